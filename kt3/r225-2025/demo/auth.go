@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Subject    string
+	CustomerID string
+	Role       string
+}
+
+// ID identifies the principal: the token subject, or the customer id for
+// tokens without one.
+func (p *Principal) ID() string {
+	if p.Subject != "" {
+		return p.Subject
+	}
+	return p.CustomerID
+}
+
+type principalContextKey struct{}
+
+func ContextWithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, p)
+}
+
+// PrincipalFromContext returns the principal put there by Authenticate.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalContextKey{}).(*Principal)
+	return p, ok
+}
+
+// JWTKey is one token verification key. HS256 keys carry a shared Secret,
+// RS256 keys a PublicKey; a key is only ever used with its own algorithm, so
+// an RSA public key can never be abused as an HMAC secret.
+type JWTKey struct {
+	ID        string
+	Algorithm string
+	Secret    []byte
+	PublicKey *rsa.PublicKey
+}
+
+// jwk is the subset of RFC 7517 fields needed for RSA and symmetric keys.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	K   string `json:"k"`
+}
+
+// ParseJWKS decodes a JWK Set with RSA ("RS256") and symmetric ("HS256")
+// signing keys. Encryption keys are skipped.
+func ParseJWKS(data []byte) ([]JWTKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parse jwks: %w", err)
+	}
+
+	var keys []JWTKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			if k.Alg != "" && k.Alg != "RS256" {
+				return nil, fmt.Errorf("jwks key %d (%s): unsupported alg %q for RSA key", i, k.Kid, k.Alg)
+			}
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("jwks key %d (%s): decode n: %w", i, k.Kid, err)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				return nil, fmt.Errorf("jwks key %d (%s): decode e: %w", i, k.Kid, err)
+			}
+			exponent := new(big.Int).SetBytes(e)
+			if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+				return nil, fmt.Errorf("jwks key %d (%s): invalid exponent", i, k.Kid)
+			}
+			pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+			if pub.N.BitLen() < 2048 {
+				return nil, fmt.Errorf("jwks key %d (%s): RSA key shorter than 2048 bits", i, k.Kid)
+			}
+			keys = append(keys, JWTKey{ID: k.Kid, Algorithm: "RS256", PublicKey: pub})
+		case "oct":
+			if k.Alg != "" && k.Alg != "HS256" {
+				return nil, fmt.Errorf("jwks key %d (%s): unsupported alg %q for symmetric key", i, k.Kid, k.Alg)
+			}
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil {
+				return nil, fmt.Errorf("jwks key %d (%s): decode k: %w", i, k.Kid, err)
+			}
+			keys = append(keys, JWTKey{ID: k.Kid, Algorithm: "HS256", Secret: secret})
+		default:
+			return nil, fmt.Errorf("jwks key %d (%s): unsupported kty %q", i, k.Kid, k.Kty)
+		}
+	}
+	return keys, nil
+}
+
+// JWTVerifier checks bearer tokens signed with HS256 or RS256 and turns
+// their claims into a Principal.
+type JWTVerifier struct {
+	keys     []JWTKey
+	issuer   string
+	audience string
+	leeway   time.Duration
+	clock    Clock
+}
+
+// NewJWTVerifier builds a verifier. An empty issuer or audience disables
+// that check.
+func NewJWTVerifier(keys []JWTKey, issuer, audience string, clock Clock) (*JWTVerifier, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("jwt verifier: no keys configured")
+	}
+	if clock == nil {
+		clock = systemClock{}
+	}
+	for _, key := range keys {
+		switch key.Algorithm {
+		case "HS256":
+			if len(key.Secret) < 32 {
+				return nil, fmt.Errorf("jwt verifier: HS256 key %q must be at least 32 bytes", key.ID)
+			}
+		case "RS256":
+			if key.PublicKey == nil {
+				return nil, fmt.Errorf("jwt verifier: RS256 key %q has no public key", key.ID)
+			}
+			if key.PublicKey.N.BitLen() < 2048 {
+				return nil, fmt.Errorf("jwt verifier: RS256 key %q is shorter than 2048 bits", key.ID)
+			}
+		default:
+			return nil, fmt.Errorf("jwt verifier: key %q has unsupported algorithm %q", key.ID, key.Algorithm)
+		}
+	}
+	return &JWTVerifier{keys: keys, issuer: issuer, audience: audience, leeway: 30 * time.Second, clock: clock}, nil
+}
+
+// IDs lists the configured key ids, for startup logging.
+func (v *JWTVerifier) IDs() []string {
+	ids := make([]string, 0, len(v.keys))
+	for _, key := range v.keys {
+		ids = append(ids, key.Algorithm+":"+key.ID)
+	}
+	return ids
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject    string      `json:"sub"`
+	CustomerID string      `json:"customer_id"`
+	Role       string      `json:"role"`
+	Issuer     string      `json:"iss"`
+	Audience   jwtAudience `json:"aud"`
+	ExpiresAt  *float64    `json:"exp"`
+	NotBefore  *float64    `json:"nbf"`
+}
+
+// jwtAudience accepts both forms of the aud claim: a string or an array.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a jwtAudience) contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify checks the token's signature and claims. exp is required; a token
+// with a kid is checked against that key only, one without against every
+// key of its algorithm.
+func (v *JWTVerifier) Verify(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenMalformed
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrTokenMalformed, err)
+	}
+	if header.Alg != "HS256" && header.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: unsupported alg %q", ErrTokenMalformed, header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrTokenMalformed, err)
+	}
+
+	if err := v.verifySignature(header, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrTokenMalformed, err)
+	}
+	return v.principal(claims)
+}
+
+func (v *JWTVerifier) verifySignature(header jwtHeader, signed string, signature []byte) error {
+	matched := false
+	for _, key := range v.keys {
+		if key.Algorithm != header.Alg || (header.Kid != "" && key.ID != header.Kid) {
+			continue
+		}
+		matched = true
+		if verifyJWTSignature(key, signed, signature) {
+			return nil
+		}
+	}
+	if !matched {
+		return fmt.Errorf("%w: kid=%q alg=%s", ErrTokenKeyUnknown, header.Kid, header.Alg)
+	}
+	return ErrTokenSignatureInvalid
+}
+
+func verifyJWTSignature(key JWTKey, signed string, signature []byte) bool {
+	switch key.Algorithm {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write([]byte(signed))
+		return hmac.Equal(mac.Sum(nil), signature)
+	case "RS256":
+		digest := sha256.Sum256([]byte(signed))
+		return rsa.VerifyPKCS1v15(key.PublicKey, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
+
+func (v *JWTVerifier) principal(claims jwtClaims) (*Principal, error) {
+	now := v.clock.Now()
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("%w: exp is required", ErrTokenClaimsInvalid)
+	}
+	if now.After(time.Unix(int64(*claims.ExpiresAt), 0).Add(v.leeway)) {
+		return nil, ErrTokenExpired
+	}
+	if claims.NotBefore != nil && now.Add(v.leeway).Before(time.Unix(int64(*claims.NotBefore), 0)) {
+		return nil, ErrTokenExpired
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrTokenClaimsInvalid, claims.Issuer)
+	}
+	if v.audience != "" && !claims.Audience.contains(v.audience) {
+		return nil, fmt.Errorf("%w: audience does not include %q", ErrTokenClaimsInvalid, v.audience)
+	}
+
+	p := &Principal{Subject: claims.Subject, CustomerID: claims.CustomerID, Role: claims.Role}
+	if p.CustomerID == "" {
+		p.CustomerID = claims.Subject
+	}
+	if p.Role == "" {
+		p.Role = RoleCustomer
+	}
+	if !isTokenRole(p.Role) {
+		return nil, fmt.Errorf("%w: unknown role %q", ErrTokenClaimsInvalid, p.Role)
+	}
+	if p.Role == RoleCustomer && p.CustomerID == "" {
+		return nil, fmt.Errorf("%w: customer token without sub or customer_id", ErrTokenClaimsInvalid)
+	}
+	return p, nil
+}
+
+func isTokenRole(role string) bool {
+	for _, r := range TokenRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Authenticate requires a valid "Authorization: Bearer <jwt>" header and
+// stores the caller's Principal in the request context.
+func Authenticate(verifier *JWTVerifier) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+			token = strings.TrimSpace(token)
+			if !strings.EqualFold(scheme, "Bearer") || token == "" {
+				writeUnauthorized(w, ErrTokenMissing)
+				return
+			}
+
+			p, err := verifier.Verify(token)
+			if err != nil {
+				log.Printf("[auth] Rejected token for %s %s: %v", r.Method, r.URL.Path, err)
+				writeUnauthorized(w, err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(ContextWithPrincipal(r.Context(), p)))
+		})
+	}
+}
+
+func writeUnauthorized(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	msg := "invalid token"
+	if errors.Is(err, ErrTokenMissing) {
+		msg = err.Error()
+	} else if errors.Is(err, ErrTokenExpired) {
+		msg = "token expired"
+	}
+	writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: msg})
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testHSSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func b64(data []byte) string { return base64.RawURLEncoding.EncodeToString(data) }
+
+func jsonPart(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return b64(data)
+}
+
+// signHS256 builds a token with an arbitrary header, HMAC-SHA256 signed.
+func signHS256(t *testing.T, secret []byte, header, claims map[string]interface{}) string {
+	t.Helper()
+	signed := jsonPart(t, header) + "." + jsonPart(t, claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + b64(mac.Sum(nil))
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	signed := jsonPart(t, map[string]interface{}{"alg": "RS256", "kid": kid}) + "." + jsonPart(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func newTestVerifier(t *testing.T, clock Clock, keys ...JWTKey) *JWTVerifier {
+	t.Helper()
+	v, err := NewJWTVerifier(keys, "", "", clock)
+	if err != nil {
+		t.Fatalf("NewJWTVerifier: %v", err)
+	}
+	return v
+}
+
+func TestJWTVerifierClaims(t *testing.T) {
+	clock := newFakeClock()
+	now := clock.Now().Unix()
+	v := newTestVerifier(t, clock, JWTKey{ID: "hs", Algorithm: "HS256", Secret: testHSSecret})
+	hs := map[string]interface{}{"alg": "HS256"}
+
+	tests := []struct {
+		name    string
+		claims  map[string]interface{}
+		want    *Principal
+		wantErr error
+	}{
+		{"defaults role and customer_id", map[string]interface{}{"sub": "c1", "exp": now + 60},
+			&Principal{Subject: "c1", CustomerID: "c1", Role: RoleCustomer}, nil},
+		{"explicit customer_id", map[string]interface{}{"sub": "u1", "customer_id": "c9", "exp": now + 60},
+			&Principal{Subject: "u1", CustomerID: "c9", Role: RoleCustomer}, nil},
+		{"staff role", map[string]interface{}{"sub": "ops", "role": RoleSupport, "exp": now + 60},
+			&Principal{Subject: "ops", CustomerID: "ops", Role: RoleSupport}, nil},
+		{"missing exp", map[string]interface{}{"sub": "c1"}, nil, ErrTokenClaimsInvalid},
+		{"expired inside leeway", map[string]interface{}{"sub": "c1", "exp": now - 30},
+			&Principal{Subject: "c1", CustomerID: "c1", Role: RoleCustomer}, nil},
+		{"expired past leeway", map[string]interface{}{"sub": "c1", "exp": now - 31}, nil, ErrTokenExpired},
+		{"not yet valid", map[string]interface{}{"sub": "c1", "exp": now + 600, "nbf": now + 31}, nil, ErrTokenExpired},
+		{"nbf inside leeway", map[string]interface{}{"sub": "c1", "exp": now + 600, "nbf": now + 30},
+			&Principal{Subject: "c1", CustomerID: "c1", Role: RoleCustomer}, nil},
+		{"unknown role", map[string]interface{}{"sub": "c1", "role": "root", "exp": now + 60}, nil, ErrTokenClaimsInvalid},
+		{"system role is not issued in tokens", map[string]interface{}{"sub": "c1", "role": RoleSystem, "exp": now + 60},
+			nil, ErrTokenClaimsInvalid},
+		{"customer without subject", map[string]interface{}{"exp": now + 60}, nil, ErrTokenClaimsInvalid},
+	}
+	for _, tc := range tests {
+		p, err := v.Verify(signHS256(t, testHSSecret, hs, tc.claims))
+		if tc.wantErr != nil {
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("%s: err = %v, want %v", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if *p != *tc.want {
+			t.Errorf("%s: principal = %+v, want %+v", tc.name, *p, *tc.want)
+		}
+	}
+}
+
+func TestJWTVerifierRejectsForgedTokens(t *testing.T) {
+	clock := newFakeClock()
+	claims := map[string]interface{}{"sub": "c1", "role": RoleAdmin, "exp": clock.Now().Unix() + 60}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	v := newTestVerifier(t, clock, JWTKey{ID: "rs", Algorithm: "RS256", PublicKey: &rsaKey.PublicKey})
+
+	if _, err := v.Verify(signRS256(t, rsaKey, "rs", claims)); err != nil {
+		t.Fatalf("valid RS256 token: %v", err)
+	}
+
+	// alg=none with an empty signature.
+	none := jsonPart(t, map[string]interface{}{"alg": "none"}) + "." + jsonPart(t, claims) + "."
+	if _, err := v.Verify(none); !errors.Is(err, ErrTokenMalformed) {
+		t.Errorf("alg=none: err = %v, want ErrTokenMalformed", err)
+	}
+
+	// HS256 "signed" with the RSA public key, the classic algorithm confusion.
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey: %v", err)
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	confused := signHS256(t, pubPEM, map[string]interface{}{"alg": "HS256", "kid": "rs"}, claims)
+	if _, err := v.Verify(confused); !errors.Is(err, ErrTokenKeyUnknown) {
+		t.Errorf("HS256 with RSA public key: err = %v, want ErrTokenKeyUnknown", err)
+	}
+
+	// Claims changed after signing.
+	valid := signRS256(t, rsaKey, "rs", map[string]interface{}{"sub": "c1", "exp": clock.Now().Unix() + 60})
+	parts := strings.Split(valid, ".")
+	tampered := parts[0] + "." + jsonPart(t, claims) + "." + parts[2]
+	if _, err := v.Verify(tampered); !errors.Is(err, ErrTokenSignatureInvalid) {
+		t.Errorf("tampered claims: err = %v, want ErrTokenSignatureInvalid", err)
+	}
+
+	if _, err := v.Verify("not-a-jwt"); !errors.Is(err, ErrTokenMalformed) {
+		t.Errorf("garbage: err = %v, want ErrTokenMalformed", err)
+	}
+}
+
+func TestJWTVerifierKeySelection(t *testing.T) {
+	clock := newFakeClock()
+	claims := map[string]interface{}{"sub": "c1", "exp": clock.Now().Unix() + 60}
+	oldSecret := []byte("old-secret-old-secret-old-secret")
+	newSecret := []byte("new-secret-new-secret-new-secret")
+	v := newTestVerifier(t, clock,
+		JWTKey{ID: "old", Algorithm: "HS256", Secret: oldSecret},
+		JWTKey{ID: "new", Algorithm: "HS256", Secret: newSecret})
+
+	tests := []struct {
+		name    string
+		secret  []byte
+		kid     string
+		wantErr error
+	}{
+		{"kid selects its key", newSecret, "new", nil},
+		{"older key still accepted", oldSecret, "old", nil},
+		{"no kid tries every key", oldSecret, "", nil},
+		{"kid names another key", oldSecret, "new", ErrTokenSignatureInvalid},
+		{"unknown kid", newSecret, "retired", ErrTokenKeyUnknown},
+		{"unknown secret", testHSSecret, "", ErrTokenSignatureInvalid},
+	}
+	for _, tc := range tests {
+		header := map[string]interface{}{"alg": "HS256"}
+		if tc.kid != "" {
+			header["kid"] = tc.kid
+		}
+		_, err := v.Verify(signHS256(t, tc.secret, header, claims))
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: err = %v, want %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestJWTVerifierRejectsWeakKeys(t *testing.T) {
+	if _, err := NewJWTVerifier([]JWTKey{{ID: "short", Algorithm: "HS256", Secret: []byte("too-short")}}, "", "", nil); err == nil {
+		t.Error("HS256 secret under 32 bytes accepted")
+	}
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	if _, err := NewJWTVerifier([]JWTKey{{ID: "small", Algorithm: "RS256", PublicKey: &small.PublicKey}}, "", "", nil); err == nil {
+		t.Error("1024-bit RSA key accepted")
+	}
+
+	jwks := `{"keys":[{"kty":"RSA","kid":"small","alg":"RS256","n":"` + b64(small.PublicKey.N.Bytes()) +
+		`","e":"` + b64(big.NewInt(int64(small.PublicKey.E)).Bytes()) + `"}]}`
+	if _, err := ParseJWKS([]byte(jwks)); err == nil {
+		t.Error("JWKS with a 1024-bit RSA key accepted")
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	jwks := `{"keys":[
+		{"kty":"RSA","kid":"rs1","use":"sig","n":"` + b64(key.PublicKey.N.Bytes()) + `","e":"AQAB"},
+		{"kty":"oct","kid":"hs1","alg":"HS256","k":"` + b64(testHSSecret) + `"},
+		{"kty":"RSA","kid":"enc","use":"enc","n":"AQAB","e":"AQAB"}
+	]}`
+	keys, err := ParseJWKS([]byte(jwks))
+	if err != nil {
+		t.Fatalf("ParseJWKS: %v", err)
+	}
+	if len(keys) != 2 || keys[0].ID != "rs1" || keys[0].Algorithm != "RS256" || keys[1].ID != "hs1" || keys[1].Algorithm != "HS256" {
+		t.Fatalf("keys = %+v", keys)
+	}
+
+	clock := newFakeClock()
+	v := newTestVerifier(t, clock, keys...)
+	if _, err := v.Verify(signRS256(t, key, "rs1", map[string]interface{}{"sub": "c1", "exp": clock.Now().Unix() + 60})); err != nil {
+		t.Errorf("token for JWKS RSA key: %v", err)
+	}
+
+	if _, err := ParseJWKS([]byte(`{"keys":[{"kty":"RSA","kid":"x","alg":"HS256","n":"AQAB","e":"AQAB"}]}`)); err == nil {
+		t.Error("RSA key declared as HS256 accepted")
+	}
+}
+
+func TestAuthenticateMiddleware(t *testing.T) {
+	clock := newFakeClock()
+	v := newTestVerifier(t, clock, JWTKey{ID: "hs", Algorithm: "HS256", Secret: testHSSecret})
+	var got *Principal
+	h := Authenticate(v)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = PrincipalFromContext(r.Context())
+	}))
+
+	token := signHS256(t, testHSSecret, map[string]interface{}{"alg": "HS256"},
+		map[string]interface{}{"sub": "c1", "exp": clock.Now().Add(time.Minute).Unix()})
+	tests := []struct {
+		auth string
+		want int
+	}{
+		{"Bearer " + token, http.StatusOK},
+		{"bearer " + token, http.StatusOK},
+		{"", http.StatusUnauthorized},
+		{"Basic " + token, http.StatusUnauthorized},
+		{"Bearer " + token + "x", http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		got = nil
+		req := httptest.NewRequest(http.MethodGet, "/orders/o1", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%q: status %d, want %d", tc.auth, rec.Code, tc.want)
+		}
+		if tc.want == http.StatusOK && (got == nil || got.CustomerID != "c1") {
+			t.Errorf("%q: principal = %+v", tc.auth, got)
+		}
+		if tc.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%q: no WWW-Authenticate header", tc.auth)
+		}
+	}
+}
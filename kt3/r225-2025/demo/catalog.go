@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CatalogProduct is the catalog's current data for one product.
+type CatalogProduct struct {
+	ProductID string `json:"product_id"`
+	SKU       string `json:"sku"`
+	Name      string `json:"name"`
+	UnitPrice Money  `json:"unit_price"`
+}
+
+// CatalogClient looks up products in the Catalog service. It returns
+// ErrProductNotFound for unknown products and wraps ErrCatalogUnavailable
+// when the catalog cannot answer.
+type CatalogClient interface {
+	GetProduct(ctx context.Context, productID string) (*CatalogProduct, error)
+}
+
+// maxCatalogResponseBytes bounds how much of a catalog response is read; a
+// single product is far smaller.
+const maxCatalogResponseBytes = 64 << 10
+
+// HTTPCatalogClient calls GET <baseURL>/products/{productID}.
+type HTTPCatalogClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewHTTPCatalogClient(baseURL string, timeout time.Duration) *HTTPCatalogClient {
+	return &HTTPCatalogClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+func (c *HTTPCatalogClient) GetProduct(ctx context.Context, productID string) (*CatalogProduct, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/products/"+url.PathEscape(productID), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCatalogUnavailable, err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCatalogUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%w: %s", ErrProductNotFound, productID)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%w: catalog returned %d for %s", ErrCatalogUnavailable, resp.StatusCode, productID)
+	}
+
+	var product CatalogProduct
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxCatalogResponseBytes)).Decode(&product); err != nil {
+		return nil, fmt.Errorf("%w: decode product %s: %v", ErrCatalogUnavailable, productID, err)
+	}
+	if product.ProductID != productID {
+		return nil, fmt.Errorf("%w: asked for %s, got %s", ErrCatalogUnavailable, productID, product.ProductID)
+	}
+	if err := product.UnitPrice.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: product %s: %v", ErrCatalogUnavailable, productID, err)
+	}
+	return &product, nil
+}
+
+// FakeCatalogClient serves a fixed in-process catalog, for local demos and
+// STORE_BACKEND=memory runs without a Catalog service.
+type FakeCatalogClient struct {
+	mu       sync.RWMutex
+	products map[string]CatalogProduct
+}
+
+func NewFakeCatalogClient(products ...CatalogProduct) *FakeCatalogClient {
+	c := &FakeCatalogClient{products: make(map[string]CatalogProduct)}
+	for _, p := range products {
+		c.SetProduct(p)
+	}
+	return c
+}
+
+// DemoCatalogProducts are the products the attack scripts and README
+// examples order.
+var DemoCatalogProducts = []CatalogProduct{
+	{ProductID: "p1", SKU: "SKU-P1", Name: "Demo product", UnitPrice: Money{Amount: 4999, Currency: "EUR"}},
+	{ProductID: "laptop-01", SKU: "SKU-LAP-01", Name: "Laptop", UnitPrice: Money{Amount: 129999, Currency: "EUR"}},
+	{ProductID: "phone-01", SKU: "SKU-PHN-01", Name: "Phone", UnitPrice: Money{Amount: 99999, Currency: "EUR"}},
+}
+
+// SetProduct adds or replaces a product, e.g. to simulate a price change.
+func (c *FakeCatalogClient) SetProduct(p CatalogProduct) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.products[p.ProductID] = p
+}
+
+func (c *FakeCatalogClient) GetProduct(_ context.Context, productID string) (*CatalogProduct, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	p, ok := c.products[productID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrProductNotFound, productID)
+	}
+	return &p, nil
+}
+
+// snapshotItems prices the requested items from the catalog. Client-sent
+// prices are never used for the order; if one is present it is the price the
+// customer was shown, and a mismatch with the catalog returns ErrPriceChanged
+// so the customer can confirm the new price instead of being charged it
+// silently. Each distinct product is looked up once, however many lines
+// name it.
+func snapshotItems(ctx context.Context, catalog CatalogClient, items []OrderItem) ([]ItemSnapshot, error) {
+	if len(items) > MaxOrderItems {
+		return nil, fmt.Errorf("%w: %d items, at most %d", ErrTooManyItems, len(items), MaxOrderItems)
+	}
+	capturedAt := time.Now().UTC()
+	products := make(map[string]*CatalogProduct, len(items))
+	snapshots := make([]ItemSnapshot, 0, len(items))
+	for i, item := range items {
+		product, ok := products[item.ProductID]
+		if !ok {
+			var err error
+			if product, err = catalog.GetProduct(ctx, item.ProductID); err != nil {
+				return nil, err
+			}
+			products[item.ProductID] = product
+		}
+		if item.Price != (Money{}) && item.Price != product.UnitPrice {
+			return nil, fmt.Errorf("%w: %s is now %s (you saw %s)",
+				ErrPriceChanged, item.ProductID, product.UnitPrice, item.Price)
+		}
+		snapshots = append(snapshots, ItemSnapshot{
+			LineNo:     i,
+			ProductID:  product.ProductID,
+			SKU:        product.SKU,
+			Name:       product.Name,
+			UnitPrice:  product.UnitPrice,
+			Quantity:   item.Quantity,
+			CapturedAt: capturedAt,
+		})
+	}
+	return snapshots, nil
+}
+
+// snapshotOrderItems turns snapshot lines into order items and their total.
+// It refuses more than MaxOrderItems lines, which keeps the write batches
+// bounded whatever the caller validated.
+func snapshotOrderItems(snapshots []ItemSnapshot) ([]OrderItem, Money, error) {
+	if len(snapshots) > MaxOrderItems {
+		return nil, Money{}, fmt.Errorf("%w: %d items, at most %d", ErrTooManyItems, len(snapshots), MaxOrderItems)
+	}
+	items := make([]OrderItem, 0, len(snapshots))
+	for _, s := range snapshots {
+		items = append(items, OrderItem{ProductID: s.ProductID, Quantity: s.Quantity, Price: s.UnitPrice})
+	}
+	total, err := orderTotal(items)
+	if err != nil {
+		return nil, Money{}, err
+	}
+	return items, total, nil
+}
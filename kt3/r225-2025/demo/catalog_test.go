@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingCatalog counts lookups per product.
+type countingCatalog struct {
+	*FakeCatalogClient
+	calls map[string]int
+}
+
+func (c *countingCatalog) GetProduct(ctx context.Context, productID string) (*CatalogProduct, error) {
+	c.calls[productID]++
+	return c.FakeCatalogClient.GetProduct(ctx, productID)
+}
+
+func TestSnapshotItemsLooksUpEachProductOnce(t *testing.T) {
+	catalog := &countingCatalog{FakeCatalogClient: NewFakeCatalogClient(DemoCatalogProducts...), calls: map[string]int{}}
+	items := []OrderItem{
+		{ProductID: "p1", Quantity: 1},
+		{ProductID: "laptop-01", Quantity: 1},
+		{ProductID: "p1", Quantity: 3},
+	}
+
+	snapshots, err := snapshotItems(context.Background(), catalog, items)
+	if err != nil {
+		t.Fatalf("snapshotItems: %v", err)
+	}
+	if len(snapshots) != len(items) {
+		t.Fatalf("%d snapshot lines, want %d", len(snapshots), len(items))
+	}
+	for id, n := range catalog.calls {
+		if n != 1 {
+			t.Errorf("product %s looked up %d times, want 1", id, n)
+		}
+	}
+}
+
+func TestSnapshotItemsRejectsTooManyItems(t *testing.T) {
+	catalog := &countingCatalog{FakeCatalogClient: NewFakeCatalogClient(DemoCatalogProducts...), calls: map[string]int{}}
+	items := make([]OrderItem, MaxOrderItems+1)
+	for i := range items {
+		items[i] = OrderItem{ProductID: "p1", Quantity: 1}
+	}
+
+	if _, err := snapshotItems(context.Background(), catalog, items); !errors.Is(err, ErrTooManyItems) {
+		t.Fatalf("err = %v, want ErrTooManyItems", err)
+	}
+	if len(catalog.calls) != 0 {
+		t.Fatalf("catalog called %v before the item count was checked", catalog.calls)
+	}
+}
+
+func TestHTTPCatalogClientLimitsResponseBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte(`{"product_id":"p1","name":"` + strings.Repeat("x", 2*maxCatalogResponseBytes) + `"}`))
+	}))
+	defer srv.Close()
+
+	_, err := NewHTTPCatalogClient(srv.URL, time.Second).GetProduct(context.Background(), "p1")
+	if !errors.Is(err, ErrCatalogUnavailable) {
+		t.Fatalf("err = %v, want ErrCatalogUnavailable", err)
+	}
+}
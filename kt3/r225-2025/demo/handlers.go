@@ -1,28 +1,84 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 type Handlers struct {
-	store         *OrderStore
-	sm            *StateMachine
-	webhookSecret string
+	store     OrderStore
+	catalog   CatalogClient
+	refunds   RefundStore
+	shipments ShipmentStore
+	sm        *StateMachine
+	policy    *AccessPolicy
+	shipping  *ShippingEventProcessor
+	webhook   WebhookConfig
+	cursorKey []byte
 }
 
-func NewHandlers(store *OrderStore, sm *StateMachine, webhookSecret string) *Handlers {
-	return &Handlers{store: store, sm: sm, webhookSecret: webhookSecret}
+// NewHandlers wires the API handlers. cursorKey signs the pagination cursors
+// of the order listings; every instance behind one API must share it.
+func NewHandlers(store OrderStore, catalog CatalogClient, refunds RefundStore, shipments ShipmentStore, sm *StateMachine, policy *AccessPolicy, webhook WebhookConfig, cursorKey []byte) *Handlers {
+	return &Handlers{
+		store:     store,
+		catalog:   catalog,
+		refunds:   refunds,
+		shipments: shipments,
+		sm:        sm,
+		policy:    policy,
+		shipping:  NewShippingEventProcessor(store, shipments, sm),
+		webhook:   webhook,
+		cursorKey: cursorKey,
+	}
+}
+
+// Routes registers the API routes on r. The caller supplies the middleware:
+// authentication, authorization and idempotency.
+func (h *Handlers) Routes(r chi.Router) {
+	r.Post("/orders", h.CreateOrder)
+	r.Get("/orders/{orderID}", h.GetOrder)
+	r.Post("/orders/{orderID}/checkout", h.CheckoutOrder)
+	r.Post("/orders/{orderID}/pay", h.PayOrder)
+	r.Post("/orders/{orderID}/payment-failed", h.FailPayment)
+	r.Post("/orders/{orderID}/cancel", h.CancelOrder)
+	r.Post("/orders/{orderID}/ship", h.ShipOrder)
+	r.Post("/orders/{orderID}/return-request", h.RequestReturn)
+	r.Post("/orders/{orderID}/return", h.ReturnOrder)
+	r.Post("/orders/{orderID}/refund", h.RefundOrder)
+	r.Post("/orders/{orderID}/refund/complete", h.CompleteRefund)
+	r.Get("/orders/{orderID}/refund", h.GetRefund)
+	r.Get("/orders/{orderID}/history", h.GetOrderHistory)
+	r.Get("/orders/{orderID}/snapshot", h.GetOrderSnapshot)
+	r.Get("/orders/{orderID}/shipments", h.GetOrderShipments)
+	r.Get("/orders/{orderID}/tracking", h.GetOrderTracking)
+	r.Get("/shipments/{shipmentID}", h.GetShipment)
+	r.Get("/customers/{customerID}/orders", h.ListCustomerOrders)
+	r.Get("/admin/orders", h.ListOrdersByStatus)
+
+	// Shipping webhook endpoints (receive status updates from the
+	// logistics provider): a carrier service account token plus a valid
+	// webhook signature.
+	r.Post("/webhooks/shipping", h.ShippingWebhook)
+	r.Post("/webhooks/shipping/v2", h.ShippingWebhookV2)
 }
 
 func (h *Handlers) CreateOrder(w http.ResponseWriter, r *http.Request) {
@@ -32,19 +88,79 @@ func (h *Handlers) CreateOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Customers always order for themselves; only roles that act on every
+	// customer's orders may place one on behalf of someone else.
+	p, ok := PrincipalFromContext(r.Context())
+	if !ok {
+		writeUnauthorized(w, ErrTokenMissing)
+		return
+	}
+	if !h.policy.AnyOrder(p.Role) {
+		if req.CustomerID != "" && req.CustomerID != p.CustomerID {
+			writeJSON(w, http.StatusForbidden, ErrorResponse{Error: "customer_id does not match the authenticated customer"})
+			return
+		}
+		req.CustomerID = p.CustomerID
+	}
+
 	if req.CustomerID == "" || len(req.Items) == 0 {
 		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "customer_id and items are required"})
 		return
 	}
+	if len(req.Items) > MaxOrderItems {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("an order holds at most %d items", MaxOrderItems),
+		})
+		return
+	}
+	for i, item := range req.Items {
+		if item.ProductID == "" || item.Quantity <= 0 {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{
+				Error: fmt.Sprintf("item %d: product_id and a positive quantity are required", i),
+			})
+			return
+		}
+		if item.Quantity > MaxItemQuantity {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{
+				Error: fmt.Sprintf("item %d: quantity is at most %d", i, MaxItemQuantity),
+			})
+			return
+		}
+		if item.Price == (Money{}) {
+			continue
+		}
+		if err := item.Price.Validate(); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("item %d: %v", i, err)})
+			return
+		}
+	}
 
-	order, err := h.store.CreateOrder(r.Context(), req)
+	snapshots, err := snapshotItems(r.Context(), h.catalog, req.Items)
 	if err != nil {
+		switch {
+		case errors.Is(err, ErrProductNotFound), errors.Is(err, ErrTooManyItems):
+			writeJSON(w, http.StatusUnprocessableEntity, ErrorResponse{Error: err.Error()})
+		case errors.Is(err, ErrPriceChanged):
+			writeJSON(w, http.StatusConflict, ErrorResponse{Error: err.Error()})
+		default:
+			log.Printf("[handler] CreateOrder catalog error: %v", err)
+			writeJSON(w, http.StatusServiceUnavailable, ErrorResponse{Error: "catalog unavailable, try again later"})
+		}
+		return
+	}
+
+	order, err := h.store.CreateOrder(r.Context(), req.CustomerID, snapshots)
+	if err != nil {
+		if errors.Is(err, ErrInvalidMoney) || errors.Is(err, ErrCurrencyMismatch) || errors.Is(err, ErrTooManyItems) {
+			writeJSON(w, http.StatusUnprocessableEntity, ErrorResponse{Error: err.Error()})
+			return
+		}
 		log.Printf("[handler] CreateOrder error: %v", err)
 		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to create order"})
 		return
 	}
 
-	log.Printf("[handler] Created order %s for customer %s (total=%.2f)",
+	log.Printf("[handler] Created order %s for customer %s (total=%s)",
 		order.OrderID, order.CustomerID, order.Total)
 
 	writeJSON(w, http.StatusCreated, order)
@@ -53,22 +169,39 @@ func (h *Handlers) CreateOrder(w http.ResponseWriter, r *http.Request) {
 func (h *Handlers) GetOrder(w http.ResponseWriter, r *http.Request) {
 	orderID := chi.URLParam(r, "orderID")
 
-	order, err := h.store.GetOrder(r.Context(), orderID)
-	if err != nil {
-		if errors.Is(err, ErrOrderNotFound) {
-			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "order not found"})
-			return
-		}
-		log.Printf("[handler] GetOrder error: %v", err)
-		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to get order"})
+	order := h.orderForCaller(w, r, "GetOrder", orderID)
+	if order == nil {
 		return
 	}
 
 	writeJSON(w, http.StatusOK, order)
 }
 
+// GetOrderSnapshot returns the catalog data captured when the order was
+// placed. It never changes, whatever happens to the catalog afterwards.
+func (h *Handlers) GetOrderSnapshot(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "orderID")
+
+	if h.orderForCaller(w, r, "GetOrderSnapshot", orderID) == nil {
+		return
+	}
+
+	snapshots, err := h.store.GetItemSnapshots(r.Context(), orderID)
+	if err != nil {
+		log.Printf("[handler] GetOrderSnapshot error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to get item snapshots"})
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshots)
+}
+
+// PayOrder records the payment provider's confirmation and moves the order to
+// PAID. Customers start a payment with CheckoutOrder; they cannot call this.
 func (h *Handlers) PayOrder(w http.ResponseWriter, r *http.Request) {
 	orderID := chi.URLParam(r, "orderID")
+	if h.orderForCaller(w, r, "PayOrder", orderID) == nil {
+		return
+	}
 
 	var req PayOrderRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -76,23 +209,13 @@ func (h *Handlers) PayOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := h.sm.Transition(r.Context(), orderID, StatusPaid, "payment confirmed: "+req.PaymentID)
+	err := h.sm.Transition(r.Context(), orderID, StatusPaid, "payment confirmed: "+req.PaymentID,
+		TransitionInputs{"payment_id": req.PaymentID})
 	if err != nil {
-		if errors.Is(err, ErrOrderNotFound) {
-			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "order not found"})
-			return
-		}
-		if errors.Is(err, ErrTransitionNotAllowed) || errors.Is(err, ErrTransitionConflict) || errors.Is(err, ErrLockNotAcquired) || errors.Is(err, ErrLockExpired) {
-			writeJSON(w, http.StatusConflict, ErrorResponse{Error: err.Error()})
-			return
-		}
-		log.Printf("[handler] PayOrder error: %v", err)
-		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to process payment"})
+		writeTransitionError(w, "PayOrder", "failed to process payment", err)
 		return
 	}
 
-	_ = h.store.UpdateOrderPaymentID(r.Context(), orderID, req.PaymentID)
-
 	log.Printf("[handler] Order %s marked as PAID (payment_id=%s)", orderID, req.PaymentID)
 	writeJSON(w, http.StatusOK, map[string]string{
 		"order_id": orderID,
@@ -103,6 +226,9 @@ func (h *Handlers) PayOrder(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handlers) CancelOrder(w http.ResponseWriter, r *http.Request) {
 	orderID := chi.URLParam(r, "orderID")
+	if h.orderForCaller(w, r, "CancelOrder", orderID) == nil {
+		return
+	}
 
 	var req CancelOrderRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -115,18 +241,9 @@ func (h *Handlers) CancelOrder(w http.ResponseWriter, r *http.Request) {
 		reason = "cancelled by customer"
 	}
 
-	err := h.sm.Transition(r.Context(), orderID, StatusCancelled, reason)
+	err := h.sm.Transition(r.Context(), orderID, StatusCancelled, reason, nil)
 	if err != nil {
-		if errors.Is(err, ErrOrderNotFound) {
-			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "order not found"})
-			return
-		}
-		if errors.Is(err, ErrTransitionNotAllowed) || errors.Is(err, ErrTransitionConflict) || errors.Is(err, ErrLockNotAcquired) || errors.Is(err, ErrLockExpired) {
-			writeJSON(w, http.StatusConflict, ErrorResponse{Error: err.Error()})
-			return
-		}
-		log.Printf("[handler] CancelOrder error: %v", err)
-		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to cancel order"})
+		writeTransitionError(w, "CancelOrder", "failed to cancel order", err)
 		return
 	}
 
@@ -140,145 +257,336 @@ func (h *Handlers) CancelOrder(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handlers) ShipOrder(w http.ResponseWriter, r *http.Request) {
 	orderID := chi.URLParam(r, "orderID")
+	if h.orderForCaller(w, r, "ShipOrder", orderID) == nil {
+		return
+	}
+
+	// The body is optional: without a carrier-supplied shipment id one is
+	// assigned here.
+	var req ShipOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+	if req.ShipmentID == "" {
+		req.ShipmentID = uuid.New().String()
+	}
 
-	err := h.sm.Transition(r.Context(), orderID, StatusShipping, "shipment initiated")
+	// Bind the shipment before the transition so no webhook can ever see a
+	// SHIPPING order without it. If the transition then fails, a binding
+	// this request created is removed again.
+	created, err := h.shipments.RegisterShipment(r.Context(), &Shipment{
+		ShipmentID:     req.ShipmentID,
+		OrderID:        orderID,
+		Carrier:        req.Carrier,
+		TrackingNumber: req.TrackingNumber,
+		Status:         ShipmentStatusRegistered,
+		UpdatedAt:      time.Now().UTC(),
+	})
 	if err != nil {
-		if errors.Is(err, ErrOrderNotFound) {
-			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "order not found"})
-			return
-		}
-		if errors.Is(err, ErrTransitionNotAllowed) || errors.Is(err, ErrTransitionConflict) || errors.Is(err, ErrLockNotAcquired) || errors.Is(err, ErrLockExpired) {
-			writeJSON(w, http.StatusConflict, ErrorResponse{Error: err.Error()})
+		if errors.Is(err, ErrShipmentOrderMismatch) {
+			// Log the other order id but do not reveal it to the caller.
+			log.Printf("[handler] ShipOrder rejected for order %s: %v", orderID, err)
+			writeJSON(w, http.StatusConflict, ErrorResponse{Error: ErrShipmentOrderMismatch.Error()})
 			return
 		}
 		log.Printf("[handler] ShipOrder error: %v", err)
-		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to initiate shipping"})
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to register shipment"})
+		return
+	}
+
+	err = h.sm.Transition(r.Context(), orderID, StatusShipping,
+		fmt.Sprintf("shipment initiated (shipment %s)", req.ShipmentID), nil)
+	if err != nil {
+		if created {
+			if delErr := h.shipments.UnregisterShipment(context.WithoutCancel(r.Context()), req.ShipmentID, orderID); delErr != nil {
+				log.Printf("[handler] ShipOrder: could not remove shipment %s of unshipped order %s: %v", req.ShipmentID, orderID, delErr)
+			}
+		}
+		writeTransitionError(w, "ShipOrder", "failed to initiate shipping", err)
+		return
+	}
+
+	log.Printf("[handler] Order %s marked as SHIPPING (shipment %s)", orderID, req.ShipmentID)
+	writeJSON(w, http.StatusOK, map[string]string{
+		"order_id":    orderID,
+		"shipment_id": req.ShipmentID,
+		"status":      StatusShipping,
+		"message":     "shipping initiated",
+	})
+}
+
+// CheckoutOrder moves a CREATED order to PENDING_PAYMENT. It is also how a
+// customer retries after PAYMENT_FAILED.
+func (h *Handlers) CheckoutOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "orderID")
+	if h.orderForCaller(w, r, "CheckoutOrder", orderID) == nil {
 		return
 	}
 
-	log.Printf("[handler] Order %s marked as SHIPPING", orderID)
+	err := h.sm.Transition(r.Context(), orderID, StatusPendingPayment, "awaiting payment", nil)
+	if err != nil {
+		writeTransitionError(w, "CheckoutOrder", "failed to start checkout", err)
+		return
+	}
+
+	log.Printf("[handler] Order %s marked as PENDING_PAYMENT", orderID)
 	writeJSON(w, http.StatusOK, map[string]string{
 		"order_id": orderID,
-		"status":   StatusShipping,
-		"message":  "shipping initiated",
+		"status":   StatusPendingPayment,
+		"message":  "awaiting payment",
 	})
 }
 
-func (h *Handlers) ShippingWebhook(w http.ResponseWriter, r *http.Request) {
-	rawBody, err := io.ReadAll(r.Body)
+func (h *Handlers) FailPayment(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "orderID")
+	if h.orderForCaller(w, r, "FailPayment", orderID) == nil {
+		return
+	}
+
+	var req PaymentFailedRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+
+	reason := req.Reason
+	if reason == "" {
+		reason = "payment declined"
+	}
+
+	err := h.sm.Transition(r.Context(), orderID, StatusPaymentFailed, reason, nil)
 	if err != nil {
-		log.Printf("[webhook] Failed to read request body: %v", err)
-		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "failed to read body"})
+		writeTransitionError(w, "FailPayment", "failed to record payment failure", err)
 		return
 	}
-	defer r.Body.Close()
 
-	signature := r.Header.Get("X-Webhook-Signature")
-	if signature == "" {
-		log.Printf("[webhook] Missing X-Webhook-Signature header")
-		writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "missing signature header"})
+	log.Printf("[handler] Order %s marked as PAYMENT_FAILED (reason: %s)", orderID, reason)
+	writeJSON(w, http.StatusOK, map[string]string{
+		"order_id": orderID,
+		"status":   StatusPaymentFailed,
+		"message":  "payment failure recorded",
+	})
+}
+
+// RequestReturn records that the customer wants to send a delivered order
+// back. The order only becomes RETURNED, and refundable, once the warehouse
+// or the carrier confirms the goods arrived.
+func (h *Handlers) RequestReturn(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "orderID")
+	if h.orderForCaller(w, r, "RequestReturn", orderID) == nil {
 		return
 	}
 
-	if !VerifyWebhookSignature(rawBody, signature, h.webhookSecret) {
-		log.Printf("[webhook] Signature verification FAILED")
-		writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "invalid webhook signature"})
+	var req ReturnOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
 		return
 	}
 
-	log.Printf("[webhook] Signature verification PASSED")
+	reason := req.Reason
+	if reason == "" {
+		reason = "return requested by customer"
+	}
 
-	var event ShippingWebhookEvent
-	if err := json.Unmarshal(rawBody, &event); err != nil {
-		log.Printf("[webhook] Failed to parse webhook event: %v", err)
-		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid event payload"})
+	err := h.sm.Transition(r.Context(), orderID, StatusReturnRequested, reason, nil)
+	if err != nil {
+		writeTransitionError(w, "RequestReturn", "failed to request return", err)
 		return
 	}
 
-	log.Printf("[webhook] Received event: shipment=%s order=%s type=%s status=%s",
-		event.ShipmentID, event.OrderID, event.EventType, event.Status)
+	log.Printf("[handler] Order %s: return requested (reason: %s)", orderID, reason)
+	writeJSON(w, http.StatusOK, map[string]string{
+		"order_id": orderID,
+		"status":   StatusReturnRequested,
+		"message":  "return requested",
+	})
+}
+
+func (h *Handlers) ReturnOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "orderID")
+	if h.orderForCaller(w, r, "ReturnOrder", orderID) == nil {
+		return
+	}
 
-	if event.OrderID == "" || event.ShipmentID == "" {
-		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "order_id and shipment_id are required"})
+	var req ReturnOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
 		return
 	}
 
-	order, err := h.store.GetOrder(r.Context(), event.OrderID)
+	reason := req.Reason
+	if reason == "" {
+		reason = "return received"
+	}
+
+	err := h.sm.Transition(r.Context(), orderID, StatusReturned, reason, nil)
 	if err != nil {
-		if errors.Is(err, ErrOrderNotFound) {
-			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "order not found"})
-			return
-		}
-		log.Printf("[webhook] GetOrder error: %v", err)
-		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to get order"})
+		writeTransitionError(w, "ReturnOrder", "failed to return order", err)
 		return
 	}
 
-	if order.Status != StatusShipping {
-		log.Printf("[webhook] Order %s is not in SHIPPING state (current=%s), ignoring", event.OrderID, order.Status)
-		writeJSON(w, http.StatusConflict, ErrorResponse{
-			Error: fmt.Sprintf("order is in %s state, expected SHIPPING", order.Status),
-		})
+	log.Printf("[handler] Order %s marked as RETURNED (reason: %s)", orderID, reason)
+	writeJSON(w, http.StatusOK, map[string]string{
+		"order_id": orderID,
+		"status":   StatusReturned,
+		"message":  "return recorded",
+	})
+}
+
+func (h *Handlers) RefundOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "orderID")
+	if h.orderForCaller(w, r, "RefundOrder", orderID) == nil {
 		return
 	}
 
-	var newStatus, reason string
-	var refundTriggered bool
-
-	switch event.Status {
-	case ShipStatusDelivered:
-		newStatus = StatusDelivered
-		reason = fmt.Sprintf("delivered — confirmed by webhook (shipment %s)", event.ShipmentID)
-
-	case ShipStatusLost, ShipStatusDamaged:
-		newStatus = StatusShipFailed
-		reason = fmt.Sprintf("shipment %s — refund initiated (shipment %s)",
-			strings.ToLower(event.Status), event.ShipmentID)
-		refundTriggered = true
-		log.Printf("[webhook] *** REFUND TRIGGERED for order %s (shipment %s, reason: %s) ***",
-			event.OrderID, event.ShipmentID, event.Status)
-
-	case ShipStatusInTransit:
-		log.Printf("[webhook] Order %s: shipment %s is in transit", event.OrderID, event.ShipmentID)
-		writeJSON(w, http.StatusOK, ShippingWebhookResponse{
-			OrderID:         event.OrderID,
-			ShipmentID:      event.ShipmentID,
-			PreviousStatus:  order.Status,
-			NewStatus:       order.Status,
-			RefundTriggered: false,
-			Message:         "status noted, no state change",
-		})
+	var req RefundOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+
+	reason := req.Reason
+	if reason == "" {
+		reason = "refund requested"
+	}
+
+	err := h.sm.Transition(r.Context(), orderID, StatusRefundPending, reason, nil)
+	if err != nil {
+		writeTransitionError(w, "RefundOrder", "failed to request refund", err)
+		return
+	}
+
+	log.Printf("[handler] Order %s marked as REFUND_PENDING (reason: %s)", orderID, reason)
+	writeJSON(w, http.StatusOK, map[string]string{
+		"order_id": orderID,
+		"status":   StatusRefundPending,
+		"message":  "refund requested",
+	})
+}
+
+func (h *Handlers) CompleteRefund(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "orderID")
+	if h.orderForCaller(w, r, "CompleteRefund", orderID) == nil {
+		return
+	}
+
+	var req CompleteRefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+
+	if req.RefundRef == "" {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "refund_ref is required"})
 		return
+	}
+	if !h.settleRefundManually(w, r, orderID, req.RefundRef) {
+		return
+	}
+
+	err := h.sm.Transition(r.Context(), orderID, StatusRefunded, "refund completed: "+req.RefundRef,
+		TransitionInputs{"refund_ref": req.RefundRef})
+	if err != nil {
+		writeTransitionError(w, "CompleteRefund", "failed to complete refund", err)
+		return
+	}
+
+	log.Printf("[handler] Order %s marked as REFUNDED (refund_ref=%s)", orderID, req.RefundRef)
+	writeJSON(w, http.StatusOK, map[string]string{
+		"order_id": orderID,
+		"status":   StatusRefunded,
+		"message":  "refund completed",
+	})
+}
 
-	case ShipStatusReturned:
-		newStatus = StatusShipFailed
-		reason = fmt.Sprintf("shipment returned (shipment %s)", event.ShipmentID)
+// settleRefundManually checks that the order's refund may be completed by
+// hand and records refundRef on it. The worker owns PENDING and PROCESSING
+// refunds, so they are refused: the order must not show REFUNDED before the
+// provider has paid. A FAILED refund is one the worker gave up on and was
+// paid out some other way; it is marked SUCCEEDED with refundRef. An already
+// SUCCEEDED refund only needs its order completed. On failure the error
+// response is written and false returned.
+func (h *Handlers) settleRefundManually(w http.ResponseWriter, r *http.Request, orderID, refundRef string) bool {
+	refund, err := h.refunds.GetRefund(r.Context(), orderID)
+	if err != nil {
+		if errors.Is(err, ErrRefundNotFound) {
+			writeJSON(w, http.StatusConflict, ErrorResponse{Error: "order has no refund to complete"})
+			return false
+		}
+		log.Printf("[handler] CompleteRefund error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to complete refund"})
+		return false
+	}
 
+	switch refund.Status {
+	case RefundStatusSucceeded:
+		return true
+	case RefundStatusFailed:
+		settled := *refund
+		settled.Status = RefundStatusSucceeded
+		settled.ProviderRef = refundRef
+		settled.UpdatedAt = refundTimestamp()
+		ok, err := h.refunds.UpdateRefund(r.Context(), refund, &settled)
+		if err != nil {
+			log.Printf("[handler] CompleteRefund error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to complete refund"})
+			return false
+		}
+		if !ok {
+			w.Header().Set("Retry-After", "1")
+			writeJSON(w, http.StatusConflict, ErrorResponse{Error: "refund changed concurrently, retry"})
+			return false
+		}
+		log.Printf("[handler] Refund %s (order %s) settled manually (refund_ref=%s)", refund.RefundID, orderID, refundRef)
+		return true
+	case RefundStatusAbandoned:
+		writeJSON(w, http.StatusConflict, ErrorResponse{Error: "refund was abandoned: the order never reached REFUND_PENDING"})
+		return false
 	default:
-		log.Printf("[webhook] Unknown shipping status: %s", event.Status)
-		writeJSON(w, http.StatusBadRequest, ErrorResponse{
-			Error: fmt.Sprintf("unknown shipping status: %s", event.Status),
+		writeJSON(w, http.StatusConflict, ErrorResponse{
+			Error: fmt.Sprintf("refund is %s and is being paid out by the refund worker", refund.Status),
 		})
+		return false
+	}
+}
+
+func (h *Handlers) ShippingWebhook(w http.ResponseWriter, r *http.Request) {
+	rawBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("[webhook] Failed to read request body: %v", err)
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "failed to read body"})
+		return
+	}
+	defer r.Body.Close()
+
+	signature := r.Header.Get(WebhookSignatureHeader)
+	if signature == "" {
+		log.Printf("[webhook] Missing X-Webhook-Signature header")
+		writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "missing signature header"})
 		return
 	}
 
-	err = h.store.UpdateOrderStatus(r.Context(), event.OrderID, newStatus, reason)
+	verified, err := h.webhook.Verifier.Verify(signature, r.Header.Get(WebhookKeyIDHeader), rawBody)
 	if err != nil {
-		log.Printf("[webhook] UpdateOrderStatus error: %v", err)
-		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to update order status"})
+		log.Printf("[webhook] Signature verification FAILED: %v", err)
+		writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: err.Error()})
 		return
 	}
 
-	log.Printf("[webhook] Order %s: %s → %s (refund=%v)", event.OrderID, order.Status, newStatus, refundTriggered)
+	log.Printf("[webhook] Signature verification PASSED (key=%s, scheme=%s)", verified.KeyID, verified.Scheme)
 
-	writeJSON(w, http.StatusOK, ShippingWebhookResponse{
-		OrderID:         event.OrderID,
-		ShipmentID:      event.ShipmentID,
-		PreviousStatus:  order.Status,
-		NewStatus:       newStatus,
-		RefundTriggered: refundTriggered,
-		Message:         fmt.Sprintf("order transitioned to %s", newStatus),
-	})
+	var event ShippingWebhookEvent
+	if err := json.Unmarshal(rawBody, &event); err != nil {
+		log.Printf("[webhook] Failed to parse webhook event: %v", err)
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid event payload"})
+		return
+	}
+
+	log.Printf("[webhook] Received event: shipment=%s order=%s type=%s status=%s",
+		event.ShipmentID, event.OrderID, event.EventType, event.Status)
+
+	h.handleShippingEvent(w, r, "webhook", event)
 }
 
 func (h *Handlers) ShippingWebhookV2(w http.ResponseWriter, r *http.Request) {
@@ -290,20 +598,21 @@ func (h *Handlers) ShippingWebhookV2(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	signature := r.Header.Get("X-Webhook-Signature")
+	signature := r.Header.Get(WebhookSignatureHeader)
 	if signature == "" {
 		log.Printf("[webhook-v2] Missing X-Webhook-Signature header")
 		writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "missing signature header"})
 		return
 	}
 
-	if !VerifyWebhookSignatureRaw(rawBody, signature, h.webhookSecret) {
-		log.Printf("[webhook-v2] Signature verification FAILED")
-		writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "invalid webhook signature"})
+	verified, err := h.webhook.Verifier.Verify(signature, r.Header.Get(WebhookKeyIDHeader), rawBody)
+	if err != nil {
+		log.Printf("[webhook-v2] Signature verification FAILED: %v", err)
+		writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: err.Error()})
 		return
 	}
 
-	log.Printf("[webhook-v2] Signature verification PASSED")
+	log.Printf("[webhook-v2] Signature verification PASSED (key=%s, scheme=%s)", verified.KeyID, verified.Scheme)
 
 	// Intentionally vulnerable parser path for CVE-2024-24786 demo:
 	// protojson.Unmarshal with DiscardUnknown on older protobuf versions.
@@ -334,91 +643,110 @@ func (h *Handlers) ShippingWebhookV2(w http.ResponseWriter, r *http.Request) {
 	log.Printf("[webhook-v2] Received event: shipment=%s order=%s type=%s status=%s",
 		event.ShipmentID, event.OrderID, event.EventType, event.Status)
 
-	if event.OrderID == "" || event.ShipmentID == "" {
-		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "order_id and shipment_id are required"})
+	h.handleShippingEvent(w, r, "webhook-v2", event)
+}
+
+// GetRefund returns the refund record of an order, including its provider
+// reference and attempt count.
+func (h *Handlers) GetRefund(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "orderID")
+	if h.orderForCaller(w, r, "GetRefund", orderID) == nil {
 		return
 	}
 
-	order, err := h.store.GetOrder(r.Context(), event.OrderID)
+	refund, err := h.refunds.GetRefund(r.Context(), orderID)
 	if err != nil {
-		if errors.Is(err, ErrOrderNotFound) {
-			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "order not found"})
+		if errors.Is(err, ErrRefundNotFound) {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "refund not found"})
 			return
 		}
-		log.Printf("[webhook-v2] GetOrder error: %v", err)
-		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to get order"})
+		log.Printf("[handler] GetRefund error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to get refund"})
 		return
 	}
 
-	if order.Status != StatusShipping {
-		log.Printf("[webhook-v2] Order %s is not in SHIPPING state (current=%s), ignoring", event.OrderID, order.Status)
-		writeJSON(w, http.StatusConflict, ErrorResponse{
-			Error: fmt.Sprintf("order is in %s state, expected SHIPPING", order.Status),
-		})
+	writeJSON(w, http.StatusOK, refund)
+}
+
+func (h *Handlers) GetOrderShipments(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "orderID")
+
+	if h.orderForCaller(w, r, "GetOrderShipments", orderID) == nil {
 		return
 	}
 
-	var newStatus, reason string
-	var refundTriggered bool
-
-	switch event.Status {
-	case ShipStatusDelivered:
-		newStatus = StatusDelivered
-		reason = fmt.Sprintf("delivered — confirmed by webhook-v2 (shipment %s)", event.ShipmentID)
-
-	case ShipStatusLost, ShipStatusDamaged:
-		newStatus = StatusShipFailed
-		reason = fmt.Sprintf("shipment %s — refund initiated (shipment %s)",
-			strings.ToLower(event.Status), event.ShipmentID)
-		refundTriggered = true
-		log.Printf("[webhook-v2] *** REFUND TRIGGERED for order %s (shipment %s, reason: %s) ***",
-			event.OrderID, event.ShipmentID, event.Status)
-
-	case ShipStatusInTransit:
-		log.Printf("[webhook-v2] Order %s: shipment %s is in transit", event.OrderID, event.ShipmentID)
-		writeJSON(w, http.StatusOK, ShippingWebhookResponse{
-			OrderID:         event.OrderID,
-			ShipmentID:      event.ShipmentID,
-			PreviousStatus:  order.Status,
-			NewStatus:       order.Status,
-			RefundTriggered: false,
-			Message:         "status noted, no state change",
-		})
+	shipments, err := h.shipments.ListShipmentsByOrder(r.Context(), orderID)
+	if err != nil {
+		log.Printf("[handler] GetOrderShipments error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to get shipments"})
 		return
+	}
 
-	case ShipStatusReturned:
-		newStatus = StatusShipFailed
-		reason = fmt.Sprintf("shipment returned (shipment %s)", event.ShipmentID)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"order_id":  orderID,
+		"shipments": shipments,
+	})
+}
 
-	default:
-		log.Printf("[webhook-v2] Unknown shipping status: %s", event.Status)
-		writeJSON(w, http.StatusBadRequest, ErrorResponse{
-			Error: fmt.Sprintf("unknown shipping status: %s", event.Status),
-		})
+// GetOrderTracking returns every shipment of the order with its carrier
+// event timeline.
+func (h *Handlers) GetOrderTracking(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "orderID")
+
+	if h.orderForCaller(w, r, "GetOrderTracking", orderID) == nil {
 		return
 	}
 
-	err = h.store.UpdateOrderStatus(r.Context(), event.OrderID, newStatus, reason)
+	shipments, err := h.shipments.ListShipmentsByOrder(r.Context(), orderID)
 	if err != nil {
-		log.Printf("[webhook-v2] UpdateOrderStatus error: %v", err)
-		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to update order status"})
+		log.Printf("[handler] GetOrderTracking error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to get tracking"})
 		return
 	}
 
-	log.Printf("[webhook-v2] Order %s: %s → %s (refund=%v)", event.OrderID, order.Status, newStatus, refundTriggered)
+	tracking := make([]ShipmentTracking, 0, len(shipments))
+	for _, shipment := range shipments {
+		events, err := h.shipments.ListTrackingEvents(r.Context(), shipment.ShipmentID)
+		if err != nil {
+			log.Printf("[handler] GetOrderTracking error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to get tracking"})
+			return
+		}
+		tracking = append(tracking, ShipmentTracking{Shipment: *shipment, Events: events})
+	}
 
-	writeJSON(w, http.StatusOK, ShippingWebhookResponse{
-		OrderID:         event.OrderID,
-		ShipmentID:      event.ShipmentID,
-		PreviousStatus:  order.Status,
-		NewStatus:       newStatus,
-		RefundTriggered: refundTriggered,
-		Message:         fmt.Sprintf("order transitioned to %s", newStatus),
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"order_id":  orderID,
+		"shipments": tracking,
 	})
 }
 
+func (h *Handlers) GetShipment(w http.ResponseWriter, r *http.Request) {
+	shipmentID := chi.URLParam(r, "shipmentID")
+
+	shipment, err := h.shipments.GetShipment(r.Context(), shipmentID)
+	if err == nil {
+		_, err = h.authorizeOrder(r.Context(), "GetShipment", shipment.OrderID)
+	}
+	if err != nil {
+		// A shipment of someone else's order is reported as missing.
+		if errors.Is(err, ErrShipmentNotFound) || errors.Is(err, ErrOrderNotFound) {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "shipment not found"})
+			return
+		}
+		log.Printf("[handler] GetShipment error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to get shipment"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, shipment)
+}
+
 func (h *Handlers) GetOrderHistory(w http.ResponseWriter, r *http.Request) {
 	orderID := chi.URLParam(r, "orderID")
+	if h.orderForCaller(w, r, "GetOrderHistory", orderID) == nil {
+		return
+	}
 
 	history, err := h.store.GetOrderHistory(r.Context(), orderID)
 	if err != nil {
@@ -433,6 +761,331 @@ func (h *Handlers) GetOrderHistory(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// ListCustomerOrders lists a customer's orders, newest first, optionally
+// filtered by status and a created_at range (from inclusive, to exclusive,
+// RFC 3339). next_cursor is passed back as cursor to get the next page.
+func (h *Handlers) ListCustomerOrders(w http.ResponseWriter, r *http.Request) {
+	customerID := chi.URLParam(r, "customerID")
+
+	p, ok := PrincipalFromContext(r.Context())
+	if !ok {
+		writeUnauthorized(w, ErrTokenMissing)
+		return
+	}
+	if !h.policy.AnyOrder(p.Role) && p.CustomerID != customerID {
+		log.Printf("[auth] ListCustomerOrders: %s %q denied access to customer %s", p.Role, p.ID(), customerID)
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "customer not found"})
+		return
+	}
+
+	filter, pageSize, err := h.parseOrderListQuery(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	query := listCursorQuery("customer", customerID, filter)
+	pageState, err := h.decodeListCursor(r.URL.Query().Get("cursor"), query)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	orders, next, err := h.store.ListCustomerOrders(r.Context(), customerID, filter, pageSize, pageState)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCursor) {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: ErrInvalidCursor.Error()})
+			return
+		}
+		log.Printf("[handler] ListCustomerOrders error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to list orders"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, OrderListResponse{Orders: orders, NextCursor: h.encodeListCursor(next, query)})
+}
+
+// ListOrdersByStatus lists the orders currently in a status that entered it
+// within [from, to), oldest first, for operational queries such as orders
+// stuck in SHIPPING. All three parameters are required, and the range may
+// span at most maxStatusListRange, as every day in it is one partition read.
+func (h *Handlers) ListOrdersByStatus(w http.ResponseWriter, r *http.Request) {
+	filter, pageSize, err := h.parseOrderListQuery(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if filter.Status == "" || filter.From.IsZero() || filter.To.IsZero() {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "status, from and to are required"})
+		return
+	}
+	if filter.To.Sub(filter.From) > maxStatusListRange {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("from and to may be at most %d days apart", int(maxStatusListRange.Hours()/24)),
+		})
+		return
+	}
+
+	query := listCursorQuery("status", filter.Status, filter)
+	pageState, err := h.decodeListCursor(r.URL.Query().Get("cursor"), query)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	orders, next, err := h.store.ListOrdersByStatus(r.Context(), filter, pageSize, pageState)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCursor) {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: ErrInvalidCursor.Error()})
+			return
+		}
+		log.Printf("[handler] ListOrdersByStatus error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to list orders"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, OrderListResponse{Orders: orders, NextCursor: h.encodeListCursor(next, query)})
+}
+
+const (
+	defaultOrderPageSize = 20
+	maxOrderPageSize     = 100
+)
+
+// maxStatusListRange bounds the time range of ListOrdersByStatus.
+const maxStatusListRange = 31 * 24 * time.Hour
+
+// parseOrderListQuery reads the status, from, to and limit parameters shared
+// by the order listings.
+func (h *Handlers) parseOrderListQuery(r *http.Request) (OrderFilter, int, error) {
+	q := r.URL.Query()
+
+	var filter OrderFilter
+	if filter.Status = q.Get("status"); filter.Status != "" && !h.sm.lifecycle.HasState(filter.Status) {
+		return OrderFilter{}, 0, fmt.Errorf("unknown status %q", filter.Status)
+	}
+	for _, param := range []struct {
+		name string
+		dest *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		if v := q.Get(param.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return OrderFilter{}, 0, fmt.Errorf("%s must be an RFC 3339 timestamp", param.name)
+			}
+			*param.dest = t.UTC()
+		}
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return OrderFilter{}, 0, errors.New("from must be before to")
+	}
+
+	pageSize := defaultOrderPageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxOrderPageSize {
+			return OrderFilter{}, 0, fmt.Errorf("limit must be between 1 and %d", maxOrderPageSize)
+		}
+		pageSize = n
+	}
+	return filter, pageSize, nil
+}
+
+// handleShippingEvent deduplicates a verified event by its event_id, runs it
+// through the shipping processor and stores the outcome, so redelivered
+// events are answered with the original result instead of being reapplied.
+func (h *Handlers) handleShippingEvent(w http.ResponseWriter, r *http.Request, source string, event ShippingWebhookEvent) {
+	if event.EventID == "" {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "event_id is required"})
+		return
+	}
+
+	key := "dedup:" + event.EventID
+	hash := shippingEventHash(event)
+
+	existing, reserved, err := h.webhook.Dedup.Reserve(r.Context(), key, IdempotencyRecord{RequestHash: hash}, idempotencyInFlightTTL)
+	if err != nil {
+		log.Printf("[%s] Dedup check error for event %s: %v", source, event.EventID, err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to check event"})
+		return
+	}
+
+	if !reserved {
+		switch {
+		case existing.RequestHash != hash:
+			log.Printf("[%s] Event %s reused for a different payload, rejecting", source, event.EventID)
+			writeJSON(w, http.StatusUnprocessableEntity, ErrorResponse{
+				Error: "event_id was already used for a different event",
+			})
+		case !existing.Completed:
+			w.Header().Set("Retry-After", "1")
+			writeJSON(w, http.StatusConflict, ErrorResponse{Error: "event is still being processed"})
+		default:
+			log.Printf("[%s] Event %s is a duplicate, already processed (status=%d)", source, event.EventID, existing.StatusCode)
+			writeJSON(w, http.StatusOK, DuplicateWebhookResponse{
+				EventID:          event.EventID,
+				Duplicate:        true,
+				Message:          "duplicate, already processed",
+				OriginalStatus:   existing.StatusCode,
+				OriginalResponse: json.RawMessage(existing.Body),
+			})
+		}
+		return
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			releaseIdempotencyKey(h.webhook.Dedup, key, event.EventID)
+			panic(p)
+		}
+	}()
+
+	resp, err := h.shipping.Process(r.Context(), event, source)
+	status, body := shippingResult(source, resp, err)
+
+	// Use a fresh context: the outcome must be recorded even if the carrier
+	// has already hung up.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Only final outcomes are stored. Server errors, lost lock or CAS races
+	// and events for a shipment or order not known yet are released, so the
+	// carrier's retry is processed again instead of replayed.
+	if status >= http.StatusInternalServerError || isTransientError(err) ||
+		errors.Is(err, ErrShipmentNotFound) || errors.Is(err, ErrOrderNotFound) {
+		if err := h.webhook.Dedup.Release(ctx, key); err != nil {
+			log.Printf("[%s] Dedup release error for event %s: %v", source, event.EventID, err)
+		}
+	} else if payload, err := json.Marshal(body); err == nil {
+		err = h.webhook.Dedup.Complete(ctx, key, IdempotencyRecord{
+			RequestHash: hash,
+			Completed:   true,
+			StatusCode:  status,
+			Body:        payload,
+		}, h.webhook.DedupTTL)
+		if err != nil {
+			log.Printf("[%s] Dedup store error for event %s: %v", source, event.EventID, err)
+		}
+	}
+
+	writeJSON(w, status, body)
+}
+
+// shippingResult maps the outcome of ShippingEventProcessor.Process to an
+// HTTP status and response body; both webhook endpoints share it.
+func shippingResult(source string, resp *ShippingWebhookResponse, err error) (int, interface{}) {
+	if err == nil {
+		if resp.Ignored {
+			// Accepted, so the carrier does not retry, but not applied.
+			return http.StatusAccepted, resp
+		}
+		return http.StatusOK, resp
+	}
+
+	switch {
+	case errors.Is(err, ErrInvalidShippingEvent), errors.Is(err, ErrUnknownShipStatus):
+		log.Printf("[%s] Rejected event: %v", source, err)
+		return http.StatusBadRequest, ErrorResponse{Error: err.Error()}
+	case errors.Is(err, ErrOrderNotFound):
+		return http.StatusNotFound, ErrorResponse{Error: "order not found"}
+	case errors.Is(err, ErrForbidden):
+		log.Printf("[%s] Rejected event: %v", source, err)
+		return http.StatusForbidden, ErrorResponse{Error: ErrForbidden.Error()}
+	case errors.Is(err, ErrShipmentNotFound):
+		return http.StatusNotFound, ErrorResponse{Error: "shipment not found"}
+	case errors.Is(err, ErrShipmentOrderMismatch):
+		return http.StatusUnprocessableEntity, ErrorResponse{Error: err.Error()}
+	case isConflictError(err):
+		return http.StatusConflict, ErrorResponse{Error: err.Error()}
+	default:
+		log.Printf("[%s] Processing error: %v", source, err)
+		return http.StatusInternalServerError, ErrorResponse{Error: "failed to update order status"}
+	}
+}
+
+func shippingEventHash(event ShippingWebhookEvent) string {
+	data, _ := json.Marshal(event)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// authorizeOrder loads an order on behalf of the request's principal. An
+// order the principal may not access is reported as ErrOrderNotFound, the
+// same as a missing one, so order ids cannot be probed.
+func (h *Handlers) authorizeOrder(ctx context.Context, op, orderID string) (*Order, error) {
+	p, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return nil, ErrTokenMissing
+	}
+	order, err := h.store.GetOrder(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !h.policy.CanAccessOrder(p, order) {
+		log.Printf("[auth] %s: %s %q denied access to order %s", op, p.Role, p.CustomerID, orderID)
+		return nil, ErrOrderNotFound
+	}
+	return order, nil
+}
+
+// orderForCaller is authorizeOrder for handlers: on failure it writes the
+// error response and returns nil.
+func (h *Handlers) orderForCaller(w http.ResponseWriter, r *http.Request, op, orderID string) *Order {
+	order, err := h.authorizeOrder(r.Context(), op, orderID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrOrderNotFound):
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "order not found"})
+		case errors.Is(err, ErrTokenMissing):
+			writeUnauthorized(w, err)
+		default:
+			log.Printf("[handler] %s error: %v", op, err)
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to get order"})
+		}
+		return nil
+	}
+	return order
+}
+
+// writeTransitionError maps a StateMachine.Transition error to an HTTP
+// response for the order action handlers.
+func writeTransitionError(w http.ResponseWriter, op, failMsg string, err error) {
+	switch {
+	case errors.Is(err, ErrOrderNotFound):
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "order not found"})
+	case errors.Is(err, ErrForbidden):
+		writeJSON(w, http.StatusForbidden, ErrorResponse{Error: ErrForbidden.Error()})
+	case errors.Is(err, ErrMissingTransitionInput):
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	case errors.Is(err, ErrTransitionGuardFailed):
+		writeJSON(w, http.StatusUnprocessableEntity, ErrorResponse{Error: err.Error()})
+	case isConflictError(err):
+		if isTransientError(err) {
+			w.Header().Set("Retry-After", "1")
+		}
+		writeJSON(w, http.StatusConflict, ErrorResponse{Error: err.Error()})
+	default:
+		log.Printf("[handler] %s error: %v", op, err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: failMsg})
+	}
+}
+
+// isTransientError reports whether err is a conflict with a concurrent
+// writer, which a retry of the same request can succeed past. A transition
+// the lifecycle does not allow is final.
+func isTransientError(err error) bool {
+	return errors.Is(err, ErrTransitionConflict) ||
+		errors.Is(err, ErrLockNotAcquired) ||
+		errors.Is(err, ErrLockExpired) ||
+		errors.Is(err, ErrStaleFence)
+}
+
+// isConflictError reports whether err means the transition lost a race or is
+// not valid from the current state; handlers answer these with 409.
+func isConflictError(err error) bool {
+	return errors.Is(err, ErrTransitionNotAllowed) || isTransientError(err)
+}
+
 func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -440,3 +1093,53 @@ func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 		log.Printf("[handler] Failed to encode JSON response: %v", err)
 	}
 }
+
+// listCursor is the opaque pagination cursor of the order listings: the
+// store's paging state plus an HMAC over it and the query it belongs to. A
+// client can neither forge paging state nor replay a cursor against a
+// different customer or filter.
+type listCursor struct {
+	State []byte `json:"s"`
+	MAC   []byte `json:"m"`
+}
+
+// listCursorQuery identifies the listing a cursor was issued for.
+func listCursorQuery(scope, id string, filter OrderFilter) string {
+	return strings.Join([]string{
+		scope, id, filter.Status, filter.From.Format(time.RFC3339Nano), filter.To.Format(time.RFC3339Nano),
+	}, "\x00")
+}
+
+func (h *Handlers) listCursorMAC(query string, state []byte) []byte {
+	mac := hmac.New(sha256.New, h.cursorKey)
+	mac.Write([]byte(query))
+	mac.Write([]byte{0})
+	mac.Write(state)
+	return mac.Sum(nil)
+}
+
+func (h *Handlers) encodeListCursor(state []byte, query string) string {
+	if state == nil {
+		return ""
+	}
+	data, _ := json.Marshal(listCursor{State: state, MAC: h.listCursorMAC(query, state)})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (h *Handlers) decodeListCursor(cursor, query string) ([]byte, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c listCursor
+	if err := json.Unmarshal(data, &c); err != nil || len(c.State) == 0 {
+		return nil, ErrInvalidCursor
+	}
+	if !hmac.Equal(c.MAC, h.listCursorMAC(query, c.State)) {
+		return nil, fmt.Errorf("%w: cursor belongs to a different query", ErrInvalidCursor)
+	}
+	return c.State, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var (
+	testCustomer1 = &Principal{Subject: "c1", CustomerID: "c1", Role: RoleCustomer}
+	testCustomer2 = &Principal{Subject: "c2", CustomerID: "c2", Role: RoleCustomer}
+	testSupport   = &Principal{Subject: "ops", Role: RoleSupport}
+)
+
+// setUpdatedAt backdates when an order entered its current status.
+func (s *testServer) setUpdatedAt(orderID string, at time.Time) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	s.store.orders[orderID].UpdatedAt = at
+}
+
+// listAll follows next_cursor from path until the last page.
+func (s *testServer) listAll(t *testing.T, p *Principal, path string) []string {
+	t.Helper()
+	var ids []string
+	cursor := ""
+	for page := 0; ; page++ {
+		if page > 10 {
+			t.Fatalf("%s: pagination does not end", path)
+		}
+		u := path
+		if cursor != "" {
+			u += "&cursor=" + url.QueryEscape(cursor)
+		}
+		rec := s.do(p, http.MethodGet, u, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d: %s", u, rec.Code, rec.Body)
+		}
+		var resp OrderListResponse
+		decodeJSON(t, rec, &resp)
+		for _, o := range resp.Orders {
+			ids = append(ids, o.OrderID)
+		}
+		if resp.NextCursor == "" {
+			return ids
+		}
+		cursor = resp.NextCursor
+	}
+}
+
+func TestListOrdersByStatusAcrossDays(t *testing.T) {
+	s := newTestServer(t)
+	midnight := time.Date(2025, 3, 2, 0, 0, 0, 0, time.UTC)
+	var want []string
+	for _, at := range []time.Time{
+		midnight.Add(-2 * time.Minute),
+		midnight.Add(-time.Second),
+		midnight,
+		midnight.Add(time.Minute),
+		midnight.Add(12 * time.Hour),
+	} {
+		order := s.seedOrder(t, "c1", StatusShipping)
+		s.setUpdatedAt(order.OrderID, at)
+		want = append(want, order.OrderID)
+	}
+	outside := s.seedOrder(t, "c1", StatusShipping)
+	s.setUpdatedAt(outside.OrderID, midnight.Add(-25*time.Hour))
+
+	got := s.listAll(t, testSupport, "/admin/orders?status=SHIPPING&from=2025-03-01T00:00:00Z&to=2025-03-03T00:00:00Z&limit=2")
+	if len(got) != len(want) {
+		t.Fatalf("listed %d orders, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("position %d: %s, want %s (oldest first)", i, got[i], want[i])
+		}
+	}
+}
+
+func TestStatusPageStateAcrossDays(t *testing.T) {
+	from := time.Date(2025, 3, 1, 22, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 3, 2, 2, 0, 0, 0, time.UTC)
+	first, last := statusDay(from), statusDay(to.Add(-time.Millisecond))
+	if !last.Equal(first.AddDate(0, 0, 1)) {
+		t.Fatalf("range spans %v..%v, want two days", first, last)
+	}
+
+	day, state, err := decodeStatusPageState(encodeStatusPageState(last, []byte("gocql")), first, last)
+	if err != nil || !day.Equal(last) || string(state) != "gocql" {
+		t.Errorf("round trip: day %v, state %q, err %v", day, state, err)
+	}
+	// A partition boundary resumes at the start of the next day.
+	day, state, err = decodeStatusPageState(encodeStatusPageState(last, nil), first, last)
+	if err != nil || !day.Equal(last) || state != nil {
+		t.Errorf("next day: day %v, state %q, err %v", day, state, err)
+	}
+	if _, _, err := decodeStatusPageState(encodeStatusPageState(last.AddDate(0, 0, 1), nil), first, last); err == nil {
+		t.Error("a day after the range was accepted")
+	}
+}
+
+func TestListCursorBoundToQuery(t *testing.T) {
+	s := newTestServer(t)
+	for i := 0; i < 3; i++ {
+		s.seedOrder(t, "c1", StatusPendingPayment)
+		s.seedOrder(t, "c2", StatusPendingPayment)
+	}
+
+	rec := s.do(testCustomer1, http.MethodGet, "/customers/c1/orders?status=PENDING_PAYMENT&limit=1", "")
+	var resp OrderListResponse
+	decodeJSON(t, rec, &resp)
+	if resp.NextCursor == "" {
+		t.Fatalf("first page has no next_cursor: %s", rec.Body)
+	}
+	cursor := url.QueryEscape(resp.NextCursor)
+
+	var tampered listCursor
+	data, _ := base64.RawURLEncoding.DecodeString(resp.NextCursor)
+	if err := json.Unmarshal(data, &tampered); err != nil {
+		t.Fatalf("decode cursor: %v", err)
+	}
+	tampered.State = []byte("0")
+	data, _ = json.Marshal(tampered)
+
+	other := newTestServer(t)
+	other.handlers.cursorKey = []byte("another-instance-key-0123456789ab")
+
+	tests := []struct {
+		name string
+		s    *testServer
+		p    *Principal
+		path string
+		want int
+	}{
+		{"same query", s, testCustomer1, "/customers/c1/orders?status=PENDING_PAYMENT&limit=1&cursor=" + cursor, http.StatusOK},
+		{"different status", s, testCustomer1, "/customers/c1/orders?status=CREATED&limit=1&cursor=" + cursor, http.StatusBadRequest},
+		{"added time filter", s, testCustomer1, "/customers/c1/orders?status=PENDING_PAYMENT&from=2025-01-01T00:00:00Z&limit=1&cursor=" + cursor, http.StatusBadRequest},
+		{"different customer", s, testSupport, "/customers/c2/orders?status=PENDING_PAYMENT&limit=1&cursor=" + cursor, http.StatusBadRequest},
+		{"status listing", s, testSupport, "/admin/orders?status=PENDING_PAYMENT&from=2025-01-01T00:00:00Z&to=2025-01-02T00:00:00Z&cursor=" + cursor, http.StatusBadRequest},
+		{"tampered paging state", s, testCustomer1, "/customers/c1/orders?status=PENDING_PAYMENT&limit=1&cursor=" + base64.RawURLEncoding.EncodeToString(data), http.StatusBadRequest},
+		{"signed with another key", other, testCustomer1, "/customers/c1/orders?status=PENDING_PAYMENT&limit=1&cursor=" + cursor, http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		if rec := tc.s.do(tc.p, http.MethodGet, tc.path, ""); rec.Code != tc.want {
+			t.Errorf("%s: status %d, want %d: %s", tc.name, rec.Code, tc.want, rec.Body)
+		}
+	}
+}
+
+func TestListCustomerOrdersIsolation(t *testing.T) {
+	s := newTestServer(t)
+	own := s.seedOrder(t, "c1", StatusCreated)
+	foreign := s.seedOrder(t, "c2", StatusCreated)
+
+	if rec := s.do(testCustomer1, http.MethodGet, "/customers/c2/orders", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("customer listing another customer's orders: status %d, want 404", rec.Code)
+	}
+	if got := s.listAll(t, testCustomer1, "/customers/c1/orders?limit=1"); len(got) != 1 || got[0] != own.OrderID {
+		t.Errorf("customer's own listing = %v, want [%s]", got, own.OrderID)
+	}
+	if got := s.listAll(t, testSupport, "/customers/c2/orders?limit=1"); len(got) != 1 || got[0] != foreign.OrderID {
+		t.Errorf("support listing of c2 = %v, want [%s]", got, foreign.OrderID)
+	}
+	if rec := s.do(testCustomer1, http.MethodGet, "/admin/orders?status=CREATED&from=2025-01-01T00:00:00Z&to=2025-01-02T00:00:00Z", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("customer on the status listing: status %d, want 403", rec.Code)
+	}
+}
+
+var testFulfillment = &Principal{Subject: "warehouse_1", Role: RoleFulfillment}
+
+var testPayment = &Principal{Subject: "psp", Role: RolePayment}
+
+func TestCustomerStartsPaymentProviderCompletesIt(t *testing.T) {
+	s := newTestServer(t)
+	order := s.seedOrder(t, "c1", StatusCreated)
+	path := "/orders/" + order.OrderID
+
+	if rec := s.do(testCustomer1, http.MethodPost, path+"/checkout", ""); rec.Code != http.StatusOK {
+		t.Fatalf("checkout: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := s.do(testCustomer1, http.MethodPost, path+"/pay", `{"payment_id":"pay_1"}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("customer marks the order paid: status %d, want 403", rec.Code)
+	}
+	if got := s.status(t, order.OrderID); got != StatusPendingPayment {
+		t.Fatalf("status %s after the customer's attempt, want PENDING_PAYMENT", got)
+	}
+	if rec := s.do(testPayment, http.MethodPost, path+"/pay", `{"payment_id":"pay_1"}`); rec.Code != http.StatusOK {
+		t.Fatalf("payment provider confirms: status %d: %s", rec.Code, rec.Body)
+	}
+	if got := s.status(t, order.OrderID); got != StatusPaid {
+		t.Errorf("status %s, want PAID", got)
+	}
+}
+
+func TestShippingWebhookRejectsAnotherOrdersShipment(t *testing.T) {
+	s := newTestServer(t)
+	orderA := s.seedOrder(t, "c1", StatusShipping)
+	orderB := s.seedOrder(t, "c2", StatusShipping)
+	s.shipSeeded(t, orderA.OrderID, "SH-A")
+
+	rec := s.webhook(t, ShippingWebhookEvent{
+		EventID:    "evt-1",
+		ShipmentID: "SH-A",
+		OrderID:    orderB.OrderID,
+		Status:     ShipStatusLost,
+		Timestamp:  time.Now().Unix(),
+	})
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("event naming another order: status %d, want 422: %s", rec.Code, rec.Body)
+	}
+	for _, id := range []string{orderA.OrderID, orderB.OrderID} {
+		if got := s.status(t, id); got != StatusShipping {
+			t.Errorf("order %s moved to %s", id, got)
+		}
+	}
+
+	// Nor can the other order claim the shipment when it ships.
+	paid := s.seedOrder(t, "c2", StatusPaid)
+	rec = s.do(testFulfillment, http.MethodPost, "/orders/"+paid.OrderID+"/ship", `{"shipment_id":"SH-A"}`)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("shipping with another order's shipment: status %d, want 409", rec.Code)
+	}
+	if got := s.status(t, paid.OrderID); got != StatusPaid {
+		t.Errorf("order moved to %s", got)
+	}
+}
+
+func TestShipOrderFailedTransitionLeavesNoShipment(t *testing.T) {
+	s := newTestServer(t)
+	order := s.seedOrder(t, "c1", StatusPendingPayment)
+
+	rec := s.do(testFulfillment, http.MethodPost, "/orders/"+order.OrderID+"/ship", `{"shipment_id":"SH-1","carrier":"demo"}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("shipping an unpaid order: status %d, want 409: %s", rec.Code, rec.Body)
+	}
+	if _, err := s.shipments.GetShipment(context.Background(), "SH-1"); !errors.Is(err, ErrShipmentNotFound) {
+		t.Errorf("shipment of the unshipped order is still registered: err = %v", err)
+	}
+	if rec := s.webhook(t, ShippingWebhookEvent{EventID: "evt-1", ShipmentID: "SH-1", Status: ShipStatusLost}); rec.Code != http.StatusNotFound {
+		t.Errorf("webhook for the removed shipment: status %d, want 404", rec.Code)
+	}
+
+	// Once paid, the order ships under the same shipment id.
+	if err := s.store.UpdateOrderStatus(context.Background(), order.OrderID, StatusPendingPayment, StatusPaid, "paid", 0, OrderFields{PaymentID: "pay_1"}); err != nil {
+		t.Fatalf("pay: %v", err)
+	}
+	if rec := s.do(testFulfillment, http.MethodPost, "/orders/"+order.OrderID+"/ship", `{"shipment_id":"SH-1"}`); rec.Code != http.StatusOK {
+		t.Errorf("ship after payment: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestGetOrderTrackingInOrder(t *testing.T) {
+	s := newTestServer(t)
+	order := s.seedOrder(t, "c1", StatusShipping)
+	s.shipSeeded(t, order.OrderID, "SH-1")
+	t0 := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	// Delivered first, the earlier events afterwards.
+	for _, e := range []ShippingWebhookEvent{
+		{EventID: "evt-3", ShipmentID: "SH-1", Status: ShipStatusDelivered, Timestamp: t0.Add(2 * time.Minute).Unix()},
+		{EventID: "evt-1", ShipmentID: "SH-1", Status: ShipStatusInTransit, Location: "Podgorica", Timestamp: t0.Unix()},
+		{EventID: "evt-2", ShipmentID: "SH-1", Status: ShipStatusInTransit, Location: "Budva", Timestamp: t0.Add(time.Minute).Unix()},
+	} {
+		if rec := s.webhook(t, e); rec.Code != http.StatusOK && rec.Code != http.StatusAccepted {
+			t.Fatalf("%s: status %d: %s", e.EventID, rec.Code, rec.Body)
+		}
+	}
+
+	rec := s.do(testCustomer1, http.MethodGet, "/orders/"+order.OrderID+"/tracking", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET tracking: status %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Shipments []ShipmentTracking `json:"shipments"`
+	}
+	decodeJSON(t, rec, &resp)
+	if len(resp.Shipments) != 1 {
+		t.Fatalf("tracking lists %d shipments, want 1", len(resp.Shipments))
+	}
+	var got []string
+	for _, e := range resp.Shipments[0].Events {
+		got = append(got, e.EventID)
+	}
+	if want := []string{"evt-1", "evt-2", "evt-3"}; !equalStrings(got, want) {
+		t.Errorf("events %v, want %v", got, want)
+	}
+	if resp.Shipments[0].Status != ShipStatusDelivered {
+		t.Errorf("shipment status %s, want DELIVERED", resp.Shipments[0].Status)
+	}
+
+	if rec := s.do(testCustomer2, http.MethodGet, "/orders/"+order.OrderID+"/tracking", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("another customer's tracking: status %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotentReplayedHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	idempotencyReserveRetries = 3
+
+	// idempotencyInFlightTTL bounds how long a reservation for a request
+	// that never completes (a crashed instance, say) blocks its key. It
+	// must exceed the router's request timeout.
+	idempotencyInFlightTTL = time.Minute
+)
+
+// IdempotencyRecord is what is stored per key. While the first request is
+// still running Completed is false; afterwards it holds the response that is
+// replayed for every retry carrying the same key.
+type IdempotencyRecord struct {
+	RequestHash string `json:"request_hash"`
+	Completed   bool   `json:"completed"`
+	StatusCode  int    `json:"status_code,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// IdempotencyStore persists IdempotencyRecords with a TTL.
+// Reserve atomically claims key for a new request; if the key is already
+// claimed it returns the existing record and false.
+type IdempotencyStore interface {
+	Reserve(ctx context.Context, key string, rec IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, bool, error)
+	Complete(ctx context.Context, key string, rec IdempotencyRecord, ttl time.Duration) error
+	Release(ctx context.Context, key string) error
+}
+
+// Idempotency honors the Idempotency-Key header on mutating requests. The
+// first request for a key runs normally and its response is stored; retries
+// with the same key and body get that response replayed, retries with a
+// different body are rejected with 422. Responses a retry can change are not
+// stored: 5xx, a panic, and 409s marked with Retry-After, which handlers set
+// for lost lock or CAS races.
+func Idempotency(store IdempotencyStore, ttl time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			idemKey := r.Header.Get(IdempotencyKeyHeader)
+			if idemKey == "" || !isMutatingMethod(r.Method) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(idemKey) > maxIdempotencyKeyLength {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "Idempotency-Key is too long"})
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "failed to read body"})
+				return
+			}
+			r.Body.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			// Keys are scoped to the caller, so one customer can never be
+			// replayed another customer's stored response.
+			caller := "anonymous"
+			if p, ok := PrincipalFromContext(r.Context()); ok {
+				caller = p.Role + ":" + p.ID()
+			}
+			key := fmt.Sprintf("idempotency:%s:%s:%s:%s", caller, r.Method, r.URL.Path, idemKey)
+			hash := requestHash(r.Method, r.URL.Path, body)
+
+			existing, reserved, err := store.Reserve(r.Context(), key, IdempotencyRecord{RequestHash: hash}, idempotencyInFlightTTL)
+			if err != nil {
+				log.Printf("[idempotency] Reserve error for key %s: %v", idemKey, err)
+				writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "idempotency check failed"})
+				return
+			}
+
+			if !reserved {
+				switch {
+				case existing.RequestHash != hash:
+					log.Printf("[idempotency] Key %s reused with a different request", idemKey)
+					writeJSON(w, http.StatusUnprocessableEntity, ErrorResponse{
+						Error: "Idempotency-Key was already used with a different request",
+					})
+				case !existing.Completed:
+					w.Header().Set("Retry-After", "1")
+					writeJSON(w, http.StatusConflict, ErrorResponse{
+						Error: "a request with this Idempotency-Key is still being processed",
+					})
+				default:
+					log.Printf("[idempotency] Replaying stored response for key %s (status=%d)", idemKey, existing.StatusCode)
+					w.Header().Set("Content-Type", "application/json")
+					w.Header().Set(IdempotentReplayedHeader, "true")
+					w.WriteHeader(existing.StatusCode)
+					w.Write(existing.Body)
+				}
+				return
+			}
+
+			// A panicking handler leaves nothing to replay; free the key
+			// before Recoverer answers the request.
+			defer func() {
+				if p := recover(); p != nil {
+					releaseIdempotencyKey(store, key, idemKey)
+					panic(p)
+				}
+			}()
+
+			rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			if rec.status >= http.StatusInternalServerError ||
+				(rec.status == http.StatusConflict && rec.Header().Get("Retry-After") != "") {
+				releaseIdempotencyKey(store, key, idemKey)
+				return
+			}
+
+			// Use a fresh context: the request context may already be
+			// cancelled once the handler returns.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			err = store.Complete(ctx, key, IdempotencyRecord{
+				RequestHash: hash,
+				Completed:   true,
+				StatusCode:  rec.status,
+				Body:        rec.body.Bytes(),
+			}, ttl)
+			if err != nil {
+				log.Printf("[idempotency] Complete error for key %s: %v", idemKey, err)
+			}
+		})
+	}
+}
+
+func releaseIdempotencyKey(store IdempotencyStore, key, idemKey string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := store.Release(ctx, key); err != nil {
+		log.Printf("[idempotency] Release error for key %s: %v", idemKey, err)
+	}
+}
+
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func requestHash(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method))
+	h.Write([]byte{0})
+	h.Write([]byte(path))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder passes the response through while keeping a copy of the
+// status code and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if !rr.wroteHeader {
+		rr.status = status
+		rr.wroteHeader = true
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.wroteHeader = true
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+type RedisIdempotencyStore struct {
+	rdb *redis.Client
+}
+
+func NewRedisIdempotencyStore(rdb *redis.Client) *RedisIdempotencyStore {
+	return &RedisIdempotencyStore{rdb: rdb}
+}
+
+func (s *RedisIdempotencyStore) Reserve(ctx context.Context, key string, rec IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, bool, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, false, fmt.Errorf("marshal idempotency record: %w", err)
+	}
+
+	// The existing record can expire between SET NX and GET; retry a few
+	// times instead of reporting a spurious conflict.
+	for i := 0; i < idempotencyReserveRetries; i++ {
+		reserved, err := s.rdb.SetNX(ctx, key, data, ttl).Result()
+		if err != nil {
+			return nil, false, fmt.Errorf("redis idempotency reserve: %w", err)
+		}
+		if reserved {
+			return nil, true, nil
+		}
+
+		stored, err := s.rdb.Get(ctx, key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("redis idempotency get: %w", err)
+		}
+
+		var existing IdempotencyRecord
+		if err := json.Unmarshal(stored, &existing); err != nil {
+			return nil, false, fmt.Errorf("unmarshal idempotency record: %w", err)
+		}
+		return &existing, false, nil
+	}
+	return nil, false, fmt.Errorf("redis idempotency reserve: key %s kept expiring", key)
+}
+
+func (s *RedisIdempotencyStore) Complete(ctx context.Context, key string, rec IdempotencyRecord, ttl time.Duration) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("marshal idempotency record: %w", err)
+	}
+	if err := s.rdb.Set(ctx, key, data, ttl).Err(); err != nil {
+		return fmt.Errorf("redis idempotency complete: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisIdempotencyStore) Release(ctx context.Context, key string) error {
+	if err := s.rdb.Del(ctx, key).Err(); err != nil {
+		return fmt.Errorf("redis idempotency release: %w", err)
+	}
+	return nil
+}
+
+// MemoryIdempotencyStore is an in-process IdempotencyStore for tests and
+// single-instance demos. Expired records are swept out as the store is used.
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	records   map[string]memoryIdempotencyEntry
+	clock     Clock
+	lastSweep time.Time
+}
+
+type memoryIdempotencyEntry struct {
+	rec       IdempotencyRecord
+	expiresAt time.Time
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		records:   make(map[string]memoryIdempotencyEntry),
+		clock:     systemClock{},
+		lastSweep: time.Now(),
+	}
+}
+
+func (s *MemoryIdempotencyStore) Reserve(_ context.Context, key string, rec IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	s.sweep(now)
+
+	if entry, ok := s.records[key]; ok && now.Before(entry.expiresAt) {
+		existing := entry.rec
+		return &existing, false, nil
+	}
+	s.records[key] = memoryIdempotencyEntry{rec: rec, expiresAt: now.Add(ttl)}
+	return nil, true, nil
+}
+
+func (s *MemoryIdempotencyStore) Complete(_ context.Context, key string, rec IdempotencyRecord, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	s.sweep(now)
+
+	s.records[key] = memoryIdempotencyEntry{rec: rec, expiresAt: now.Add(ttl)}
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+	return nil
+}
+
+// sweep drops expired records, at most once a minute, so keys that are never
+// retried do not accumulate. Callers must hold s.mu.
+func (s *MemoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, entry := range s.records {
+		if !now.Before(entry.expiresAt) {
+			delete(s.records, key)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// idempotentHandler wraps handler in the Idempotency middleware with a
+// one-hour TTL, as the router does.
+func idempotentHandler(store IdempotencyStore, handler http.HandlerFunc) http.Handler {
+	return Idempotency(store, time.Hour)(handler)
+}
+
+func idempotentRequest(p *Principal, key, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/orders/o1/pay", strings.NewReader(body))
+	r.Header.Set(IdempotencyKeyHeader, key)
+	return r.WithContext(ContextWithPrincipal(r.Context(), p))
+}
+
+var idemCustomer = &Principal{Subject: "c1", Role: RoleCustomer, CustomerID: "c1"}
+
+func TestIdempotencyReplaysStoredResponse(t *testing.T) {
+	var calls atomic.Int32
+	h := idempotentHandler(NewMemoryIdempotencyStore(), func(w http.ResponseWriter, _ *http.Request) {
+		n := calls.Add(1)
+		writeJSON(w, http.StatusCreated, map[string]int32{"call": n})
+	})
+
+	first := httptest.NewRecorder()
+	h.ServeHTTP(first, idempotentRequest(idemCustomer, "k1", `{"payment_id":"pay_1"}`))
+	second := httptest.NewRecorder()
+	h.ServeHTTP(second, idempotentRequest(idemCustomer, "k1", `{"payment_id":"pay_1"}`))
+
+	if calls.Load() != 1 {
+		t.Fatalf("handler ran %d times, want 1", calls.Load())
+	}
+	if second.Code != http.StatusCreated || second.Body.String() != first.Body.String() {
+		t.Errorf("replay = %d %q, want %d %q", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get(IdempotentReplayedHeader) != "true" {
+		t.Errorf("replay is missing %s", IdempotentReplayedHeader)
+	}
+
+	// The same key from another caller is a different request.
+	other := httptest.NewRecorder()
+	h.ServeHTTP(other, idempotentRequest(&Principal{Subject: "c2", Role: RoleCustomer, CustomerID: "c2"}, "k1", `{"payment_id":"pay_1"}`))
+	if calls.Load() != 2 || other.Header().Get(IdempotentReplayedHeader) != "" {
+		t.Errorf("another caller's request was replayed the stored response")
+	}
+}
+
+func TestIdempotencyRejectsDifferentBody(t *testing.T) {
+	var calls atomic.Int32
+	h := idempotentHandler(NewMemoryIdempotencyStore(), func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "PAID"})
+	})
+
+	h.ServeHTTP(httptest.NewRecorder(), idempotentRequest(idemCustomer, "k1", `{"payment_id":"pay_1"}`))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, idempotentRequest(idemCustomer, "k1", `{"payment_id":"pay_2"}`))
+
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("different body under the same key: status %d, want 422", rec.Code)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("handler ran %d times, want 1", calls.Load())
+	}
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	h := idempotentHandler(NewMemoryIdempotencyStore(), func(w http.ResponseWriter, _ *http.Request) {
+		close(started)
+		<-finish
+		writeJSON(w, http.StatusOK, map[string]string{"status": "PAID"})
+	})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, idempotentRequest(idemCustomer, "k1", `{}`))
+		done <- rec
+	}()
+	<-started
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, idempotentRequest(idemCustomer, "k1", `{}`))
+	if rec.Code != http.StatusConflict || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("retry while in flight: status %d, Retry-After %q, want 409 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	close(finish)
+	if first := <-done; first.Code != http.StatusOK {
+		t.Errorf("first request: status %d, want 200", first.Code)
+	}
+}
+
+func TestIdempotencyReleasesRetryableResponses(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fail func(http.ResponseWriter)
+	}{
+		{"5xx", func(w http.ResponseWriter) {
+			writeJSON(w, http.StatusServiceUnavailable, ErrorResponse{Error: "store unavailable"})
+		}},
+		{"409 with Retry-After", func(w http.ResponseWriter) {
+			w.Header().Set("Retry-After", "1")
+			writeJSON(w, http.StatusConflict, ErrorResponse{Error: "order is being updated"})
+		}},
+	} {
+		var calls atomic.Int32
+		h := idempotentHandler(NewMemoryIdempotencyStore(), func(w http.ResponseWriter, _ *http.Request) {
+			if calls.Add(1) == 1 {
+				tc.fail(w)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"status": "PAID"})
+		})
+
+		h.ServeHTTP(httptest.NewRecorder(), idempotentRequest(idemCustomer, "k1", `{}`))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, idempotentRequest(idemCustomer, "k1", `{}`))
+
+		if rec.Code != http.StatusOK || rec.Header().Get(IdempotentReplayedHeader) != "" {
+			t.Errorf("%s: retry got %d (replayed=%q), want a fresh 200", tc.name, rec.Code, rec.Header().Get(IdempotentReplayedHeader))
+		}
+		if calls.Load() != 2 {
+			t.Errorf("%s: handler ran %d times, want 2", tc.name, calls.Load())
+		}
+	}
+}
+
+func TestMemoryIdempotencyStoreEvictsExpired(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	store := NewMemoryIdempotencyStore()
+	store.clock = clock
+	store.lastSweep = clock.Now()
+
+	for _, key := range []string{"a", "b"} {
+		if _, ok, err := store.Reserve(ctx, key, IdempotencyRecord{RequestHash: key}, 30*time.Second); err != nil || !ok {
+			t.Fatalf("Reserve %s: reserved=%v err=%v", key, ok, err)
+		}
+	}
+	if err := store.Complete(ctx, "b", IdempotencyRecord{RequestHash: "b", Completed: true, StatusCode: 200}, time.Hour); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+
+	clock.Advance(2 * time.Minute)
+	if _, ok, err := store.Reserve(ctx, "c", IdempotencyRecord{RequestHash: "c"}, time.Minute); err != nil || !ok {
+		t.Fatalf("Reserve c: reserved=%v err=%v", ok, err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, ok := store.records["a"]; ok {
+		t.Error("expired reservation a was not evicted")
+	}
+	if _, ok := store.records["b"]; !ok {
+		t.Error("completed record b was evicted before its TTL")
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// defaultLifecycleJSON is the order lifecycle used unless LIFECYCLE_FILE
+// points at another definition.
+//
+//go:embed lifecycle.json
+var defaultLifecycleJSON []byte
+
+// TransitionInputs carries caller-supplied values a transition may require,
+// e.g. the payment_id for PENDING_PAYMENT → PAID.
+type TransitionInputs map[string]string
+
+// GuardFunc is a precondition evaluated against the order (read under the
+// lock) before a transition is committed.
+type GuardFunc func(order *Order, inputs TransitionInputs) error
+
+// ActionEnv is what post-commit actions may use besides the order itself.
+type ActionEnv struct {
+	Orders  OrderStore
+	Refunds RefundStore
+}
+
+// ActionFunc is a side effect of a transition. It is used in two places:
+//
+//   - preparations run under the order lock before the status write, on the
+//     order as it will be after the transition; a failure aborts it. Anything
+//     the next state depends on belongs here.
+//   - actions run after the transition has been committed. Failures are
+//     logged by the state machine; the transition itself is not rolled back.
+type ActionFunc func(ctx context.Context, env ActionEnv, order *Order, inputs TransitionInputs) error
+
+// lifecycleGuards and lifecycleActions are the names a lifecycle definition
+// may reference. New business rules are added here once and then wired to
+// transitions in lifecycle.json.
+var lifecycleGuards = map[string]GuardFunc{
+	"positive_total": func(order *Order, _ TransitionInputs) error {
+		if order.Total.Amount <= 0 {
+			return errors.New("order total must be positive")
+		}
+		return nil
+	},
+	"has_payment_id": func(order *Order, _ TransitionInputs) error {
+		if order.PaymentID == "" {
+			return errors.New("order has no payment_id")
+		}
+		return nil
+	},
+}
+
+// lifecycleRecords are the inputs a transition may store on the order. They
+// are written by the same conditional update as the status, unlike actions,
+// so a later guard can rely on them.
+var lifecycleRecords = map[string]func(fields *OrderFields, value string){
+	"payment_id": func(fields *OrderFields, value string) { fields.PaymentID = value },
+}
+
+var lifecyclePreparations = map[string]ActionFunc{
+	// The refund record must exist before the order is REFUND_PENDING, or
+	// nothing would ever pay it out. The worker only pays refunds whose
+	// order has actually reached REFUND_PENDING.
+	"request_refund": func(ctx context.Context, env ActionEnv, order *Order, _ TransitionInputs) error {
+		return requestRefund(ctx, env.Refunds, order)
+	},
+}
+
+var lifecycleActions = map[string]ActionFunc{}
+
+// LifecycleDefinition is the declarative, reviewable form of the order
+// lifecycle as stored in lifecycle.json.
+type LifecycleDefinition struct {
+	Initial     string                 `json:"initial"`
+	States      []string               `json:"states"`
+	Terminal    []string               `json:"terminal"`
+	Transitions []TransitionDefinition `json:"transitions"`
+}
+
+type TransitionDefinition struct {
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Inputs  []string `json:"inputs,omitempty"`
+	Record  []string `json:"record,omitempty"`
+	Guards  []string `json:"guards,omitempty"`
+	Prepare []string `json:"prepare,omitempty"`
+	Actions []string `json:"actions,omitempty"`
+}
+
+// Lifecycle is a validated LifecycleDefinition with guards and actions
+// resolved to functions.
+type Lifecycle struct {
+	initial     string
+	terminal    map[string]bool
+	transitions map[string]map[string]*lifecycleTransition
+}
+
+type lifecycleTransition struct {
+	def     TransitionDefinition
+	guards  []GuardFunc
+	prepare []namedAction
+	actions []namedAction
+}
+
+type namedAction struct {
+	name string
+	fn   ActionFunc
+}
+
+// HasState reports whether status is a state of this lifecycle.
+func (l *Lifecycle) HasState(status string) bool {
+	return l.transitions[status] != nil || l.terminal[status]
+}
+
+// DefaultLifecycle loads the embedded lifecycle.json.
+func DefaultLifecycle() (*Lifecycle, error) {
+	return LoadLifecycle(defaultLifecycleJSON)
+}
+
+// LoadLifecycle parses and validates a JSON lifecycle definition.
+func LoadLifecycle(data []byte) (*Lifecycle, error) {
+	var def LifecycleDefinition
+	if err := json.Unmarshal(data, &def); err != nil {
+		return nil, fmt.Errorf("parse lifecycle: %w", err)
+	}
+	return NewLifecycle(def)
+}
+
+// NewLifecycle validates def and resolves its guard and action names. It
+// rejects undeclared states, unknown guards or actions, duplicate
+// transitions, states unreachable from the initial state, non-terminal
+// states without an outgoing transition, and terminal states with one.
+func NewLifecycle(def LifecycleDefinition) (*Lifecycle, error) {
+	declared := make(map[string]bool, len(def.States))
+	for _, state := range def.States {
+		if declared[state] {
+			return nil, fmt.Errorf("lifecycle: state %s declared twice", state)
+		}
+		declared[state] = true
+	}
+	if !declared[def.Initial] {
+		return nil, fmt.Errorf("lifecycle: initial state %q is not declared", def.Initial)
+	}
+
+	lc := &Lifecycle{
+		initial:     def.Initial,
+		terminal:    make(map[string]bool, len(def.Terminal)),
+		transitions: make(map[string]map[string]*lifecycleTransition),
+	}
+	for _, state := range def.Terminal {
+		if !declared[state] {
+			return nil, fmt.Errorf("lifecycle: terminal state %q is not declared", state)
+		}
+		lc.terminal[state] = true
+	}
+
+	for _, td := range def.Transitions {
+		if !declared[td.From] || !declared[td.To] {
+			return nil, fmt.Errorf("lifecycle: transition %s → %s uses an undeclared state", td.From, td.To)
+		}
+		if lc.transitions[td.From][td.To] != nil {
+			return nil, fmt.Errorf("lifecycle: transition %s → %s defined twice", td.From, td.To)
+		}
+
+		t := &lifecycleTransition{def: td}
+		for _, name := range td.Record {
+			if lifecycleRecords[name] == nil {
+				return nil, fmt.Errorf("lifecycle: transition %s → %s: %q cannot be recorded", td.From, td.To, name)
+			}
+			if !containsString(td.Inputs, name) {
+				return nil, fmt.Errorf("lifecycle: transition %s → %s records %q, which is not one of its inputs", td.From, td.To, name)
+			}
+		}
+		for _, name := range td.Guards {
+			guard, ok := lifecycleGuards[name]
+			if !ok {
+				return nil, fmt.Errorf("lifecycle: transition %s → %s: unknown guard %q", td.From, td.To, name)
+			}
+			t.guards = append(t.guards, guard)
+		}
+		for _, name := range td.Prepare {
+			prepare, ok := lifecyclePreparations[name]
+			if !ok {
+				return nil, fmt.Errorf("lifecycle: transition %s → %s: unknown preparation %q", td.From, td.To, name)
+			}
+			t.prepare = append(t.prepare, namedAction{name: name, fn: prepare})
+		}
+		for _, name := range td.Actions {
+			action, ok := lifecycleActions[name]
+			if !ok {
+				return nil, fmt.Errorf("lifecycle: transition %s → %s: unknown action %q", td.From, td.To, name)
+			}
+			t.actions = append(t.actions, namedAction{name: name, fn: action})
+		}
+
+		if lc.transitions[td.From] == nil {
+			lc.transitions[td.From] = make(map[string]*lifecycleTransition)
+		}
+		lc.transitions[td.From][td.To] = t
+	}
+
+	var problems []string
+	reachable := lc.reachableStates()
+	for _, state := range def.States {
+		outgoing := len(lc.transitions[state])
+		switch {
+		case !reachable[state]:
+			problems = append(problems, fmt.Sprintf("state %s is unreachable from %s", state, def.Initial))
+		case lc.terminal[state] && outgoing > 0:
+			problems = append(problems, fmt.Sprintf("terminal state %s has outgoing transitions", state))
+		case !lc.terminal[state] && outgoing == 0:
+			problems = append(problems, fmt.Sprintf("state %s is a dead end (no transitions and not terminal)", state))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("lifecycle: %s", strings.Join(problems, "; "))
+	}
+
+	return lc, nil
+}
+
+func (lc *Lifecycle) reachableStates() map[string]bool {
+	seen := map[string]bool{lc.initial: true}
+	queue := []string{lc.initial}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for next := range lc.transitions[state] {
+			if !seen[next] {
+				seen[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	return seen
+}
+
+// fields returns the order fields t records from inputs.
+func (t *lifecycleTransition) fields(inputs TransitionInputs) OrderFields {
+	var fields OrderFields
+	for _, name := range t.def.Record {
+		lifecycleRecords[name](&fields, inputs[name])
+	}
+	return fields
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// check validates a transition of order to target: it must exist, all
+// required inputs must be present and every guard must pass.
+func (lc *Lifecycle) check(order *Order, target string, inputs TransitionInputs) (*lifecycleTransition, error) {
+	t := lc.transitions[order.Status][target]
+	if t == nil {
+		return nil, ErrTransitionNotAllowed
+	}
+
+	for _, name := range t.def.Inputs {
+		if inputs[name] == "" {
+			return nil, fmt.Errorf("%w: %s", ErrMissingTransitionInput, name)
+		}
+	}
+	for i, guard := range t.guards {
+		if err := guard(order, inputs); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrTransitionGuardFailed, t.def.Guards[i], err)
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// miniLifecycle is a small valid lifecycle; extra is appended to its
+// transitions.
+func miniLifecycle(extra string) []byte {
+	return []byte(fmt.Sprintf(`{
+		"initial": "CREATED",
+		"states": ["CREATED", "PAID", "CANCELLED"],
+		"terminal": ["CANCELLED"],
+		"transitions": [
+			{"from": "CREATED", "to": "PAID", "inputs": ["payment_id"], "record": ["payment_id"], "guards": ["positive_total"]},
+			{"from": "CREATED", "to": "CANCELLED"},
+			{"from": "PAID", "to": "CANCELLED", "prepare": ["request_refund"]}%s
+		]
+	}`, extra))
+}
+
+func TestLoadLifecycle(t *testing.T) {
+	if _, err := LoadLifecycle(miniLifecycle("")); err != nil {
+		t.Fatalf("valid lifecycle rejected: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"unknown state", miniLifecycle(`, {"from": "PAID", "to": "SHIPPED"}`), "undeclared state"},
+		{"unknown guard", miniLifecycle(`, {"from": "PAID", "to": "CREATED", "guards": ["is_vip"]}`), `unknown guard "is_vip"`},
+		{"unknown record", miniLifecycle(`, {"from": "PAID", "to": "CREATED", "inputs": ["coupon"], "record": ["coupon"]}`), `"coupon" cannot be recorded`},
+		{"record without input", miniLifecycle(`, {"from": "PAID", "to": "CREATED", "record": ["payment_id"]}`), "not one of its inputs"},
+		{"unknown preparation", miniLifecycle(`, {"from": "PAID", "to": "CREATED", "prepare": ["charge_card"]}`), `unknown preparation "charge_card"`},
+		{"unknown action", miniLifecycle(`, {"from": "PAID", "to": "CREATED", "actions": ["send_email"]}`), `unknown action "send_email"`},
+		{"transition out of a terminal state", miniLifecycle(`, {"from": "CANCELLED", "to": "CREATED"}`), "terminal state CANCELLED has outgoing transitions"},
+		{"duplicate transition", miniLifecycle(`, {"from": "CREATED", "to": "PAID"}`), "defined twice"},
+		{"undeclared initial state", []byte(`{"initial": "NEW", "states": ["CREATED"], "terminal": ["CREATED"]}`), `initial state "NEW"`},
+		{"undeclared terminal state", []byte(`{"initial": "CREATED", "states": ["CREATED"], "terminal": ["DONE"]}`), `terminal state "DONE"`},
+		{"state without transitions", []byte(`{"initial": "CREATED", "states": ["CREATED", "PAID", "DONE"], "terminal": ["DONE"],
+			"transitions": [{"from": "CREATED", "to": "PAID"}, {"from": "CREATED", "to": "DONE"}]}`), "state PAID is a dead end"},
+		{"unreachable state", []byte(`{"initial": "CREATED", "states": ["CREATED", "DONE", "LOST"], "terminal": ["DONE"],
+			"transitions": [{"from": "CREATED", "to": "DONE"}, {"from": "LOST", "to": "DONE"}]}`), "state LOST is unreachable"},
+		{"not JSON", []byte(`{"initial": `), "parse lifecycle"},
+	}
+	for _, tc := range tests {
+		_, err := LoadLifecycle(tc.data)
+		if err == nil {
+			t.Errorf("%s: accepted", tc.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: err = %v, want it to mention %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestShippedLifecycle(t *testing.T) {
+	data, err := os.ReadFile("lifecycle.json")
+	if err != nil {
+		t.Fatalf("read lifecycle.json: %v", err)
+	}
+	lc, err := LoadLifecycle(data)
+	if err != nil {
+		t.Fatalf("lifecycle.json does not load: %v", err)
+	}
+	for _, state := range []string{StatusCancelled, StatusRefunded} {
+		if !lc.terminal[state] || len(lc.transitions[state]) != 0 {
+			t.Errorf("%s is not a terminal state without transitions", state)
+		}
+	}
+	for _, state := range []string{
+		StatusCreated, StatusPendingPayment, StatusPaymentFailed, StatusPaid, StatusCancelled, StatusShipping,
+		StatusDelivered, StatusShipFailed, StatusReturnRequested, StatusReturned, StatusRefundPending, StatusRefunded,
+	} {
+		if !lc.HasState(state) {
+			t.Errorf("lifecycle.json lacks state %s", state)
+		}
+	}
+
+	// Reopening a terminal state is rejected in the shipped file too.
+	for _, reopen := range []TransitionDefinition{
+		{From: StatusCancelled, To: StatusPendingPayment},
+		{From: StatusRefunded, To: StatusRefundPending, Prepare: []string{"request_refund"}},
+	} {
+		var def LifecycleDefinition
+		if err := json.Unmarshal(data, &def); err != nil {
+			t.Fatalf("parse lifecycle.json: %v", err)
+		}
+		def.Transitions = append(def.Transitions, reopen)
+		if _, err := NewLifecycle(def); err == nil || !strings.Contains(err.Error(), "terminal state "+reopen.From) {
+			t.Errorf("%s → %s: err = %v, want a terminal state error", reopen.From, reopen.To, err)
+		}
+	}
+}
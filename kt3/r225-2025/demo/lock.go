@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Lease identifies one successful lock acquisition. Owner is a random token
+// unique to the acquisition; Release, Refresh and IsHeld only act on the
+// lock while it is still held by that owner. Fence is a per-key counter that
+// strictly increases with every acquisition, so storage can reject writes
+// from a holder whose lease has since been taken over.
+type Lease struct {
+	Key   string
+	Owner string
+	Fence int64
+}
+
+// Locker is the distributed lock abstraction used by StateMachine.
+// Acquire returns ErrLockNotAcquired when the lock is held by someone else;
+// retrying is left to the caller.
+type Locker interface {
+	Acquire(ctx context.Context, key string, ttl time.Duration) (*Lease, error)
+	Release(ctx context.Context, lease *Lease) (bool, error)
+	Refresh(ctx context.Context, lease *Lease, ttl time.Duration) (bool, error)
+	IsHeld(ctx context.Context, lease *Lease) (bool, error)
+}
+
+// acquireLockScript sets the lock and bumps the fencing counter in one step,
+// so a fence is only handed out together with ownership. The counter key has
+// no TTL and outlives the lock itself.
+var acquireLockScript = redis.NewScript(`
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+    return redis.call("INCR", KEYS[2])
+end
+return 0
+`)
+
+// releaseLockScript deletes the key only if it still holds our owner token,
+// so a holder whose TTL expired cannot delete a lock taken over by another
+// process.
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+    return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+var refreshLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+    return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+type RedisLocker struct {
+	rdb *redis.Client
+}
+
+func NewRedisLocker(rdb *redis.Client) *RedisLocker {
+	return &RedisLocker{rdb: rdb}
+}
+
+func (l *RedisLocker) Acquire(ctx context.Context, key string, ttl time.Duration) (*Lease, error) {
+	owner := uuid.New().String()
+
+	fence, err := acquireLockScript.Run(ctx, l.rdb, []string{key, fenceKey(key)}, owner, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return nil, fmt.Errorf("redis lock error: %w", err)
+	}
+	if fence == 0 {
+		return nil, ErrLockNotAcquired
+	}
+	return &Lease{Key: key, Owner: owner, Fence: fence}, nil
+}
+
+func (l *RedisLocker) Release(ctx context.Context, lease *Lease) (bool, error) {
+	n, err := releaseLockScript.Run(ctx, l.rdb, []string{lease.Key}, lease.Owner).Int64()
+	if err != nil {
+		return false, fmt.Errorf("redis lock release error: %w", err)
+	}
+	return n == 1, nil
+}
+
+func (l *RedisLocker) Refresh(ctx context.Context, lease *Lease, ttl time.Duration) (bool, error) {
+	n, err := refreshLockScript.Run(ctx, l.rdb, []string{lease.Key}, lease.Owner, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return false, fmt.Errorf("redis lock refresh error: %w", err)
+	}
+	return n == 1, nil
+}
+
+func (l *RedisLocker) IsHeld(ctx context.Context, lease *Lease) (bool, error) {
+	owner, err := l.rdb.Get(ctx, lease.Key).Result()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("redis lock check error: %w", err)
+	}
+	return owner == lease.Owner, nil
+}
+
+func fenceKey(key string) string {
+	return key + ":fence"
+}
+
+// MemoryLocker is an in-process Locker with the same owner semantics as
+// RedisLocker. Expired entries are treated as free on the next access.
+type MemoryLocker struct {
+	mu     sync.Mutex
+	locks  map[string]memoryLock
+	fences map[string]int64
+	clock  Clock
+}
+
+type memoryLock struct {
+	owner     string
+	expiresAt time.Time
+}
+
+func NewMemoryLocker() *MemoryLocker {
+	return &MemoryLocker{
+		locks:  make(map[string]memoryLock),
+		fences: make(map[string]int64),
+		clock:  systemClock{},
+	}
+}
+
+func (l *MemoryLocker) Acquire(_ context.Context, key string, ttl time.Duration) (*Lease, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, held := l.current(key); held {
+		return nil, ErrLockNotAcquired
+	}
+
+	owner := uuid.New().String()
+	l.locks[key] = memoryLock{owner: owner, expiresAt: l.clock.Now().Add(ttl)}
+	l.fences[key]++
+	return &Lease{Key: key, Owner: owner, Fence: l.fences[key]}, nil
+}
+
+func (l *MemoryLocker) Release(_ context.Context, lease *Lease) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock, held := l.current(lease.Key)
+	if !held || lock.owner != lease.Owner {
+		return false, nil
+	}
+	delete(l.locks, lease.Key)
+	return true, nil
+}
+
+func (l *MemoryLocker) Refresh(_ context.Context, lease *Lease, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock, held := l.current(lease.Key)
+	if !held || lock.owner != lease.Owner {
+		return false, nil
+	}
+	lock.expiresAt = l.clock.Now().Add(ttl)
+	l.locks[lease.Key] = lock
+	return true, nil
+}
+
+func (l *MemoryLocker) IsHeld(_ context.Context, lease *Lease) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock, held := l.current(lease.Key)
+	return held && lock.owner == lease.Owner, nil
+}
+
+// current returns the live lock for key, evicting it if its TTL has passed.
+// Callers must hold l.mu.
+func (l *MemoryLocker) current(key string) (memoryLock, bool) {
+	lock, ok := l.locks[key]
+	if !ok {
+		return memoryLock{}, false
+	}
+	if !l.clock.Now().Before(lock.expiresAt) {
+		delete(l.locks, key)
+		return memoryLock{}, false
+	}
+	return lock, true
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryLockerExpiry(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	locker := NewMemoryLocker()
+	locker.clock = clock
+
+	first, err := locker.Acquire(ctx, "order:o1", time.Second)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if _, err := locker.Acquire(ctx, "order:o1", time.Second); !errors.Is(err, ErrLockNotAcquired) {
+		t.Fatalf("second Acquire while held: err = %v, want ErrLockNotAcquired", err)
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if ok, _ := locker.Refresh(ctx, first, time.Second); !ok {
+		t.Fatal("Refresh before expiry failed")
+	}
+	clock.Advance(999 * time.Millisecond)
+	if held, _ := locker.IsHeld(ctx, first); !held {
+		t.Fatal("lock expired before its refreshed TTL")
+	}
+
+	clock.Advance(time.Millisecond)
+	if held, _ := locker.IsHeld(ctx, first); held {
+		t.Fatal("lock still held after its TTL")
+	}
+	second, err := locker.Acquire(ctx, "order:o1", time.Second)
+	if err != nil {
+		t.Fatalf("Acquire after expiry: %v", err)
+	}
+	if second.Fence <= first.Fence {
+		t.Fatalf("fence %d after %d, want it to grow", second.Fence, first.Fence)
+	}
+
+	// The expired holder must not disturb the new one.
+	if ok, _ := locker.Refresh(ctx, first, time.Second); ok {
+		t.Fatal("expired holder refreshed the new holder's lock")
+	}
+	if ok, _ := locker.Release(ctx, first); ok {
+		t.Fatal("expired holder released the new holder's lock")
+	}
+	if held, _ := locker.IsHeld(ctx, second); !held {
+		t.Fatal("new holder lost the lock")
+	}
+	if ok, _ := locker.Release(ctx, second); !ok {
+		t.Fatal("holder could not release its lock")
+	}
+}
+
+// TestExpiredLeaseWriteIsFenced is the case fencing exists for: a holder
+// pauses past its TTL, another process takes the lock and writes, and the
+// first holder's late write must be refused.
+func TestExpiredLeaseWriteIsFenced(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+	clock := newFakeClock()
+	env.locker.clock = clock
+	order := env.seedOrder(t, "c1", StatusPendingPayment)
+
+	slow, err := env.locker.Acquire(ctx, "order:"+order.OrderID, time.Second)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	clock.Advance(2 * time.Second)
+	fast, err := env.locker.Acquire(ctx, "order:"+order.OrderID, time.Second)
+	if err != nil {
+		t.Fatalf("Acquire after expiry: %v", err)
+	}
+	if err := env.store.UpdateOrderStatus(ctx, order.OrderID, StatusPendingPayment, StatusCancelled, "cancelled", fast.Fence, OrderFields{}); err != nil {
+		t.Fatalf("write by current holder: %v", err)
+	}
+
+	err = env.store.UpdateOrderStatus(ctx, order.OrderID, StatusCancelled, StatusPaid, "paid", slow.Fence, OrderFields{PaymentID: "pay_late"})
+	if !errors.Is(err, ErrStaleFence) {
+		t.Fatalf("write by expired holder: err = %v, want ErrStaleFence", err)
+	}
+	if got := env.status(t, order.OrderID); got != StatusCancelled {
+		t.Fatalf("status = %s, want CANCELLED", got)
+	}
+}
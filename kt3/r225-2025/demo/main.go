@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -17,8 +20,10 @@ func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
 	log.Println("=== Ordering Service (Race Condition + Webhook Canonicalization Demo) ===")
 
+	storeBackend := envOrDefault("STORE_BACKEND", "cassandra")
 	cassandraHost := envOrDefault("CASSANDRA_HOST", "localhost")
 	cassandraTimeout := 120 * time.Second
+	lockBackend := envOrDefault("LOCK_BACKEND", "redis")
 	redisAddr := envOrDefault("REDIS_ADDR", "localhost:6379")
 	webhookSecret := envOrDefault("WEBHOOK_SECRET", "default-webhook-secret-change-me")
 
@@ -28,54 +33,235 @@ func main() {
 	lockTTLMs, _ := strconv.Atoi(envOrDefault("LOCK_TTL_MS", "1000"))
 	lockTTL := time.Duration(lockTTLMs) * time.Millisecond
 
+	idempotencyBackend := envOrDefault("IDEMPOTENCY_BACKEND", "redis")
+	idempotencyTTL, err := time.ParseDuration(envOrDefault("IDEMPOTENCY_TTL", "24h"))
+	if err != nil {
+		log.Fatalf("[main] Invalid IDEMPOTENCY_TTL: %v", err)
+	}
+
+	webhookDedupTTL, err := time.ParseDuration(envOrDefault("WEBHOOK_DEDUP_TTL", "72h"))
+	if err != nil {
+		log.Fatalf("[main] Invalid WEBHOOK_DEDUP_TTL: %v", err)
+	}
+
+	webhookTolerance, err := time.ParseDuration(envOrDefault("WEBHOOK_TOLERANCE", "5m"))
+	if err != nil {
+		log.Fatalf("[main] Invalid WEBHOOK_TOLERANCE: %v", err)
+	}
+
 	listenAddr := envOrDefault("LISTEN_ADDR", ":8080")
+	rateLimitBackend := envOrDefault("RATELIMIT_BACKEND", "redis")
 
-	log.Printf("[main] Connecting to Cassandra at %s (timeout %v)...", cassandraHost, cassandraTimeout)
-	session, err := ConnectCassandra(cassandraHost, cassandraTimeout)
+	trustedProxies, err := ParseTrustedProxies(os.Getenv("RATELIMIT_TRUSTED_PROXIES"))
 	if err != nil {
-		log.Fatalf("[main] Failed to connect to Cassandra: %v", err)
+		log.Fatalf("[main] Invalid RATELIMIT_TRUSTED_PROXIES: %v", err)
 	}
-	defer session.Close()
 
-	log.Printf("[main] Connecting to Redis at %s...", redisAddr)
-	rdb := redis.NewClient(&redis.Options{
-		Addr: redisAddr,
-	})
-	if err := rdb.Ping(context.Background()).Err(); err != nil {
-		log.Fatalf("[main] Failed to connect to Redis: %v", err)
+	refundPollInterval, err := time.ParseDuration(envOrDefault("REFUND_POLL_INTERVAL", "2s"))
+	if err != nil {
+		log.Fatalf("[main] Invalid REFUND_POLL_INTERVAL: %v", err)
 	}
-	log.Println("[main] Connected to Redis")
 
-	store := NewOrderStore(session)
-	if err := store.InitSchema(); err != nil {
-		log.Fatalf("[main] Failed to initialize schema: %v", err)
+	var catalog CatalogClient
+	if catalogURL := os.Getenv("CATALOG_URL"); catalogURL != "" {
+		catalogTimeout, err := time.ParseDuration(envOrDefault("CATALOG_TIMEOUT", "2s"))
+		if err != nil {
+			log.Fatalf("[main] Invalid CATALOG_TIMEOUT: %v", err)
+		}
+		log.Printf("[main] Using catalog service at %s (timeout %v)", catalogURL, catalogTimeout)
+		catalog = NewHTTPCatalogClient(catalogURL, catalogTimeout)
+	} else {
+		log.Println("[main] CATALOG_URL not set, using built-in demo catalog")
+		catalog = NewFakeCatalogClient(DemoCatalogProducts...)
 	}
 
-	sm := NewStateMachine(store, rdb, lockTTL, maxProcessingDelay)
+	var store OrderStore
+	var refunds RefundStore
+	var shipments ShipmentStore
+	switch storeBackend {
+	case "cassandra":
+		log.Printf("[main] Connecting to Cassandra at %s (timeout %v)...", cassandraHost, cassandraTimeout)
+		session, err := ConnectCassandra(cassandraHost, cassandraTimeout)
+		if err != nil {
+			log.Fatalf("[main] Failed to connect to Cassandra: %v", err)
+		}
+		defer session.Close()
+
+		cassandraStore := NewCassandraOrderStore(session)
+		if err := cassandraStore.InitSchema(); err != nil {
+			log.Fatalf("[main] Failed to initialize schema: %v", err)
+		}
+		store = cassandraStore
+
+		if os.Getenv("MONEY_BACKFILL") == "true" {
+			go func() {
+				converted, err := cassandraStore.BackfillOrderMoney(context.Background())
+				if err != nil {
+					log.Printf("[main] Money backfill stopped after %d orders: %v", converted, err)
+					return
+				}
+				log.Printf("[main] Money backfill converted %d orders", converted)
+			}()
+		}
+
+		if os.Getenv("ORDER_INDEX_BACKFILL") == "true" {
+			go func() {
+				indexed, err := cassandraStore.ReconcileOrderIndexes(context.Background())
+				if err != nil {
+					log.Printf("[main] Order index backfill stopped after %d orders: %v", indexed, err)
+					return
+				}
+				log.Printf("[main] Order index backfill indexed %d orders", indexed)
+			}()
+		}
+
+		// Rewrites index rows whose update failed after a committed
+		// transition; 0 turns periodic reconciliation off.
+		reconcileInterval, err := time.ParseDuration(envOrDefault("ORDER_INDEX_RECONCILE_INTERVAL", "1h"))
+		if err != nil {
+			log.Fatalf("[main] Invalid ORDER_INDEX_RECONCILE_INTERVAL: %v", err)
+		}
+		if reconcileInterval > 0 {
+			log.Printf("[main] Reconciling order indexes every %v", reconcileInterval)
+			go cassandraStore.RunIndexReconciler(context.Background(), reconcileInterval)
+		}
+
+		refundStore := NewCassandraRefundStore(session)
+		if err := refundStore.InitSchema(); err != nil {
+			log.Fatalf("[main] Failed to initialize refund schema: %v", err)
+		}
+		refunds = refundStore
+
+		shipmentStore := NewCassandraShipmentStore(session)
+		if err := shipmentStore.InitSchema(); err != nil {
+			log.Fatalf("[main] Failed to initialize shipment schema: %v", err)
+		}
+		shipments = shipmentStore
+	case "memory":
+		log.Println("[main] Using in-memory order store (data is not persisted)")
+		store = NewMemoryOrderStore()
+		refunds = NewMemoryRefundStore()
+		shipments = NewMemoryShipmentStore()
+	default:
+		log.Fatalf("[main] Unknown STORE_BACKEND %q (expected \"cassandra\" or \"memory\")", storeBackend)
+	}
+
+	// Redis is connected lazily, only if some backend below needs it.
+	var rdb *redis.Client
+	redisClient := func() *redis.Client {
+		if rdb != nil {
+			return rdb
+		}
+		log.Printf("[main] Connecting to Redis at %s...", redisAddr)
+		rdb = redis.NewClient(&redis.Options{
+			Addr: redisAddr,
+		})
+		if err := rdb.Ping(context.Background()).Err(); err != nil {
+			log.Fatalf("[main] Failed to connect to Redis: %v", err)
+		}
+		log.Println("[main] Connected to Redis")
+		return rdb
+	}
+
+	var locker Locker
+	switch lockBackend {
+	case "redis":
+		locker = NewRedisLocker(redisClient())
+	case "memory":
+		log.Println("[main] Using in-process lock (single instance only)")
+		locker = NewMemoryLocker()
+	default:
+		log.Fatalf("[main] Unknown LOCK_BACKEND %q (expected \"redis\" or \"memory\")", lockBackend)
+	}
+
+	var idempotencyStore IdempotencyStore
+	switch idempotencyBackend {
+	case "redis":
+		idempotencyStore = NewRedisIdempotencyStore(redisClient())
+	case "memory":
+		log.Println("[main] Using in-process idempotency store (single instance only)")
+		idempotencyStore = NewMemoryIdempotencyStore()
+	default:
+		log.Fatalf("[main] Unknown IDEMPOTENCY_BACKEND %q (expected \"redis\" or \"memory\")", idempotencyBackend)
+	}
+
+	var rateLimiter RateLimiter
+	switch rateLimitBackend {
+	case "redis":
+		// If Redis fails at runtime the limits fall back to this instance.
+		rateLimiter = NewFallbackRateLimiter(NewRedisRateLimiter(redisClient()), NewMemoryRateLimiter())
+	case "memory":
+		log.Println("[main] Using in-process rate limiter (limits are per instance)")
+		rateLimiter = NewMemoryRateLimiter()
+	default:
+		log.Fatalf("[main] Unknown RATELIMIT_BACKEND %q (expected \"redis\" or \"memory\")", rateLimitBackend)
+	}
+	log.Printf("[main] rate limit trusted proxies=%v", trustedProxies)
+
+	lifecycle, err := loadLifecycle(os.Getenv("LIFECYCLE_FILE"))
+	if err != nil {
+		log.Fatalf("[main] Invalid order lifecycle: %v", err)
+	}
+
+	sm := NewStateMachine(store, refunds, locker, lifecycle, DefaultAccessPolicy, lockTTL, maxProcessingDelay)
+
+	// Only the fake provider exists so far; a real adapter implements
+	// RefundProvider and is selected here.
+	refundWorker := NewRefundWorker(refunds, NewFakeRefundProvider(), sm, refundPollInterval)
+	go refundWorker.Run(context.Background())
 
 	log.Printf("[main] lockTTL=%v, maxProcessingDelay=%v", lockTTL, maxProcessingDelay)
 
-	log.Printf("[main] webhookSecret configured (%d chars)", len(webhookSecret))
+	webhookKeys, err := loadWebhookKeyring(webhookSecret)
+	if err != nil {
+		log.Fatalf("[main] Invalid webhook key configuration: %v", err)
+	}
+	log.Printf("[main] webhook keys configured: %v", webhookKeys.IDs())
 
-	h := NewHandlers(store, sm, webhookSecret)
+	log.Printf("[main] webhook timestamp tolerance=±%v, dedupTTL=%v", webhookTolerance, webhookDedupTTL)
+
+	cursorKey, err := loadCursorKey()
+	if err != nil {
+		log.Fatalf("[main] Invalid CURSOR_SECRET: %v", err)
+	}
+
+	jwtVerifier, err := loadJWTVerifier()
+	if err != nil {
+		log.Fatalf("[main] Invalid auth configuration: %v", err)
+	}
+	log.Printf("[main] JWT verification keys: %v", jwtVerifier.IDs())
+
+	webhookSchemes, err := LookupSignatureSchemes(envOrDefault("WEBHOOK_SIGNATURE_SCHEMES", "v1,v2"))
+	if err != nil {
+		log.Fatalf("[main] Invalid WEBHOOK_SIGNATURE_SCHEMES: %v", err)
+	}
+
+	h := NewHandlers(store, catalog, refunds, shipments, sm, DefaultAccessPolicy, WebhookConfig{
+		Verifier: NewWebhookVerifier(webhookKeys, webhookSchemes, webhookTolerance, systemClock{}),
+		Dedup:    idempotencyStore,
+		DedupTTL: webhookDedupTTL,
+	}, cursorKey)
 
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(RealIP(trustedProxies))
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(30 * time.Second))
+	r.Use(RateLimitByIP(rateLimiter, DefaultRateLimits))
 
-	r.Post("/orders", h.CreateOrder)
-	r.Get("/orders/{orderID}", h.GetOrder)
-	r.Post("/orders/{orderID}/pay", h.PayOrder)
-	r.Post("/orders/{orderID}/cancel", h.CancelOrder)
-	r.Post("/orders/{orderID}/ship", h.ShipOrder)
-	r.Get("/orders/{orderID}/history", h.GetOrderHistory)
+	// Every request but /health carries a JWT whose role must hold the
+	// permission DefaultAccessPolicy assigns to the route, and is then
+	// limited per caller by DefaultRateLimits. Idempotency runs after
+	// authentication so stored responses are scoped to the caller.
+	r.Group(func(r chi.Router) {
+		r.Use(Authenticate(jwtVerifier))
+		r.Use(Authorize(DefaultAccessPolicy))
+		r.Use(RateLimitByCaller(rateLimiter, DefaultRateLimits))
+		r.Use(Idempotency(idempotencyStore, idempotencyTTL))
 
-	// Shipping webhook endpoint (receives status updates from logistics provider)
-	r.Post("/webhooks/shipping", h.ShippingWebhook)
-	r.Post("/webhooks/shipping/v2", h.ShippingWebhookV2)
+		h.Routes(r)
+	})
 
 	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -88,6 +274,85 @@ func main() {
 	}
 }
 
+// loadLifecycle reads the lifecycle definition from path, or returns the
+// embedded default when path is empty.
+func loadLifecycle(path string) (*Lifecycle, error) {
+	if path == "" {
+		return DefaultLifecycle()
+	}
+	log.Printf("[main] Loading order lifecycle from %s", path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read lifecycle file: %w", err)
+	}
+	return LoadLifecycle(data)
+}
+
+// loadJWTVerifier builds the token verifier from AUTH_JWKS_FILE (a local JWK
+// Set with RS256 and/or HS256 keys) and AUTH_JWT_SECRET (a single HS256 key
+// "default"). At least one of them must be set. AUTH_ISSUER and
+// AUTH_AUDIENCE, when set, must match the token's iss and aud.
+func loadJWTVerifier() (*JWTVerifier, error) {
+	var keys []JWTKey
+	if path := os.Getenv("AUTH_JWKS_FILE"); path != "" {
+		log.Printf("[main] Loading JWT keys from %s", path)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read jwks file: %w", err)
+		}
+		fileKeys, err := ParseJWKS(data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, fileKeys...)
+	}
+	if secret := os.Getenv("AUTH_JWT_SECRET"); secret != "" {
+		keys = append(keys, JWTKey{ID: "default", Algorithm: "HS256", Secret: []byte(secret)})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("set AUTH_JWKS_FILE or AUTH_JWT_SECRET")
+	}
+	return NewJWTVerifier(keys, os.Getenv("AUTH_ISSUER"), os.Getenv("AUTH_AUDIENCE"), systemClock{})
+}
+
+// loadWebhookKeyring builds the keyring from WEBHOOK_KEYS (JSON array of
+// keys) and WEBHOOK_ACTIVE_KEY_ID. Without WEBHOOK_KEYS the single legacy
+// WEBHOOK_SECRET becomes the active key "default".
+// loadCursorKey returns CURSOR_SECRET, which signs pagination cursors. Without
+// it a random key is used: cursors then stop working on restart and on
+// every other instance.
+func loadCursorKey() ([]byte, error) {
+	if secret := os.Getenv("CURSOR_SECRET"); secret != "" {
+		if len(secret) < 32 {
+			return nil, errors.New("must be at least 32 bytes")
+		}
+		return []byte(secret), nil
+	}
+	log.Println("[main] CURSOR_SECRET not set, using a random key (cursors are valid on this instance until restart)")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func loadWebhookKeyring(legacySecret string) (*WebhookKeyring, error) {
+	raw := os.Getenv("WEBHOOK_KEYS")
+	if raw == "" {
+		return NewWebhookKeyring("default", []WebhookKey{{ID: "default", Secret: legacySecret}}, systemClock{})
+	}
+
+	keys, err := ParseWebhookKeys(raw)
+	if err != nil {
+		return nil, err
+	}
+	activeID := os.Getenv("WEBHOOK_ACTIVE_KEY_ID")
+	if activeID == "" && len(keys) > 0 {
+		activeID = keys[0].ID
+	}
+	return NewWebhookKeyring(activeID, keys, systemClock{})
+}
+
 func envOrDefault(key, defaultVal string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
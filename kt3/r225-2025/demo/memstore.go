@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MemoryOrderStore is a thread-safe, process-local OrderStore. It mirrors the
+// semantics of CassandraOrderStore so the HTTP API and the state machine can
+// run without a Cassandra node.
+type MemoryOrderStore struct {
+	mu        sync.RWMutex
+	orders    map[string]*Order
+	history   map[string][]StatusChange
+	fences    map[string]int64
+	snapshots map[string][]ItemSnapshot
+}
+
+func NewMemoryOrderStore() *MemoryOrderStore {
+	return &MemoryOrderStore{
+		orders:    make(map[string]*Order),
+		history:   make(map[string][]StatusChange),
+		fences:    make(map[string]int64),
+		snapshots: make(map[string][]ItemSnapshot),
+	}
+}
+
+// CreateOrder inserts a new order with CREATED status, priced from snapshots.
+func (s *MemoryOrderStore) CreateOrder(_ context.Context, customerID string, snapshots []ItemSnapshot) (*Order, error) {
+	orderID := uuid.New().String()
+	now := time.Now()
+
+	items, total, err := snapshotOrderItems(snapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	order := &Order{
+		OrderID:    orderID,
+		CustomerID: customerID,
+		Status:     StatusCreated,
+		Items:      items,
+		Total:      total,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.snapshots[orderID]; ok {
+		return nil, ErrSnapshotExists
+	}
+	lines := make([]ItemSnapshot, len(snapshots))
+	for i, snapshot := range snapshots {
+		snapshot.OrderID = orderID
+		lines[i] = snapshot
+	}
+	s.snapshots[orderID] = lines
+	s.orders[orderID] = order
+	s.history[orderID] = append(s.history[orderID], StatusChange{
+		OrderID:   orderID,
+		Status:    StatusCreated,
+		Reason:    "order created",
+		ChangedAt: now,
+	})
+
+	return copyOrder(order), nil
+}
+
+// GetOrder retrieves an order by ID.
+func (s *MemoryOrderStore) GetOrder(_ context.Context, orderID string) (*Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	order, ok := s.orders[orderID]
+	if !ok {
+		return nil, ErrOrderNotFound
+	}
+	return copyOrder(order), nil
+}
+
+// UpdateOrderStatus moves the order from expectedStatus to newStatus and
+// records the change in history, with the same ErrTransitionConflict and
+// ErrStaleFence semantics as CassandraOrderStore.
+func (s *MemoryOrderStore) UpdateOrderStatus(_ context.Context, orderID, expectedStatus, newStatus, reason string, fence int64, fields OrderFields) error {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[orderID]
+	if !ok {
+		return ErrOrderNotFound
+	}
+	if order.Status != expectedStatus {
+		return ErrTransitionConflict
+	}
+	if fence > 0 {
+		if fence < s.fences[orderID] {
+			return ErrStaleFence
+		}
+		s.fences[orderID] = fence
+	}
+	order.Status = newStatus
+	order.Reason = reason
+	order.UpdatedAt = now
+	if fields.PaymentID != "" {
+		order.PaymentID = fields.PaymentID
+	}
+
+	s.history[orderID] = append(s.history[orderID], StatusChange{
+		OrderID:   orderID,
+		Status:    newStatus,
+		Reason:    reason,
+		ChangedAt: now,
+	})
+
+	return nil
+}
+
+// GetOrderHistory returns the status change history for an order,
+// ordered by most recent first.
+func (s *MemoryOrderStore) GetOrderHistory(_ context.Context, orderID string) ([]StatusChange, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := s.history[orderID]
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	history := make([]StatusChange, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		history = append(history, entries[i])
+	}
+	return history, nil
+}
+
+func copyOrder(order *Order) *Order {
+	cp := *order
+	cp.Items = append([]OrderItem(nil), order.Items...)
+	return &cp
+}
+
+func (s *MemoryOrderStore) GetItemSnapshots(_ context.Context, orderID string) ([]ItemSnapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]ItemSnapshot{}, s.snapshots[orderID]...), nil
+}
+
+// ListCustomerOrders pages through the customer's orders like the Cassandra
+// store; its paging state is simply the offset of the next page.
+func (s *MemoryOrderStore) ListCustomerOrders(_ context.Context, customerID string, filter OrderFilter, pageSize int, pageState []byte) ([]OrderSummary, []byte, error) {
+	offset, err := memoryPageOffset(pageState)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.mu.RLock()
+	var matched []OrderSummary
+	for _, order := range s.orders {
+		if order.CustomerID == customerID && matchesFilter(order, filter) {
+			matched = append(matched, summarizeOrder(order))
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		if !matched[i].CreatedAt.Equal(matched[j].CreatedAt) {
+			return matched[i].CreatedAt.After(matched[j].CreatedAt)
+		}
+		return matched[i].OrderID < matched[j].OrderID
+	})
+	orders, next := memoryPage(matched, offset, pageSize)
+	return orders, next, nil
+}
+
+// ListOrdersByStatus pages through the orders in filter.Status by the time
+// they entered it, oldest first, with the same offset paging state as
+// ListCustomerOrders.
+func (s *MemoryOrderStore) ListOrdersByStatus(_ context.Context, filter OrderFilter, pageSize int, pageState []byte) ([]OrderSummary, []byte, error) {
+	offset, err := memoryPageOffset(pageState)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.mu.RLock()
+	var matched []OrderSummary
+	for _, order := range s.orders {
+		if order.Status == filter.Status && !order.UpdatedAt.Before(filter.From) && order.UpdatedAt.Before(filter.To) {
+			matched = append(matched, summarizeOrder(order))
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		if !matched[i].UpdatedAt.Equal(matched[j].UpdatedAt) {
+			return matched[i].UpdatedAt.Before(matched[j].UpdatedAt)
+		}
+		return matched[i].OrderID < matched[j].OrderID
+	})
+	orders, next := memoryPage(matched, offset, pageSize)
+	return orders, next, nil
+}
+
+func memoryPageOffset(pageState []byte) (int, error) {
+	if pageState == nil {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(string(pageState))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: bad offset %q", ErrInvalidCursor, pageState)
+	}
+	return n, nil
+}
+
+func memoryPage(matched []OrderSummary, offset, pageSize int) ([]OrderSummary, []byte) {
+	if offset > len(matched) {
+		offset = len(matched)
+	}
+	end := offset + pageSize
+	if end >= len(matched) {
+		return append([]OrderSummary{}, matched[offset:]...), nil
+	}
+	return matched[offset:end], []byte(strconv.Itoa(end))
+}
+
+func matchesFilter(order *Order, filter OrderFilter) bool {
+	if filter.Status != "" && order.Status != filter.Status {
+		return false
+	}
+	if !filter.From.IsZero() && order.CreatedAt.Before(filter.From) {
+		return false
+	}
+	if !filter.To.IsZero() && !order.CreatedAt.Before(filter.To) {
+		return false
+	}
+	return true
+}
+
+func summarizeOrder(order *Order) OrderSummary {
+	return OrderSummary{
+		OrderID:    order.OrderID,
+		CustomerID: order.CustomerID,
+		Status:     order.Status,
+		Total:      order.Total,
+		CreatedAt:  order.CreatedAt,
+		UpdatedAt:  order.UpdatedAt,
+	}
+}
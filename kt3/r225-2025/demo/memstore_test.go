@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestMemoryOrderStoreStatusCAS(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+
+	// Both writers expect PENDING_PAYMENT; only one may move the order.
+	for i := 0; i < 50; i++ {
+		order := env.seedOrder(t, "c1", StatusPendingPayment)
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for j, target := range []string{StatusPaid, StatusCancelled} {
+			wg.Add(1)
+			go func(j int, target string) {
+				defer wg.Done()
+				errs[j] = env.store.UpdateOrderStatus(ctx, order.OrderID, StatusPendingPayment, target, "race", 0, OrderFields{})
+			}(j, target)
+		}
+		wg.Wait()
+
+		won := 0
+		for _, err := range errs {
+			switch {
+			case err == nil:
+				won++
+			case !errors.Is(err, ErrTransitionConflict):
+				t.Fatalf("loser: err = %v, want ErrTransitionConflict", err)
+			}
+		}
+		if won != 1 {
+			t.Fatalf("%d writers won, want exactly 1", won)
+		}
+	}
+}
+
+func TestMemoryOrderStoreRejectsStaleFence(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+	order := env.seedOrder(t, "c1", StatusPendingPayment)
+
+	if err := env.store.UpdateOrderStatus(ctx, order.OrderID, StatusPendingPayment, StatusPaymentFailed, "declined", 5, OrderFields{}); err != nil {
+		t.Fatalf("write with fence 5: %v", err)
+	}
+	err := env.store.UpdateOrderStatus(ctx, order.OrderID, StatusPaymentFailed, StatusCancelled, "late writer", 3, OrderFields{})
+	if !errors.Is(err, ErrStaleFence) {
+		t.Fatalf("write with fence 3 after 5: err = %v, want ErrStaleFence", err)
+	}
+	if got := env.status(t, order.OrderID); got != StatusPaymentFailed {
+		t.Fatalf("status = %s, want PAYMENT_FAILED", got)
+	}
+	if err := env.store.UpdateOrderStatus(ctx, order.OrderID, StatusPaymentFailed, StatusPendingPayment, "retry", 5, OrderFields{}); err != nil {
+		t.Fatalf("write with the same fence: %v", err)
+	}
+}
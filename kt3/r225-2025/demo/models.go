@@ -1,31 +1,87 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"time"
 )
 
 const (
-	StatusPendingPayment = "PENDING_PAYMENT"
-	StatusPaid           = "PAID"
-	StatusCancelled      = "CANCELLED"
-	StatusShipping       = "SHIPPING"
-	StatusDelivered      = "DELIVERED"
-	StatusShipFailed     = "SHIP_FAILED"
+	StatusCreated         = "CREATED"
+	StatusPendingPayment  = "PENDING_PAYMENT"
+	StatusPaymentFailed   = "PAYMENT_FAILED"
+	StatusPaid            = "PAID"
+	StatusCancelled       = "CANCELLED"
+	StatusShipping        = "SHIPPING"
+	StatusDelivered       = "DELIVERED"
+	StatusShipFailed      = "SHIP_FAILED"
+	StatusReturnRequested = "RETURN_REQUESTED"
+	StatusReturned        = "RETURNED"
+	StatusRefundPending   = "REFUND_PENDING"
+	StatusRefunded        = "REFUNDED"
 )
 
 var (
-	ErrOrderNotFound        = errors.New("order not found")
-	ErrTransitionNotAllowed = errors.New("state transition not allowed")
-	ErrLockNotAcquired      = errors.New("could not acquire distributed lock")
-	ErrLockExpired          = errors.New("lock expired or stolen during processing (ownership lost)")
-	ErrTransitionConflict   = errors.New("state changed by another process")
+	ErrOrderNotFound          = errors.New("order not found")
+	ErrTransitionNotAllowed   = errors.New("state transition not allowed")
+	ErrLockNotAcquired        = errors.New("could not acquire distributed lock")
+	ErrLockExpired            = errors.New("lock expired or stolen during processing (ownership lost)")
+	ErrTransitionConflict     = errors.New("state changed by another process")
+	ErrStaleFence             = errors.New("stale fencing token (lock taken over by another process)")
+	ErrMissingTransitionInput = errors.New("missing required transition input")
+	ErrTransitionGuardFailed  = errors.New("transition precondition failed")
+	ErrInvalidShippingEvent   = errors.New("invalid shipping event")
+	ErrUnknownShipStatus      = errors.New("unknown shipping status")
+	ErrRefundNotFound         = errors.New("refund not found")
+	ErrRefundExists           = errors.New("refund already exists for order")
+	ErrShipmentNotFound       = errors.New("shipment not found")
+	ErrShipmentOrderMismatch  = errors.New("shipment belongs to a different order")
+	ErrProductNotFound        = errors.New("product not found in catalog")
+	ErrCatalogUnavailable     = errors.New("catalog unavailable")
+	ErrPriceChanged           = errors.New("price changed since it was shown")
+	ErrSnapshotExists         = errors.New("price snapshot already written for order")
+	ErrTooManyItems           = errors.New("too many order items")
+	ErrInvalidMoney           = errors.New("invalid money amount")
+	ErrCurrencyMismatch       = errors.New("currency mismatch")
+	ErrInvalidCursor          = errors.New("invalid cursor")
+
+	ErrWebhookTimestampMissing   = errors.New("webhook timestamp is required")
+	ErrWebhookTimestampStale     = errors.New("webhook timestamp outside tolerance window")
+	ErrWebhookSignatureInvalid   = errors.New("invalid webhook signature")
+	ErrWebhookSignatureMalformed = errors.New("malformed webhook signature header")
+	ErrWebhookKeyUnknown         = errors.New("unknown webhook key id")
+	ErrWebhookKeyNotValid        = errors.New("webhook key is outside its validity window")
+
+	ErrTokenMissing          = errors.New("missing bearer token")
+	ErrTokenMalformed        = errors.New("malformed token")
+	ErrTokenKeyUnknown       = errors.New("unknown token signing key")
+	ErrTokenSignatureInvalid = errors.New("invalid token signature")
+	ErrTokenExpired          = errors.New("token expired or not yet valid")
+	ErrTokenClaimsInvalid    = errors.New("invalid token claims")
+	ErrForbidden             = errors.New("forbidden")
 )
 
+// OrderItem is one order line. In a CreateOrderRequest Price is optional and
+// only states the price the customer was shown; the order is always priced
+// from the catalog snapshot.
 type OrderItem struct {
-	ProductID string  `json:"product_id"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+	Price     Money  `json:"price"`
+}
+
+// ItemSnapshot is the catalog data of one order line captured when the order
+// was placed. Snapshots are written once and never updated, so later catalog
+// changes cannot alter an existing order.
+type ItemSnapshot struct {
+	OrderID    string    `json:"order_id"`
+	LineNo     int       `json:"line_no"`
+	ProductID  string    `json:"product_id"`
+	SKU        string    `json:"sku"`
+	Name       string    `json:"name"`
+	UnitPrice  Money     `json:"unit_price"`
+	Quantity   int       `json:"quantity"`
+	CapturedAt time.Time `json:"captured_at"`
 }
 
 type Order struct {
@@ -33,13 +89,47 @@ type Order struct {
 	CustomerID string      `json:"customer_id"`
 	Status     string      `json:"status"`
 	Items      []OrderItem `json:"items"`
-	Total      float64     `json:"total"`
+	Total      Money       `json:"total"`
 	PaymentID  string      `json:"payment_id,omitempty"`
 	Reason     string      `json:"reason,omitempty"`
 	CreatedAt  time.Time   `json:"created_at"`
 	UpdatedAt  time.Time   `json:"updated_at"`
 }
 
+// OrderSummary is an order as listed from the orders_by_customer or
+// orders_by_status index, without its items.
+type OrderSummary struct {
+	OrderID    string    `json:"order_id"`
+	CustomerID string    `json:"customer_id"`
+	Status     string    `json:"status"`
+	Total      Money     `json:"total"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// OrderFilter narrows an order listing. Empty fields do not filter; From is
+// inclusive and To exclusive, both on created_at for customer listings and on
+// updated_at, the time the order entered its status, for status listings.
+type OrderFilter struct {
+	Status string
+	From   time.Time
+	To     time.Time
+}
+
+// OrderListResponse is one page of an order listing. NextCursor is absent
+// on the last page.
+type OrderListResponse struct {
+	Orders     []OrderSummary `json:"orders"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// OrderFields are order fields written by the same conditional update as a
+// status change, so they can never be missing once the new status is visible.
+// Empty fields are left unchanged.
+type OrderFields struct {
+	PaymentID string
+}
+
 type StatusChange struct {
 	OrderID   string    `json:"order_id"`
 	Status    string    `json:"status"`
@@ -47,6 +137,14 @@ type StatusChange struct {
 	ChangedAt time.Time `json:"changed_at"`
 }
 
+// An order holds at most MaxOrderItems lines of at most MaxItemQuantity
+// units each. The limits bound the catalog lookups per request and the size
+// of the Cassandra batches an order is written in.
+const (
+	MaxOrderItems   = 50
+	MaxItemQuantity = 1000
+)
+
 type CreateOrderRequest struct {
 	CustomerID string      `json:"customer_id"`
 	Items      []OrderItem `json:"items"`
@@ -56,21 +154,54 @@ type PayOrderRequest struct {
 	PaymentID string `json:"payment_id"`
 }
 
+// ShipOrderRequest optionally carries the carrier's shipment id; without one
+// the service assigns an id.
+type ShipOrderRequest struct {
+	ShipmentID     string `json:"shipment_id,omitempty"`
+	Carrier        string `json:"carrier,omitempty"`
+	TrackingNumber string `json:"tracking_number,omitempty"`
+}
+
 type CancelOrderRequest struct {
 	Reason string `json:"reason"`
 }
 
+type PaymentFailedRequest struct {
+	Reason string `json:"reason"`
+}
+
+type ReturnOrderRequest struct {
+	Reason string `json:"reason"`
+}
+
+type RefundOrderRequest struct {
+	Reason string `json:"reason"`
+}
+
+type CompleteRefundRequest struct {
+	RefundRef string `json:"refund_ref"`
+}
+
 type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
 type ShippingWebhookEvent struct {
+	EventID    string `json:"event_id"`
 	ShipmentID string `json:"shipment_id"`
 	OrderID    string `json:"order_id"`
 	EventType  string `json:"event_type"`
 	Status     string `json:"status"`
 	Details    string `json:"details,omitempty"`
 	Timestamp  int64  `json:"timestamp"`
+
+	// Optional. Sequence orders events that share a timestamp; the rest are
+	// shipment details kept on the shipment record when present.
+	Sequence          int64  `json:"sequence,omitempty"`
+	Location          string `json:"location,omitempty"`
+	Carrier           string `json:"carrier,omitempty"`
+	TrackingNumber    string `json:"tracking_number,omitempty"`
+	EstimatedDelivery int64  `json:"estimated_delivery,omitempty"`
 }
 
 type ShippingWebhookResponse struct {
@@ -79,13 +210,108 @@ type ShippingWebhookResponse struct {
 	PreviousStatus  string `json:"previous_status"`
 	NewStatus       string `json:"new_status"`
 	RefundTriggered bool   `json:"refund_triggered"`
+	Ignored         bool   `json:"ignored,omitempty"`
 	Message         string `json:"message"`
 }
 
+type DuplicateWebhookResponse struct {
+	EventID          string          `json:"event_id"`
+	Duplicate        bool            `json:"duplicate"`
+	Message          string          `json:"message"`
+	OriginalStatus   int             `json:"original_status"`
+	OriginalResponse json.RawMessage `json:"original_response"`
+}
+
 const (
 	ShipStatusInTransit = "IN_TRANSIT"
 	ShipStatusDelivered = "DELIVERED"
 	ShipStatusLost      = "LOST"
 	ShipStatusDamaged   = "DAMAGED"
 	ShipStatusReturned  = "RETURNED"
-)
\ No newline at end of file
+
+	// ShipmentStatusRegistered is the status of a shipment bound by ShipOrder
+	// before the carrier has reported anything.
+	ShipmentStatusRegistered = "REGISTERED"
+)
+
+const (
+	RefundStatusPending    = "PENDING"
+	RefundStatusProcessing = "PROCESSING"
+	RefundStatusSucceeded  = "SUCCEEDED"
+	RefundStatusFailed     = "FAILED"
+	// RefundStatusAbandoned marks a refund whose order never reached
+	// REFUND_PENDING because the transition that recorded it failed. It is
+	// queued again if the order gets there after all.
+	RefundStatusAbandoned = "ABANDONED"
+)
+
+// Refund is the audit record of one automated refund. An order has at most
+// one; Attempts and LastError record every failed try with the provider.
+type Refund struct {
+	RefundID    string    `json:"refund_id"`
+	OrderID     string    `json:"order_id"`
+	PaymentID   string    `json:"payment_id"`
+	Amount      Money     `json:"amount"`
+	Reason      string    `json:"reason"`
+	Status      string    `json:"status"`
+	ProviderRef string    `json:"provider_ref,omitempty"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Shipment is the latest known state of one carrier shipment. Status holds
+// the carrier's status (IN_TRANSIT, DELIVERED, ...), not the order status.
+type Shipment struct {
+	ShipmentID        string     `json:"shipment_id"`
+	OrderID           string     `json:"order_id"`
+	Carrier           string     `json:"carrier,omitempty"`
+	TrackingNumber    string     `json:"tracking_number,omitempty"`
+	Status            string     `json:"status"`
+	EstimatedDelivery *time.Time `json:"estimated_delivery,omitempty"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+
+	// Position of the newest carrier event applied so far; older events
+	// are kept in the timeline but no longer change the order.
+	LastEventAt  *time.Time `json:"last_event_at,omitempty"`
+	LastEventSeq int64      `json:"last_event_seq,omitempty"`
+}
+
+// EventPosition orders carrier events: by timestamp, then by sequence.
+type EventPosition struct {
+	At  time.Time
+	Seq int64
+}
+
+func (p EventPosition) Before(other EventPosition) bool {
+	if !p.At.Equal(other.At) {
+		return p.At.Before(other.At)
+	}
+	return p.Seq < other.Seq
+}
+
+func (s *Shipment) lastEvent() EventPosition {
+	if s.LastEventAt == nil {
+		return EventPosition{}
+	}
+	return EventPosition{At: *s.LastEventAt, Seq: s.LastEventSeq}
+}
+
+// TrackingEvent is one carrier event in a shipment's timeline.
+type TrackingEvent struct {
+	ShipmentID string    `json:"shipment_id"`
+	EventID    string    `json:"event_id"`
+	EventType  string    `json:"event_type,omitempty"`
+	Status     string    `json:"status"`
+	Location   string    `json:"location,omitempty"`
+	Details    string    `json:"details,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// ShipmentTracking is a shipment together with its timeline, oldest first.
+type ShipmentTracking struct {
+	Shipment
+	Events []TrackingEvent `json:"events"`
+}
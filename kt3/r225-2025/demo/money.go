@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Money is an amount in the currency's minor units (cents for EUR) together
+// with its ISO 4217 code. Arithmetic is integer-only, so totals never drift
+// the way float64 sums do.
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// currencyExponents maps the accepted ISO 4217 codes to their number of
+// minor-unit digits.
+var currencyExponents = map[string]int{
+	"EUR": 2,
+	"USD": 2,
+	"GBP": 2,
+	"CHF": 2,
+	"RSD": 2,
+	"JPY": 0,
+}
+
+// LegacyCurrency is assumed for rows written before amounts carried a
+// currency; the service only ever sold in EUR until then.
+const LegacyCurrency = "EUR"
+
+// Validate checks that the currency is supported and the amount is not
+// negative.
+func (m Money) Validate() error {
+	if _, ok := currencyExponents[m.Currency]; !ok {
+		return fmt.Errorf("%w: unsupported currency %q", ErrInvalidMoney, m.Currency)
+	}
+	if m.Amount < 0 {
+		return fmt.Errorf("%w: negative amount", ErrInvalidMoney)
+	}
+	return nil
+}
+
+// Add returns m + other. Both must be in the same currency.
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, other.Currency)
+	}
+	sum := m.Amount + other.Amount
+	if (other.Amount > 0 && sum < m.Amount) || (other.Amount < 0 && sum > m.Amount) {
+		return Money{}, fmt.Errorf("%w: amount overflow", ErrInvalidMoney)
+	}
+	return Money{Amount: sum, Currency: m.Currency}, nil
+}
+
+// Times returns m multiplied by a non-negative quantity.
+func (m Money) Times(quantity int) (Money, error) {
+	if quantity < 0 {
+		return Money{}, fmt.Errorf("%w: negative quantity", ErrInvalidMoney)
+	}
+	if quantity > 0 && m.Amount > math.MaxInt64/int64(quantity) {
+		return Money{}, fmt.Errorf("%w: amount overflow", ErrInvalidMoney)
+	}
+	return Money{Amount: m.Amount * int64(quantity), Currency: m.Currency}, nil
+}
+
+// String formats the amount in major units, e.g. "19.99 EUR".
+func (m Money) String() string {
+	exp := currencyExponents[m.Currency]
+	if exp == 0 {
+		return fmt.Sprintf("%d %s", m.Amount, m.Currency)
+	}
+	return strconv.FormatFloat(float64(m.Amount)/math.Pow10(exp), 'f', exp, 64) + " " + m.Currency
+}
+
+// MoneyFromFloat converts a legacy float64 major-unit amount, rounding to
+// the nearest minor unit. It exists only to migrate old rows.
+func MoneyFromFloat(amount float64, currency string) Money {
+	exp, ok := currencyExponents[currency]
+	if !ok {
+		exp = 2
+	}
+	return Money{Amount: int64(math.Round(amount * math.Pow10(exp))), Currency: currency}
+}
+
+// storedMoney rebuilds a Money from its Cassandra columns. Rows written
+// before the minor-unit column existed have it null and are converted from
+// their legacy float64 value.
+func storedMoney(minor *int64, currency string, legacy float64) Money {
+	if currency == "" {
+		currency = LegacyCurrency
+	}
+	if minor == nil {
+		return MoneyFromFloat(legacy, currency)
+	}
+	return Money{Amount: *minor, Currency: currency}
+}
+
+// orderTotal sums price × quantity over items. All items must share one
+// currency, which becomes the order's currency.
+func orderTotal(items []OrderItem) (Money, error) {
+	if len(items) == 0 {
+		return Money{}, fmt.Errorf("%w: no items", ErrInvalidMoney)
+	}
+	total := Money{Currency: items[0].Price.Currency}
+	for _, item := range items {
+		line, err := item.Price.Times(item.Quantity)
+		if err != nil {
+			return Money{}, err
+		}
+		if total, err = total.Add(line); err != nil {
+			return Money{}, err
+		}
+	}
+	return total, nil
+}
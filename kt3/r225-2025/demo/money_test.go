@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestMoneyFromFloat(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		currency string
+		want     int64
+	}{
+		{49.99, "EUR", 4999},
+		{0.1 + 0.2, "EUR", 30}, // 0.30000000000000004
+		{1299.99, "EUR", 129999},
+		{19.995, "EUR", 2000},
+		{0.005, "EUR", 1},
+		{1000, "JPY", 1000},
+		{12.5, "JPY", 13},
+		{3.14, "XXX", 314}, // unknown currency: assume two digits
+		{0, "EUR", 0},
+	}
+	for _, tc := range tests {
+		got := MoneyFromFloat(tc.amount, tc.currency)
+		if got != (Money{Amount: tc.want, Currency: tc.currency}) {
+			t.Errorf("MoneyFromFloat(%v, %s) = %+v, want %d", tc.amount, tc.currency, got, tc.want)
+		}
+	}
+}
+
+func TestStoredMoney(t *testing.T) {
+	minor := int64(4999)
+	tests := []struct {
+		name     string
+		minor    *int64
+		currency string
+		legacy   float64
+		want     Money
+	}{
+		{"minor-unit column", &minor, "USD", 12.34, Money{Amount: 4999, Currency: "USD"}},
+		{"legacy row", nil, "", 49.99, Money{Amount: 4999, Currency: LegacyCurrency}},
+		{"legacy amount with currency", nil, "GBP", 0.07, Money{Amount: 7, Currency: "GBP"}},
+		{"minor-unit column without currency", &minor, "", 0, Money{Amount: 4999, Currency: LegacyCurrency}},
+	}
+	for _, tc := range tests {
+		if got := storedMoney(tc.minor, tc.currency, tc.legacy); got != tc.want {
+			t.Errorf("%s: storedMoney = %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBackfillTotal(t *testing.T) {
+	if got, ok := backfillTotal(1299.99, nil); !ok || got != (Money{Amount: 129999, Currency: LegacyCurrency}) {
+		t.Errorf("legacy row: backfillTotal = %+v, %v", got, ok)
+	}
+	converted := int64(129999)
+	if _, ok := backfillTotal(1299.99, &converted); ok {
+		t.Error("row with total_minor is converted again")
+	}
+}
+
+func TestParseLegacyItems(t *testing.T) {
+	items, err := parseLegacyItems(`[{"product_id":"p1","quantity":3,"price":0.1},{"product_id":"p2","quantity":1,"price":19.99}]`)
+	if err != nil {
+		t.Fatalf("parseLegacyItems: %v", err)
+	}
+	want := []OrderItem{
+		{ProductID: "p1", Quantity: 3, Price: Money{Amount: 10, Currency: "EUR"}},
+		{ProductID: "p2", Quantity: 1, Price: Money{Amount: 1999, Currency: "EUR"}},
+	}
+	if len(items) != len(want) {
+		t.Fatalf("got %d items, want %d", len(items), len(want))
+	}
+	for i := range want {
+		if items[i] != want[i] {
+			t.Errorf("item %d = %+v, want %+v", i, items[i], want[i])
+		}
+	}
+	// 3 × 0.10 is exactly 0.30 once the price is in minor units.
+	total, err := orderTotal(items[:1])
+	if err != nil || total.Amount != 30 {
+		t.Errorf("total of 3 × 0.10 = %+v, %v; want 30", total, err)
+	}
+
+	if _, err := parseLegacyItems(`[{"product_id":"a"b"}]`); err == nil {
+		t.Error("malformed legacy column parsed")
+	}
+}
+
+func TestOrderTotal(t *testing.T) {
+	eur := func(amount int64) Money { return Money{Amount: amount, Currency: "EUR"} }
+	tests := []struct {
+		name    string
+		items   []OrderItem
+		want    Money
+		wantErr error
+	}{
+		{"single line", []OrderItem{{Quantity: 2, Price: eur(4999)}}, eur(9998), nil},
+		{"cents add up exactly", []OrderItem{
+			{Quantity: 1, Price: eur(10)},
+			{Quantity: 1, Price: eur(20)},
+			{Quantity: 7, Price: eur(1999)},
+		}, eur(14023), nil},
+		{"no items", nil, Money{}, ErrInvalidMoney},
+		{"mixed currencies", []OrderItem{
+			{Quantity: 1, Price: eur(100)},
+			{Quantity: 1, Price: Money{Amount: 100, Currency: "USD"}},
+		}, Money{}, ErrCurrencyMismatch},
+		{"line overflow", []OrderItem{{Quantity: 2, Price: eur(math.MaxInt64/2 + 1)}}, Money{}, ErrInvalidMoney},
+		{"sum overflow", []OrderItem{
+			{Quantity: 1, Price: eur(math.MaxInt64 - 1)},
+			{Quantity: 1, Price: eur(2)},
+		}, Money{}, ErrInvalidMoney},
+		{"negative quantity", []OrderItem{{Quantity: -1, Price: eur(100)}}, Money{}, ErrInvalidMoney},
+	}
+	for _, tc := range tests {
+		got, err := orderTotal(tc.items)
+		if tc.wantErr != nil {
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("%s: err = %v, want %v", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%s: orderTotal = %+v, %v; want %+v", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestMoneyValidateAndString(t *testing.T) {
+	tests := []struct {
+		money   Money
+		valid   bool
+		printed string
+	}{
+		{Money{Amount: 1999, Currency: "EUR"}, true, "19.99 EUR"},
+		{Money{Amount: 5, Currency: "USD"}, true, "0.05 USD"},
+		{Money{Amount: 1500, Currency: "JPY"}, true, "1500 JPY"},
+		{Money{Amount: -1, Currency: "EUR"}, false, ""},
+		{Money{Amount: 100, Currency: "eur"}, false, ""},
+		{Money{Amount: 100}, false, ""},
+	}
+	for _, tc := range tests {
+		err := tc.money.Validate()
+		if tc.valid != (err == nil) {
+			t.Errorf("%+v: Validate() = %v, want valid=%v", tc.money, err, tc.valid)
+		}
+		if tc.valid && tc.money.String() != tc.printed {
+			t.Errorf("%+v: String() = %q, want %q", tc.money, tc.money.String(), tc.printed)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	data, err := json.Marshal(Money{Amount: 4999, Currency: "EUR"})
+	if err != nil || string(data) != `{"amount":4999,"currency":"EUR"}` {
+		t.Fatalf("Marshal = %s, %v", data, err)
+	}
+
+	var req CreateOrderRequest
+	body := `{"items":[{"product_id":"p1","quantity":1,"price":{"amount":4999,"currency":"EUR"}}]}`
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if req.Items[0].Price != (Money{Amount: 4999, Currency: "EUR"}) {
+		t.Errorf("price = %+v", req.Items[0].Price)
+	}
+
+	// A legacy float price is refused rather than silently truncated.
+	legacy := `{"items":[{"product_id":"p1","quantity":1,"price":49.99}]}`
+	if err := json.Unmarshal([]byte(legacy), &req); err == nil {
+		t.Error("float price accepted")
+	}
+}
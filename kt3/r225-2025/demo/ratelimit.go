@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimitRule allows Limit requests per identity in any trailing Window.
+// FailOpen lets requests through unlimited if the limiter itself fails;
+// otherwise they are answered 503. Rules that guard against floods and
+// guessing keep it off.
+type RateLimitRule struct {
+	Name     string
+	Limit    int
+	Window   time.Duration
+	FailOpen bool
+}
+
+// RateLimitPolicy is the single definition of the service's rate limits.
+// PerIP applies to every request before authentication, so floods with bad
+// or missing tokens are cut off early. Once the caller is known, Routes
+// limits it per route ("METHOD pattern", as in AccessPolicy), and PerCaller
+// applies to every route without its own rule.
+type RateLimitPolicy struct {
+	PerIP     RateLimitRule
+	PerCaller RateLimitRule
+	Routes    map[string]RateLimitRule
+}
+
+// DefaultRateLimits is the policy the service runs with.
+var DefaultRateLimits = &RateLimitPolicy{
+	PerIP:     RateLimitRule{Name: "ip", Limit: 300, Window: time.Minute},
+	PerCaller: RateLimitRule{Name: "caller", Limit: 120, Window: time.Minute, FailOpen: true},
+	Routes: map[string]RateLimitRule{
+		"POST /orders": {Name: "create-order", Limit: 10, Window: time.Minute, FailOpen: true},
+		// Order ids are UUIDs, but a tight per-caller limit on lookups keeps
+		// enumeration impractical even if ids leak in bulk.
+		"GET /orders/{orderID}":       {Name: "get-order", Limit: 60, Window: time.Minute},
+		"GET /shipments/{shipmentID}": {Name: "get-shipment", Limit: 60, Window: time.Minute},
+		"POST /orders/{orderID}/pay":  {Name: "pay-order", Limit: 10, Window: time.Minute, FailOpen: true},
+		// Carriers batch status updates, so their limit is generous but
+		// still bounded per carrier account.
+		"POST /webhooks/shipping":    {Name: "webhook", Limit: 600, Window: time.Minute},
+		"POST /webhooks/shipping/v2": {Name: "webhook", Limit: 600, Window: time.Minute},
+	},
+}
+
+// RateLimitResult is the outcome of one RateLimiter.Allow call. Reset is
+// how long until the oldest counted request leaves the window; for a denied
+// request it is also the earliest time a retry can succeed.
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	Reset     time.Duration
+}
+
+// RateLimiter counts requests in a sliding window. Denied requests are not
+// counted, so a client that backs off recovers as soon as the window moves.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, rule RateLimitRule) (RateLimitResult, error)
+}
+
+// slidingWindowScript evaluates and records one request atomically. The
+// sorted set holds one member per counted request, scored by its time in ms.
+// Redis' own clock is used so every service instance agrees on the window.
+var slidingWindowScript = redis.NewScript(`
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+local count = redis.call("ZCARD", KEYS[1])
+local allowed = 0
+if count < limit then
+    redis.call("ZADD", KEYS[1], now, ARGV[3])
+    redis.call("PEXPIRE", KEYS[1], window)
+    count = count + 1
+    allowed = 1
+end
+
+local reset = 0
+local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+if oldest[2] then
+    reset = tonumber(oldest[2]) + window - now
+end
+return {allowed, count, reset}
+`)
+
+type RedisRateLimiter struct {
+	rdb *redis.Client
+}
+
+func NewRedisRateLimiter(rdb *redis.Client) *RedisRateLimiter {
+	return &RedisRateLimiter{rdb: rdb}
+}
+
+func (l *RedisRateLimiter) Allow(ctx context.Context, key string, rule RateLimitRule) (RateLimitResult, error) {
+	res, err := slidingWindowScript.Run(ctx, l.rdb, []string{key},
+		rule.Window.Milliseconds(), rule.Limit, uuid.New().String()).Int64Slice()
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("redis rate limit: %w", err)
+	}
+	if len(res) != 3 {
+		return RateLimitResult{}, fmt.Errorf("redis rate limit: unexpected reply %v", res)
+	}
+	return RateLimitResult{
+		Allowed:   res[0] == 1,
+		Limit:     rule.Limit,
+		Remaining: max(rule.Limit-int(res[1]), 0),
+		Reset:     time.Duration(res[2]) * time.Millisecond,
+	}, nil
+}
+
+// FallbackRateLimiter asks primary and, whenever primary fails, fallback.
+// With Redis as primary and a MemoryRateLimiter as fallback a Redis outage
+// degrades the limits to per instance instead of switching them off.
+type FallbackRateLimiter struct {
+	primary  RateLimiter
+	fallback RateLimiter
+}
+
+func NewFallbackRateLimiter(primary, fallback RateLimiter) *FallbackRateLimiter {
+	return &FallbackRateLimiter{primary: primary, fallback: fallback}
+}
+
+func (l *FallbackRateLimiter) Allow(ctx context.Context, key string, rule RateLimitRule) (RateLimitResult, error) {
+	res, err := l.primary.Allow(ctx, key, rule)
+	if err == nil {
+		return res, nil
+	}
+	log.Printf("[ratelimit] %s: %v, using in-process limits", key, err)
+	return l.fallback.Allow(ctx, key, rule)
+}
+
+// MemoryRateLimiter is the in-process RateLimiter used with
+// RATELIMIT_BACKEND=memory and as the fallback of the Redis limiter. Limits
+// are per instance.
+type MemoryRateLimiter struct {
+	mu        sync.Mutex
+	hits      map[string][]time.Time
+	window    map[string]time.Duration
+	lastSweep time.Time
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		hits:      make(map[string][]time.Time),
+		window:    make(map[string]time.Duration),
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *MemoryRateLimiter) Allow(_ context.Context, key string, rule RateLimitRule) (RateLimitResult, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	hits := pruneHits(l.hits[key], now.Add(-rule.Window))
+	allowed := len(hits) < rule.Limit
+	if allowed {
+		hits = append(hits, now)
+	}
+	l.hits[key] = hits
+	l.window[key] = rule.Window
+
+	var reset time.Duration
+	if len(hits) > 0 {
+		reset = hits[0].Add(rule.Window).Sub(now)
+	}
+	return RateLimitResult{
+		Allowed:   allowed,
+		Limit:     rule.Limit,
+		Remaining: max(rule.Limit-len(hits), 0),
+		Reset:     reset,
+	}, nil
+}
+
+// sweep drops keys whose window has emptied, at most once a minute, so one-off
+// clients do not accumulate. Callers must hold l.mu.
+func (l *MemoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, hits := range l.hits {
+		if len(pruneHits(hits, now.Add(-l.window[key]))) == 0 {
+			delete(l.hits, key)
+			delete(l.window, key)
+		}
+	}
+}
+
+// pruneHits drops the timestamps at or before cutoff; hits are in order.
+func pruneHits(hits []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(hits) && !hits[i].After(cutoff) {
+		i++
+	}
+	return hits[i:]
+}
+
+// TrustedProxies are the networks of the reverse proxies in front of the
+// service. Forwarding headers are believed only on connections from them.
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies parses a comma-separated list of CIDRs or single
+// addresses, e.g. "10.0.0.0/8,192.168.1.10". An empty list trusts no one.
+func ParseTrustedProxies(list string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %q: %w", entry, err)
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", entry, err)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+func (t TrustedProxies) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range t {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that sent r. It starts from
+// the TCP peer and, only while that hop is a trusted proxy, steps back
+// through X-Forwarded-For from the right, since each proxy appends the
+// address it received the request from; entries further left were written
+// by the client and prove nothing. X-Real-IP is used when a trusted proxy
+// sends it without X-Forwarded-For.
+func (t TrustedProxies) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !t.contains(peer) {
+		return host
+	}
+
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) == 0 {
+		if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return realIP.Unmap().String()
+		}
+		return peer.Unmap().String()
+	}
+	hops := strings.Split(strings.Join(forwarded, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		peer = hop
+		if !t.contains(hop) {
+			break
+		}
+	}
+	return peer.Unmap().String()
+}
+
+// RealIP replaces RemoteAddr with proxies.ClientIP, so logging and
+// RateLimitByIP see the client instead of the proxy. Unlike chi's
+// middleware.RealIP it ignores forwarding headers from anyone else, who
+// could otherwise spread a flood over made-up addresses.
+func RealIP(proxies TrustedProxies) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.RemoteAddr = proxies.ClientIP(r)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RateLimitByIP limits every request by client address with policy.PerIP.
+// The address is RemoteAddr, so it must run after RealIP and never after
+// chi's middleware.RealIP, which trusts forwarding headers from anyone.
+func RateLimitByIP(limiter RateLimiter, policy *RateLimitPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			if enforceRateLimit(w, r, limiter, "ip:"+host, policy.PerIP) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// RateLimitByCaller limits authenticated requests per principal, with the
+// route's own rule or policy.PerCaller. It must run after Authenticate,
+// inside a chi group, so the route pattern is already known.
+func RateLimitByCaller(limiter RateLimiter, policy *RateLimitPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := PrincipalFromContext(r.Context())
+			if !ok {
+				writeUnauthorized(w, ErrTokenMissing)
+				return
+			}
+
+			rule, ok := policy.Routes[r.Method+" "+chi.RouteContext(r.Context()).RoutePattern()]
+			if !ok {
+				rule = policy.PerCaller
+			}
+			if enforceRateLimit(w, r, limiter, p.Role+":"+p.ID(), rule) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// enforceRateLimit counts the request against rule for identity, sets the
+// RateLimit-* headers and answers 429 when the limit is reached. It reports
+// whether the request may proceed. If the limiter itself fails the request
+// is let through when the rule fails open and answered 503 otherwise.
+func enforceRateLimit(w http.ResponseWriter, r *http.Request, limiter RateLimiter, identity string, rule RateLimitRule) bool {
+	key := "ratelimit:" + identity + ":" + rule.Name
+	res, err := limiter.Allow(r.Context(), key, rule)
+	if err != nil {
+		if rule.FailOpen {
+			log.Printf("[ratelimit] %s: limiter unavailable, allowing request: %v", key, err)
+			return true
+		}
+		log.Printf("[ratelimit] %s: limiter unavailable, rejecting request: %v", key, err)
+		w.Header().Set("Retry-After", "1")
+		writeJSON(w, http.StatusServiceUnavailable, ErrorResponse{Error: "rate limiter unavailable"})
+		return false
+	}
+
+	reset := strconv.Itoa(ceilSeconds(res.Reset))
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", reset)
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rule.Limit, ceilSeconds(rule.Window)))
+
+	if !res.Allowed {
+		log.Printf("[ratelimit] %s: limit %d per %v reached (%s %s)", key, rule.Limit, rule.Window, r.Method, r.URL.Path)
+		w.Header().Set("Retry-After", reset)
+		writeJSON(w, http.StatusTooManyRequests, ErrorResponse{Error: "rate limit exceeded, retry after " + reset + "s"})
+		return false
+	}
+	return true
+}
+
+// ceilSeconds rounds d up to whole seconds, with a minimum of 1, as header
+// values are in seconds and a client must never be told to retry too early.
+func ceilSeconds(d time.Duration) int {
+	return max(int(math.Ceil(d.Seconds())), 1)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.10")
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		want       string
+	}{
+		{"direct client", "203.0.113.7:5000", "", "", "203.0.113.7"},
+		{"direct client spoofs X-Forwarded-For", "203.0.113.7:5000", "198.51.100.1", "", "203.0.113.7"},
+		{"direct client spoofs X-Real-IP", "203.0.113.7:5000", "", "198.51.100.1", "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:5000", "203.0.113.7", "", "203.0.113.7"},
+		{"trusted proxy, client prepends a fake hop", "10.1.2.3:5000", "198.51.100.1, 203.0.113.7", "", "203.0.113.7"},
+		{"two trusted proxies", "10.1.2.3:5000", "203.0.113.7, 192.168.1.10", "", "203.0.113.7"},
+		{"trusted proxy with X-Real-IP", "192.168.1.10:5000", "", "203.0.113.7", "203.0.113.7"},
+		{"trusted proxy, garbage hop", "10.1.2.3:5000", "not-an-ip", "", "10.1.2.3"},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if tc.realIP != "" {
+			r.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if got := proxies.ClientIP(r); got != tc.want {
+			t.Errorf("%s: ClientIP = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+type failingRateLimiter struct{}
+
+func (failingRateLimiter) Allow(context.Context, string, RateLimitRule) (RateLimitResult, error) {
+	return RateLimitResult{}, errors.New("redis down")
+}
+
+func TestRateLimitFailOpen(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	for _, tc := range []struct {
+		failOpen bool
+		want     int
+	}{
+		{true, http.StatusNoContent},
+		{false, http.StatusServiceUnavailable},
+	} {
+		policy := *DefaultRateLimits
+		policy.PerIP.FailOpen = tc.failOpen
+		rec := httptest.NewRecorder()
+		RateLimitByIP(failingRateLimiter{}, &policy)(ok).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != tc.want {
+			t.Errorf("FailOpen=%v: status %d, want %d", tc.failOpen, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestDefaultRateLimitsFailClosed(t *testing.T) {
+	if DefaultRateLimits.PerIP.FailOpen {
+		t.Error("per-IP rule fails open")
+	}
+	for _, route := range []string{"POST /webhooks/shipping", "POST /webhooks/shipping/v2"} {
+		if DefaultRateLimits.Routes[route].FailOpen {
+			t.Errorf("%s fails open", route)
+		}
+	}
+}
+
+func TestFallbackRateLimiter(t *testing.T) {
+	rule := RateLimitRule{Name: "ip", Limit: 2, Window: time.Minute}
+	limiter := NewFallbackRateLimiter(failingRateLimiter{}, NewMemoryRateLimiter())
+	for i := 1; i <= 3; i++ {
+		res, err := limiter.Allow(context.Background(), "ratelimit:ip:203.0.113.7:ip", rule)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if want := i <= rule.Limit; res.Allowed != want {
+			t.Errorf("request %d: allowed=%v, want %v", i, res.Allowed, want)
+		}
+	}
+
+	// A 503 for the rules that fail closed is left for when the fallback
+	// fails too.
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	mw := RateLimitByIP(NewFallbackRateLimiter(failingRateLimiter{}, NewMemoryRateLimiter()), DefaultRateLimits)
+	rec := httptest.NewRecorder()
+	mw(ok).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusNoContent || rec.Header().Get("RateLimit-Limit") != "300" {
+		t.Errorf("with Redis down: status %d, RateLimit-Limit %q", rec.Code, rec.Header().Get("RateLimit-Limit"))
+	}
+}
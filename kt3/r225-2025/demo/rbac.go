@@ -0,0 +1,217 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Roles a principal can have. RoleSystem is never accepted from a token; it
+// is the identity background workers run their transitions under.
+const (
+	RoleCustomer    = "customer"
+	RoleSupport     = "support"
+	RoleFulfillment = "fulfillment"
+	RoleCarrier     = "carrier"
+	RolePayment     = "payment"
+	RoleAdmin       = "admin"
+	RoleSystem      = "system"
+)
+
+// TokenRoles are the roles a JWT may carry.
+var TokenRoles = []string{RoleCustomer, RoleSupport, RoleFulfillment, RoleCarrier, RolePayment, RoleAdmin}
+
+// SystemPrincipal is used for transitions no user asked for directly, such as
+// the refund worker completing a refund.
+var SystemPrincipal = &Principal{Subject: "system", Role: RoleSystem}
+
+// Permission names one action a role may be granted.
+type Permission string
+
+const (
+	PermCreateOrder    Permission = "order:create"
+	PermReadOrder      Permission = "order:read"
+	PermListOrders     Permission = "order:list"
+	PermDeliverWebhook Permission = "webhook:deliver"
+)
+
+// TransitionPermission is the permission to move an order into status.
+func TransitionPermission(status string) Permission {
+	return Permission("order:transition:" + status)
+}
+
+// RolePolicy is what one role may do. Without AnyOrder the role only acts on
+// orders placed by the principal's own customer_id.
+type RolePolicy struct {
+	Permissions []Permission
+	AnyOrder    bool
+}
+
+// AccessPolicy is the single definition of who may do what: the permissions
+// of every role and the permission every route requires. Routes are keyed by
+// "METHOD pattern" as registered with chi; a route missing from the table is
+// denied.
+type AccessPolicy struct {
+	Roles  map[string]RolePolicy
+	Routes map[string]Permission
+}
+
+// DefaultAccessPolicy is the policy the service runs with.
+var DefaultAccessPolicy = &AccessPolicy{
+	Roles: map[string]RolePolicy{
+		// Customers can start a payment but not complete one: only the
+		// payment provider confirms that the money arrived. Likewise they
+		// can ask for a return but not declare one: only the warehouse or
+		// the carrier confirm that the goods came back, which is what makes
+		// the order refundable.
+		RoleCustomer: {
+			Permissions: []Permission{
+				PermCreateOrder,
+				PermReadOrder,
+				TransitionPermission(StatusPendingPayment),
+				TransitionPermission(StatusCancelled),
+				TransitionPermission(StatusReturnRequested),
+				TransitionPermission(StatusRefundPending),
+			},
+		},
+		RoleSupport: {
+			Permissions: []Permission{
+				PermReadOrder,
+				PermListOrders,
+				TransitionPermission(StatusCancelled),
+				TransitionPermission(StatusReturnRequested),
+				TransitionPermission(StatusRefundPending),
+				TransitionPermission(StatusRefunded),
+			},
+			AnyOrder: true,
+		},
+		RoleFulfillment: {
+			Permissions: []Permission{
+				PermReadOrder,
+				TransitionPermission(StatusShipping),
+				TransitionPermission(StatusReturned),
+			},
+			AnyOrder: true,
+		},
+		// Carriers only reach orders through the webhooks; a lost or damaged
+		// parcel moves the order on to REFUND_PENDING in the same request.
+		RoleCarrier: {
+			Permissions: []Permission{
+				PermDeliverWebhook,
+				TransitionPermission(StatusDelivered),
+				TransitionPermission(StatusShipFailed),
+				TransitionPermission(StatusReturned),
+				TransitionPermission(StatusRefundPending),
+			},
+			AnyOrder: true,
+		},
+		// The payment provider's integration reports the outcome of a
+		// payment the customer started with checkout.
+		RolePayment: {
+			Permissions: []Permission{
+				TransitionPermission(StatusPaid),
+				TransitionPermission(StatusPaymentFailed),
+			},
+			AnyOrder: true,
+		},
+		RoleAdmin: {
+			Permissions: []Permission{
+				PermCreateOrder,
+				PermReadOrder,
+				PermListOrders,
+				TransitionPermission(StatusPendingPayment),
+				TransitionPermission(StatusPaid),
+				TransitionPermission(StatusPaymentFailed),
+				TransitionPermission(StatusCancelled),
+				TransitionPermission(StatusShipping),
+				TransitionPermission(StatusDelivered),
+				TransitionPermission(StatusShipFailed),
+				TransitionPermission(StatusReturnRequested),
+				TransitionPermission(StatusReturned),
+				TransitionPermission(StatusRefundPending),
+				TransitionPermission(StatusRefunded),
+			},
+			AnyOrder: true,
+		},
+		RoleSystem: {
+			Permissions: []Permission{
+				TransitionPermission(StatusRefunded),
+			},
+			AnyOrder: true,
+		},
+	},
+	Routes: map[string]Permission{
+		"POST /orders":                           PermCreateOrder,
+		"GET /orders/{orderID}":                  PermReadOrder,
+		"POST /orders/{orderID}/checkout":        TransitionPermission(StatusPendingPayment),
+		"POST /orders/{orderID}/pay":             TransitionPermission(StatusPaid),
+		"POST /orders/{orderID}/payment-failed":  TransitionPermission(StatusPaymentFailed),
+		"POST /orders/{orderID}/cancel":          TransitionPermission(StatusCancelled),
+		"POST /orders/{orderID}/ship":            TransitionPermission(StatusShipping),
+		"POST /orders/{orderID}/return-request":  TransitionPermission(StatusReturnRequested),
+		"POST /orders/{orderID}/return":          TransitionPermission(StatusReturned),
+		"POST /orders/{orderID}/refund":          TransitionPermission(StatusRefundPending),
+		"POST /orders/{orderID}/refund/complete": TransitionPermission(StatusRefunded),
+		"GET /orders/{orderID}/refund":           PermReadOrder,
+		"GET /orders/{orderID}/history":          PermReadOrder,
+		"GET /orders/{orderID}/snapshot":         PermReadOrder,
+		"GET /orders/{orderID}/shipments":        PermReadOrder,
+		"GET /orders/{orderID}/tracking":         PermReadOrder,
+		"GET /shipments/{shipmentID}":            PermReadOrder,
+		"GET /customers/{customerID}/orders":     PermReadOrder,
+		"GET /admin/orders":                      PermListOrders,
+		"POST /webhooks/shipping":                PermDeliverWebhook,
+		"POST /webhooks/shipping/v2":             PermDeliverWebhook,
+	},
+}
+
+// Allows reports whether role has perm. Unknown roles have no permissions.
+func (ap *AccessPolicy) Allows(role string, perm Permission) bool {
+	for _, granted := range ap.Roles[role].Permissions {
+		if granted == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// AnyOrder reports whether role acts on every customer's orders.
+func (ap *AccessPolicy) AnyOrder(role string) bool {
+	return ap.Roles[role].AnyOrder
+}
+
+// CanAccessOrder reports whether p may read or act on order.
+func (ap *AccessPolicy) CanAccessOrder(p *Principal, order *Order) bool {
+	return ap.AnyOrder(p.Role) || (p.CustomerID != "" && order.CustomerID == p.CustomerID)
+}
+
+// RoutePermission returns the permission a route requires.
+func (ap *AccessPolicy) RoutePermission(method, pattern string) (Permission, bool) {
+	perm, ok := ap.Routes[method+" "+pattern]
+	return perm, ok
+}
+
+// Authorize rejects requests whose principal lacks the permission the matched
+// route requires. It must run after Authenticate, inside a chi group, so the
+// route pattern is already known.
+func Authorize(policy *AccessPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := PrincipalFromContext(r.Context())
+			if !ok {
+				writeUnauthorized(w, ErrTokenMissing)
+				return
+			}
+
+			pattern := chi.RouteContext(r.Context()).RoutePattern()
+			perm, ok := policy.RoutePermission(r.Method, pattern)
+			if !ok || !policy.Allows(p.Role, perm) {
+				log.Printf("[auth] %s %q denied %s %s (needs %q)", p.Role, p.ID(), r.Method, pattern, perm)
+				writeJSON(w, http.StatusForbidden, ErrorResponse{Error: ErrForbidden.Error()})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
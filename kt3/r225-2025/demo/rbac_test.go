@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var allRoles = []string{RoleCustomer, RoleSupport, RoleFulfillment, RoleCarrier, RolePayment, RoleAdmin, RoleSystem}
+
+// TestDefaultAccessPolicyRoleActions is the role×action table: for every
+// route, and for transitions only reached from background work, the roles
+// that may perform it. Every role not listed must be denied.
+func TestDefaultAccessPolicyRoleActions(t *testing.T) {
+	const (
+		C = RoleCustomer
+		S = RoleSupport
+		F = RoleFulfillment
+		K = RoleCarrier
+		P = RolePayment
+		A = RoleAdmin
+		Y = RoleSystem
+	)
+	routes := []struct {
+		route   string
+		allowed []string
+	}{
+		{"POST /orders", []string{C, A}},
+		{"GET /orders/{orderID}", []string{C, S, F, A}},
+		{"POST /orders/{orderID}/checkout", []string{C, A}},
+		{"POST /orders/{orderID}/pay", []string{P, A}},
+		{"POST /orders/{orderID}/payment-failed", []string{P, A}},
+		{"POST /orders/{orderID}/cancel", []string{C, S, A}},
+		{"POST /orders/{orderID}/ship", []string{F, A}},
+		{"POST /orders/{orderID}/return-request", []string{C, S, A}},
+		{"POST /orders/{orderID}/return", []string{F, K, A}},
+		{"POST /orders/{orderID}/refund", []string{C, S, K, A}},
+		{"POST /orders/{orderID}/refund/complete", []string{S, A, Y}},
+		{"GET /orders/{orderID}/refund", []string{C, S, F, A}},
+		{"GET /orders/{orderID}/history", []string{C, S, F, A}},
+		{"GET /orders/{orderID}/snapshot", []string{C, S, F, A}},
+		{"GET /orders/{orderID}/shipments", []string{C, S, F, A}},
+		{"GET /orders/{orderID}/tracking", []string{C, S, F, A}},
+		{"GET /shipments/{shipmentID}", []string{C, S, F, A}},
+		{"GET /customers/{customerID}/orders", []string{C, S, F, A}},
+		{"GET /admin/orders", []string{S, A}},
+		{"POST /webhooks/shipping", []string{K}},
+		{"POST /webhooks/shipping/v2", []string{K}},
+	}
+	if len(routes) != len(DefaultAccessPolicy.Routes) {
+		t.Errorf("table covers %d routes, policy has %d", len(routes), len(DefaultAccessPolicy.Routes))
+	}
+	for _, tc := range routes {
+		perm, ok := DefaultAccessPolicy.Routes[tc.route]
+		if !ok {
+			t.Errorf("%s: route missing from DefaultAccessPolicy", tc.route)
+			continue
+		}
+		checkRoles(t, tc.route, perm, tc.allowed)
+	}
+
+	// Transitions the webhooks drive rather than a route of their own.
+	transitions := []struct {
+		status  string
+		allowed []string
+	}{
+		{StatusDelivered, []string{K, A}},
+		{StatusShipFailed, []string{K, A}},
+	}
+	for _, tc := range transitions {
+		checkRoles(t, "transition to "+tc.status, TransitionPermission(tc.status), tc.allowed)
+	}
+}
+
+func checkRoles(t *testing.T, action string, perm Permission, allowed []string) {
+	t.Helper()
+	for _, role := range allRoles {
+		want := false
+		for _, r := range allowed {
+			want = want || r == role
+		}
+		if got := DefaultAccessPolicy.Allows(role, perm); got != want {
+			t.Errorf("%s (%s): role %s allowed=%v, want %v", action, perm, role, got, want)
+		}
+	}
+}
+
+func TestAnyOrderRoles(t *testing.T) {
+	customer := &Principal{Subject: "c1", CustomerID: "c1", Role: RoleCustomer}
+	own := &Order{OrderID: "o1", CustomerID: "c1"}
+	foreign := &Order{OrderID: "o2", CustomerID: "c2"}
+
+	if !DefaultAccessPolicy.CanAccessOrder(customer, own) {
+		t.Error("customer cannot access own order")
+	}
+	if DefaultAccessPolicy.CanAccessOrder(customer, foreign) {
+		t.Error("customer can access another customer's order")
+	}
+	for _, role := range []string{RoleSupport, RoleFulfillment, RoleCarrier, RolePayment, RoleAdmin, RoleSystem} {
+		if !DefaultAccessPolicy.CanAccessOrder(&Principal{Subject: "x", Role: role}, foreign) {
+			t.Errorf("role %s cannot access every order", role)
+		}
+	}
+}
+
+func TestAuthorizeMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	r := chi.NewRouter()
+	r.Group(func(r chi.Router) {
+		r.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				p := &Principal{Subject: "u1", CustomerID: "u1", Role: req.Header.Get("X-Test-Role")}
+				next.ServeHTTP(w, req.WithContext(ContextWithPrincipal(req.Context(), p)))
+			})
+		})
+		r.Use(Authorize(DefaultAccessPolicy))
+		r.Post("/orders/{orderID}/ship", ok)
+		r.Post("/orders/{orderID}/return", ok)
+		r.Get("/not-in-policy", ok)
+	})
+
+	tests := []struct {
+		role, method, path string
+		want               int
+	}{
+		{RoleCustomer, http.MethodPost, "/orders/o1/ship", http.StatusForbidden},
+		{RoleFulfillment, http.MethodPost, "/orders/o1/ship", http.StatusNoContent},
+		{RoleCustomer, http.MethodPost, "/orders/o1/return", http.StatusForbidden},
+		{RoleCarrier, http.MethodPost, "/orders/o1/return", http.StatusNoContent},
+		{RoleAdmin, http.MethodGet, "/not-in-policy", http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.Header.Set("X-Test-Role", tc.role)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s %s %s: status %d, want %d", tc.role, tc.method, tc.path, rec.Code, tc.want)
+		}
+	}
+}
+
+// TestTransitionEnforcesPolicy checks the state machine itself, which every
+// route and the webhooks go through.
+func TestTransitionEnforcesPolicy(t *testing.T) {
+	env := newTestEnv(t)
+	customer := asPrincipal(&Principal{Subject: "c1", CustomerID: "c1", Role: RoleCustomer})
+	fulfillment := asPrincipal(&Principal{Subject: "wh1", Role: RoleFulfillment})
+
+	order := env.seedOrder(t, "c1", StatusDelivered)
+	err := env.sm.Transition(customer, order.OrderID, StatusReturned, "not sent back", nil)
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("customer DELIVERED → RETURNED: err = %v, want ErrForbidden", err)
+	}
+	if err := env.sm.Transition(customer, order.OrderID, StatusReturnRequested, "too small", nil); err != nil {
+		t.Fatalf("customer requests return: %v", err)
+	}
+	if err := env.sm.Transition(fulfillment, order.OrderID, StatusReturned, "received", nil); err != nil {
+		t.Fatalf("fulfillment confirms return: %v", err)
+	}
+	if got := env.status(t, order.OrderID); got != StatusReturned {
+		t.Fatalf("status = %s, want RETURNED", got)
+	}
+
+	// Customers start payment; only the payment provider completes it.
+	payment := asPrincipal(&Principal{Subject: "psp", Role: RolePayment})
+	unpaid := env.seedOrder(t, "c1", StatusCreated)
+	if err := env.sm.Transition(customer, unpaid.OrderID, StatusPendingPayment, "checkout", nil); err != nil {
+		t.Fatalf("customer checks out: %v", err)
+	}
+	err = env.sm.Transition(customer, unpaid.OrderID, StatusPaid, "paid", TransitionInputs{"payment_id": "pay_1"})
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("customer PENDING_PAYMENT → PAID: err = %v, want ErrForbidden", err)
+	}
+	if err := env.sm.Transition(payment, unpaid.OrderID, StatusPaid, "paid", TransitionInputs{"payment_id": "pay_1"}); err != nil {
+		t.Fatalf("payment provider confirms payment: %v", err)
+	}
+
+	foreign := env.seedOrder(t, "c2", StatusCreated)
+	err = env.sm.Transition(customer, foreign.OrderID, StatusCancelled, "not mine", nil)
+	if !errors.Is(err, ErrOrderNotFound) {
+		t.Fatalf("customer cancels another customer's order: err = %v, want ErrOrderNotFound", err)
+	}
+}
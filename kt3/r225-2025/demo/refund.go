@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// RefundStore persists refund records. Refunds are keyed by order so that an
+// order can never be refunded twice; UpdateRefund is a compare-and-set so two
+// workers cannot both claim or finish the same refund.
+type RefundStore interface {
+	// CreateRefund stores a new refund, or returns ErrRefundExists if the
+	// order already has one.
+	CreateRefund(ctx context.Context, refund *Refund) error
+	GetRefund(ctx context.Context, orderID string) (*Refund, error)
+	// ListRefunds returns the refunds currently in the given status.
+	ListRefunds(ctx context.Context, status string) ([]*Refund, error)
+	// UpdateRefund replaces expected with updated if the stored record still
+	// has expected's status and updated_at, and reports whether it did.
+	UpdateRefund(ctx context.Context, expected, updated *Refund) (bool, error)
+}
+
+type CassandraRefundStore struct {
+	session *gocql.Session
+}
+
+func NewCassandraRefundStore(session *gocql.Session) *CassandraRefundStore {
+	return &CassandraRefundStore{session: session}
+}
+
+// InitSchema creates the refunds table. The keyspace is created by
+// CassandraOrderStore.InitSchema, which must run first.
+func (s *CassandraRefundStore) InitSchema() error {
+	err := s.session.Query(`
+		CREATE TABLE IF NOT EXISTS ordering.refunds (
+			order_id     TEXT PRIMARY KEY,
+			refund_id    TEXT,
+			payment_id   TEXT,
+			amount       DOUBLE,
+			amount_minor BIGINT,
+			currency     TEXT,
+			reason       TEXT,
+			status       TEXT,
+			provider_ref TEXT,
+			attempts     INT,
+			last_error   TEXT,
+			created_at   TIMESTAMP,
+			updated_at   TIMESTAMP
+		)
+	`).Exec()
+	if err != nil {
+		return fmt.Errorf("create refunds table: %w", err)
+	}
+
+	// Refunds written before amounts moved to minor units only have the
+	// DOUBLE amount column; they are converted on read.
+	if err := addColumnIfMissing(s.session, "ordering", "refunds", "amount_minor", "BIGINT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(s.session, "ordering", "refunds", "currency", "TEXT"); err != nil {
+		return err
+	}
+
+	// The worker polls by status. Only a handful of refunds are open at any
+	// time, so a secondary index is good enough here.
+	err = s.session.Query(`
+		CREATE INDEX IF NOT EXISTS refunds_status_idx ON ordering.refunds (status)
+	`).Exec()
+	if err != nil {
+		return fmt.Errorf("create refunds status index: %w", err)
+	}
+	return nil
+}
+
+func (s *CassandraRefundStore) CreateRefund(_ context.Context, refund *Refund) error {
+	applied, err := s.session.Query(`
+		INSERT INTO ordering.refunds
+			(order_id, refund_id, payment_id, amount_minor, currency, reason, status, attempts, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		IF NOT EXISTS
+	`, refund.OrderID, refund.RefundID, refund.PaymentID, refund.Amount.Amount, refund.Amount.Currency, refund.Reason,
+		refund.Status, refund.Attempts, refund.CreatedAt, refund.UpdatedAt).MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		return fmt.Errorf("insert refund: %w", err)
+	}
+	if !applied {
+		return ErrRefundExists
+	}
+	return nil
+}
+
+const refundColumns = `order_id, refund_id, payment_id, amount, amount_minor, currency, reason, status, provider_ref, attempts, last_error, created_at, updated_at`
+
+func scanRefund(scan func(dest ...interface{}) error) (*Refund, error) {
+	var r Refund
+	var legacyAmount float64
+	var amountMinor *int64
+	var currency string
+	err := scan(&r.OrderID, &r.RefundID, &r.PaymentID, &legacyAmount, &amountMinor, &currency, &r.Reason, &r.Status,
+		&r.ProviderRef, &r.Attempts, &r.LastError, &r.CreatedAt, &r.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	r.Amount = storedMoney(amountMinor, currency, legacyAmount)
+	return &r, nil
+}
+
+func (s *CassandraRefundStore) GetRefund(_ context.Context, orderID string) (*Refund, error) {
+	refund, err := scanRefund(s.session.Query(
+		`SELECT `+refundColumns+` FROM ordering.refunds WHERE order_id = ?`, orderID).Scan)
+	if err != nil {
+		if err == gocql.ErrNotFound {
+			return nil, ErrRefundNotFound
+		}
+		return nil, fmt.Errorf("get refund: %w", err)
+	}
+	return refund, nil
+}
+
+func (s *CassandraRefundStore) ListRefunds(_ context.Context, status string) ([]*Refund, error) {
+	iter := s.session.Query(
+		`SELECT `+refundColumns+` FROM ordering.refunds WHERE status = ?`, status).Iter()
+
+	var refunds []*Refund
+	scanner := iter.Scanner()
+	for scanner.Next() {
+		refund, err := scanRefund(scanner.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("scan refund: %w", err)
+		}
+		refunds = append(refunds, refund)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("list refunds: %w", err)
+	}
+	return refunds, nil
+}
+
+func (s *CassandraRefundStore) UpdateRefund(_ context.Context, expected, updated *Refund) (bool, error) {
+	applied, err := s.session.Query(`
+		UPDATE ordering.refunds
+		SET status = ?, provider_ref = ?, attempts = ?, last_error = ?, updated_at = ?
+		WHERE order_id = ?
+		IF status = ? AND updated_at = ?
+	`, updated.Status, updated.ProviderRef, updated.Attempts, updated.LastError, updated.UpdatedAt,
+		expected.OrderID, expected.Status, expected.UpdatedAt).MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		return false, fmt.Errorf("update refund: %w", err)
+	}
+	if !applied {
+		log.Printf("[store] Refund %s: CAS rejected (expected status=%s)", expected.RefundID, expected.Status)
+	}
+	return applied, nil
+}
+
+// MemoryRefundStore is the process-local RefundStore used with
+// STORE_BACKEND=memory.
+type MemoryRefundStore struct {
+	mu      sync.Mutex
+	refunds map[string]*Refund
+}
+
+func NewMemoryRefundStore() *MemoryRefundStore {
+	return &MemoryRefundStore{refunds: make(map[string]*Refund)}
+}
+
+func (s *MemoryRefundStore) CreateRefund(_ context.Context, refund *Refund) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.refunds[refund.OrderID]; ok {
+		return ErrRefundExists
+	}
+	stored := *refund
+	s.refunds[refund.OrderID] = &stored
+	return nil
+}
+
+func (s *MemoryRefundStore) GetRefund(_ context.Context, orderID string) (*Refund, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refund, ok := s.refunds[orderID]
+	if !ok {
+		return nil, ErrRefundNotFound
+	}
+	out := *refund
+	return &out, nil
+}
+
+func (s *MemoryRefundStore) ListRefunds(_ context.Context, status string) ([]*Refund, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var refunds []*Refund
+	for _, refund := range s.refunds {
+		if refund.Status == status {
+			out := *refund
+			refunds = append(refunds, &out)
+		}
+	}
+	return refunds, nil
+}
+
+func (s *MemoryRefundStore) UpdateRefund(_ context.Context, expected, updated *Refund) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.refunds[expected.OrderID]
+	if !ok || stored.Status != expected.Status || !stored.UpdatedAt.Equal(expected.UpdatedAt) {
+		return false, nil
+	}
+	stored.Status = updated.Status
+	stored.ProviderRef = updated.ProviderRef
+	stored.Attempts = updated.Attempts
+	stored.LastError = updated.LastError
+	stored.UpdatedAt = updated.UpdatedAt
+	return true, nil
+}
+
+// refundTimestamp returns now at the millisecond precision Cassandra stores,
+// so a read-back updated_at compares equal in UpdateRefund.
+func refundTimestamp() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RefundRequest is what the payment provider needs to return money.
+// IdempotencyKey is the refund_id: a provider must return the original
+// result when the same key is sent again, which is what makes worker
+// retries safe.
+type RefundRequest struct {
+	IdempotencyKey string
+	OrderID        string
+	PaymentID      string
+	Amount         Money
+}
+
+// RefundProvider is the payment-provider adapter. It returns the provider's
+// reference for the refund.
+type RefundProvider interface {
+	Refund(ctx context.Context, req RefundRequest) (string, error)
+}
+
+// FakeRefundProvider approves every refund locally. It honours idempotency
+// keys like a real provider would.
+type FakeRefundProvider struct {
+	mu     sync.Mutex
+	issued map[string]string
+}
+
+func NewFakeRefundProvider() *FakeRefundProvider {
+	return &FakeRefundProvider{issued: make(map[string]string)}
+}
+
+func (p *FakeRefundProvider) Refund(_ context.Context, req RefundRequest) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ref, ok := p.issued[req.IdempotencyKey]; ok {
+		return ref, nil
+	}
+	ref := "fake_re_" + uuid.New().String()[:8]
+	p.issued[req.IdempotencyKey] = ref
+	log.Printf("[refund] fake provider: refunded %s for payment %s (order %s, ref=%s)",
+		req.Amount, req.PaymentID, req.OrderID, ref)
+	return ref, nil
+}
+
+// requestRefund is the request_refund lifecycle preparation: it records a
+// PENDING refund for the order's full total before the order moves to
+// REFUND_PENDING. A second request for the same order reuses the first
+// refund, so re-entering REFUND_PENDING, or retrying a transition whose
+// status write failed, never refunds twice.
+func requestRefund(ctx context.Context, refunds RefundStore, order *Order) error {
+	if refunds == nil {
+		return errors.New("no refund store configured")
+	}
+
+	now := refundTimestamp()
+	err := refunds.CreateRefund(ctx, &Refund{
+		RefundID:  uuid.New().String(),
+		OrderID:   order.OrderID,
+		PaymentID: order.PaymentID,
+		Amount:    order.Total,
+		Reason:    order.Reason,
+		Status:    RefundStatusPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+	if errors.Is(err, ErrRefundExists) {
+		return requeueRefund(ctx, refunds, order.OrderID)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("[refund] Order %s: refund of %s queued", order.OrderID, order.Total)
+	return nil
+}
+
+// requeueRefund handles a refund request for an order that already has a
+// refund. A PENDING or ABANDONED refund is queued again with a fresh
+// updated_at; the compare-and-set makes this win over a worker abandoning it
+// at the same moment, as the order is about to reach REFUND_PENDING. A
+// refund that is being paid out or is settled is left alone.
+func requeueRefund(ctx context.Context, refunds RefundStore, orderID string) error {
+	existing, err := refunds.GetRefund(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	if existing.Status != RefundStatusPending && existing.Status != RefundStatusAbandoned {
+		log.Printf("[refund] Order %s: refund already %s, not creating another", orderID, existing.Status)
+		return nil
+	}
+
+	queued := *existing
+	queued.Status = RefundStatusPending
+	queued.LastError = ""
+	queued.UpdatedAt = refundTimestamp()
+	if !queued.UpdatedAt.After(existing.UpdatedAt) {
+		// Within the same millisecond a worker's compare-and-set would
+		// still match.
+		queued.UpdatedAt = existing.UpdatedAt.Add(time.Millisecond)
+	}
+	ok, err := refunds.UpdateRefund(ctx, existing, &queued)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: refund of order %s changed concurrently", ErrTransitionConflict, orderID)
+	}
+	log.Printf("[refund] Order %s: existing refund %s queued again (was %s)", orderID, existing.RefundID, existing.Status)
+	return nil
+}
+
+// RefundWorker executes queued refunds in the background. A refund is
+// claimed with a compare-and-set before the provider is called, so only one
+// worker handles it at a time; a claim older than claimTimeout is taken
+// over, on the assumption that its worker died. A PENDING refund whose order
+// is still not in REFUND_PENDING after abandonAfter is marked ABANDONED: the
+// transition that recorded it failed, and nothing is owed.
+type RefundWorker struct {
+	refunds      RefundStore
+	provider     RefundProvider
+	sm           *StateMachine
+	interval     time.Duration
+	claimTimeout time.Duration
+	abandonAfter time.Duration
+	maxAttempts  int
+}
+
+func NewRefundWorker(refunds RefundStore, provider RefundProvider, sm *StateMachine, interval time.Duration) *RefundWorker {
+	return &RefundWorker{
+		refunds:      refunds,
+		provider:     provider,
+		sm:           sm,
+		interval:     interval,
+		claimTimeout: time.Minute,
+		abandonAfter: time.Minute,
+		maxAttempts:  5,
+	}
+}
+
+// Run polls for work until ctx is cancelled. Its transitions run as
+// SystemPrincipal.
+func (w *RefundWorker) Run(ctx context.Context) {
+	ctx = ContextWithPrincipal(ctx, SystemPrincipal)
+	log.Printf("[refund] Worker started (interval=%v, maxAttempts=%d)", w.interval, w.maxAttempts)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		w.poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *RefundWorker) poll(ctx context.Context) {
+	pending, err := w.refunds.ListRefunds(ctx, RefundStatusPending)
+	if err != nil {
+		log.Printf("[refund] list pending refunds: %v", err)
+		return
+	}
+	processing, err := w.refunds.ListRefunds(ctx, RefundStatusProcessing)
+	if err != nil {
+		log.Printf("[refund] list processing refunds: %v", err)
+		return
+	}
+	for _, refund := range processing {
+		if time.Since(refund.UpdatedAt) > w.claimTimeout {
+			log.Printf("[refund] Refund %s: claim expired, retrying", refund.RefundID)
+			pending = append(pending, refund)
+		}
+	}
+
+	for _, refund := range pending {
+		w.execute(ctx, refund)
+	}
+}
+
+func (w *RefundWorker) execute(ctx context.Context, refund *Refund) {
+	// The record is written just before its order moves to REFUND_PENDING;
+	// until that transition commits there is nothing to pay out yet, and if
+	// it never does the refund is abandoned. An order already REFUNDED is
+	// let through so a refund whose outcome was not recorded can finish.
+	order, err := w.sm.store.GetOrder(ctx, refund.OrderID)
+	if err != nil {
+		log.Printf("[refund] Refund %s: cannot read order %s: %v", refund.RefundID, refund.OrderID, err)
+		return
+	}
+	if order.Status != StatusRefundPending && order.Status != StatusRefunded {
+		if refund.Status == RefundStatusPending && time.Since(refund.UpdatedAt) > w.abandonAfter {
+			w.abandon(ctx, refund, order.Status)
+		}
+		return
+	}
+
+	claimed := *refund
+	claimed.Status = RefundStatusProcessing
+	claimed.Attempts++
+	claimed.UpdatedAt = refundTimestamp()
+
+	ok, err := w.refunds.UpdateRefund(ctx, refund, &claimed)
+	if err != nil {
+		log.Printf("[refund] Refund %s: claim failed: %v", refund.RefundID, err)
+		return
+	}
+	if !ok {
+		return // another worker got there first
+	}
+
+	done := claimed
+	done.UpdatedAt = refundTimestamp()
+
+	ref, err := w.provider.Refund(ctx, RefundRequest{
+		IdempotencyKey: refund.RefundID,
+		OrderID:        refund.OrderID,
+		PaymentID:      refund.PaymentID,
+		Amount:         refund.Amount,
+	})
+	if err != nil {
+		done.LastError = fmt.Sprintf("provider: %v", err)
+		done.Status = RefundStatusPending
+		if done.Attempts >= w.maxAttempts {
+			done.Status = RefundStatusFailed
+		}
+		log.Printf("[refund] Refund %s (order %s): attempt %d failed: %v → %s",
+			refund.RefundID, refund.OrderID, done.Attempts, err, done.Status)
+		w.finish(ctx, &claimed, &done)
+		return
+	}
+	done.ProviderRef = ref
+
+	// The money has moved. If the order cannot be marked REFUNDED now the
+	// refund goes back to PENDING; the provider returns the same ref for the
+	// same idempotency key, so the retry only repeats the transition.
+	err = w.sm.Transition(ctx, refund.OrderID, StatusRefunded, "refund completed: "+ref,
+		TransitionInputs{"refund_ref": ref})
+	if err != nil && !w.alreadyRefunded(ctx, refund.OrderID) {
+		done.LastError = fmt.Sprintf("order transition: %v", err)
+		done.Status = RefundStatusPending
+		log.Printf("[refund] Refund %s (order %s): provider ref %s, but order update failed: %v",
+			refund.RefundID, refund.OrderID, ref, err)
+		w.finish(ctx, &claimed, &done)
+		return
+	}
+
+	done.Status = RefundStatusSucceeded
+	done.LastError = ""
+	log.Printf("[refund] Refund %s (order %s): SUCCEEDED (ref=%s, attempts=%d)",
+		refund.RefundID, refund.OrderID, ref, done.Attempts)
+	w.finish(ctx, &claimed, &done)
+}
+
+// abandon marks a PENDING refund ABANDONED, noting its order's status. The
+// compare-and-set fails if requeueRefund claimed the refund meanwhile.
+func (w *RefundWorker) abandon(ctx context.Context, refund *Refund, status string) {
+	abandoned := *refund
+	abandoned.Status = RefundStatusAbandoned
+	abandoned.LastError = fmt.Sprintf("order is %s, never reached %s", status, StatusRefundPending)
+	abandoned.UpdatedAt = refundTimestamp()
+
+	ok, err := w.refunds.UpdateRefund(ctx, refund, &abandoned)
+	if err != nil {
+		log.Printf("[refund] Refund %s: could not abandon: %v", refund.RefundID, err)
+		return
+	}
+	if ok {
+		log.Printf("[refund] Refund %s (order %s): ABANDONED, order is %s", refund.RefundID, refund.OrderID, status)
+	}
+}
+
+func (w *RefundWorker) alreadyRefunded(ctx context.Context, orderID string) bool {
+	order, err := w.sm.store.GetOrder(ctx, orderID)
+	return err == nil && order.Status == StatusRefunded
+}
+
+func (w *RefundWorker) finish(ctx context.Context, claimed, done *Refund) {
+	ok, err := w.refunds.UpdateRefund(ctx, claimed, done)
+	if err != nil {
+		log.Printf("[refund] Refund %s: could not record outcome %s: %v", done.RefundID, done.Status, err)
+	} else if !ok {
+		log.Printf("[refund] Refund %s: claim was taken over, outcome %s not recorded", done.RefundID, done.Status)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingRefundProvider records every payout it is asked for. Unlike
+// FakeRefundProvider it does not deduplicate, so a second call for the same
+// refund shows up as a second payout.
+type countingRefundProvider struct {
+	mu       sync.Mutex
+	requests []RefundRequest
+	delay    time.Duration
+}
+
+func (p *countingRefundProvider) Refund(_ context.Context, req RefundRequest) (string, error) {
+	time.Sleep(p.delay)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests = append(p.requests, req)
+	return "re_test", nil
+}
+
+func (p *countingRefundProvider) payouts() []RefundRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]RefundRequest(nil), p.requests...)
+}
+
+func (env *testEnv) refund(t *testing.T, orderID string) *Refund {
+	t.Helper()
+	refund, err := env.refunds.GetRefund(context.Background(), orderID)
+	if err != nil {
+		t.Fatalf("GetRefund: %v", err)
+	}
+	return refund
+}
+
+func TestRefundWorkersPayOutOnce(t *testing.T) {
+	env := newTestEnv(t)
+	order := env.seedOrder(t, "c1", StatusShipFailed)
+	ctx := asPrincipal(SystemPrincipal)
+	admin := asPrincipal(&Principal{Subject: "admin", Role: RoleAdmin})
+	if err := env.sm.Transition(admin, order.OrderID, StatusRefundPending, "shipment lost", nil); err != nil {
+		t.Fatalf("request refund: %v", err)
+	}
+	refundID := env.refund(t, order.OrderID).RefundID
+
+	provider := &countingRefundProvider{delay: 20 * time.Millisecond}
+	workers := []*RefundWorker{
+		NewRefundWorker(env.refunds, provider, env.sm, time.Second),
+		NewRefundWorker(env.refunds, provider, env.sm, time.Second),
+	}
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *RefundWorker) {
+			defer wg.Done()
+			<-start
+			for i := 0; i < 3; i++ {
+				w.poll(ctx)
+			}
+		}(w)
+	}
+	close(start)
+	wg.Wait()
+
+	payouts := provider.payouts()
+	if len(payouts) != 1 {
+		t.Fatalf("provider paid out %d times, want 1", len(payouts))
+	}
+	if payouts[0].IdempotencyKey != refundID {
+		t.Errorf("idempotency key %q, want the refund_id %q", payouts[0].IdempotencyKey, refundID)
+	}
+	if payouts[0].Amount != order.Total || payouts[0].PaymentID != "pay_test" {
+		t.Errorf("payout %+v, want %s for pay_test", payouts[0], order.Total)
+	}
+	if refund := env.refund(t, order.OrderID); refund.Status != RefundStatusSucceeded || refund.Attempts != 1 {
+		t.Errorf("refund is %s after %d attempts, want SUCCEEDED after 1", refund.Status, refund.Attempts)
+	}
+	if got := env.status(t, order.OrderID); got != StatusRefunded {
+		t.Errorf("order status %s, want REFUNDED", got)
+	}
+}
+
+func TestRefundWorkerAbandonsRefundOfUnrefundedOrder(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := asPrincipal(SystemPrincipal)
+	order := env.seedOrder(t, "c1", StatusShipFailed)
+
+	// The transition recorded its refund, then failed to write the status.
+	if err := requestRefund(ctx, env.refunds, order); err != nil {
+		t.Fatalf("requestRefund: %v", err)
+	}
+	provider := &countingRefundProvider{}
+	worker := NewRefundWorker(env.refunds, provider, env.sm, time.Second)
+
+	worker.poll(ctx)
+	if refund := env.refund(t, order.OrderID); refund.Status != RefundStatusPending {
+		t.Fatalf("fresh refund is %s, want PENDING while its transition may still commit", refund.Status)
+	}
+
+	worker.abandonAfter = 0
+	worker.poll(ctx)
+	refund := env.refund(t, order.OrderID)
+	if refund.Status != RefundStatusAbandoned {
+		t.Fatalf("refund is %s, want ABANDONED", refund.Status)
+	}
+	worker.poll(ctx)
+	if n := len(provider.payouts()); n != 0 {
+		t.Fatalf("abandoned refund paid out %d times", n)
+	}
+
+	// The order reaches REFUND_PENDING after all: the same refund is paid.
+	admin := asPrincipal(&Principal{Subject: "admin", Role: RoleAdmin})
+	if err := env.sm.Transition(admin, order.OrderID, StatusRefundPending, "retry", nil); err != nil {
+		t.Fatalf("request refund again: %v", err)
+	}
+	if requeued := env.refund(t, order.OrderID); requeued.Status != RefundStatusPending || requeued.RefundID != refund.RefundID {
+		t.Fatalf("after the retry: refund %s is %s, want %s PENDING", requeued.RefundID, requeued.Status, refund.RefundID)
+	}
+	worker.poll(ctx)
+	if payouts := provider.payouts(); len(payouts) != 1 || payouts[0].IdempotencyKey != refund.RefundID {
+		t.Errorf("payouts %+v, want one for %s", payouts, refund.RefundID)
+	}
+	if got := env.status(t, order.OrderID); got != StatusRefunded {
+		t.Errorf("order status %s, want REFUNDED", got)
+	}
+}
+
+func TestRequeueRefundLeavesSettledRefunds(t *testing.T) {
+	env := newTestEnv(t)
+	order := env.seedOrder(t, "c1", StatusRefundPending)
+	ctx := context.Background()
+	if err := requestRefund(ctx, env.refunds, order); err != nil {
+		t.Fatalf("requestRefund: %v", err)
+	}
+	pending := env.refund(t, order.OrderID)
+	succeeded := *pending
+	succeeded.Status = RefundStatusSucceeded
+	succeeded.UpdatedAt = pending.UpdatedAt.Add(time.Millisecond)
+	if ok, err := env.refunds.UpdateRefund(ctx, pending, &succeeded); !ok || err != nil {
+		t.Fatalf("UpdateRefund: ok=%v err=%v", ok, err)
+	}
+
+	if err := requestRefund(ctx, env.refunds, order); err != nil {
+		t.Fatalf("second requestRefund: %v", err)
+	}
+	if refund := env.refund(t, order.OrderID); refund.Status != RefundStatusSucceeded {
+		t.Errorf("settled refund is %s, want SUCCEEDED", refund.Status)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+var createTableRE = regexp.MustCompile(`CREATE TABLE IF NOT EXISTS ordering\.(\w+)`)
+
+// TestSchemaCreatesTablesBeforeAltering reads every InitSchema in source
+// order and checks that each addColumnIfMissing names a table the same
+// function has already created. On a fresh keyspace an ALTER before the
+// CREATE fails and the service cannot start.
+func TestSchemaCreatesTablesBeforeAltering(t *testing.T) {
+	fset := token.NewFileSet()
+	for _, file := range []string{"store.go", "refund.go", "shipment.go"} {
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatalf("parse %s: %v", file, err)
+		}
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Name.Name != "InitSchema" {
+				continue
+			}
+			checkSchemaOrder(t, fset, fn)
+		}
+	}
+}
+
+func checkSchemaOrder(t *testing.T, fset *token.FileSet, fn *ast.FuncDecl) {
+	t.Helper()
+	created := make(map[string]bool)
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.BasicLit:
+			if n.Kind == token.STRING {
+				for _, m := range createTableRE.FindAllStringSubmatch(n.Value, -1) {
+					created[m[1]] = true
+				}
+			}
+		case *ast.CallExpr:
+			ident, ok := n.Fun.(*ast.Ident)
+			if !ok || ident.Name != "addColumnIfMissing" {
+				return true
+			}
+			lit, ok := n.Args[2].(*ast.BasicLit)
+			if !ok {
+				t.Errorf("%s: addColumnIfMissing table must be a string literal", fset.Position(n.Pos()))
+				return true
+			}
+			table, _ := strconv.Unquote(lit.Value)
+			if !created[table] {
+				t.Errorf("%s: ordering.%s is altered before it is created", fset.Position(n.Pos()), table)
+			}
+		}
+		return true
+	})
+}
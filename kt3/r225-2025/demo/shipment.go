@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// ShipmentStore keeps the latest state of every shipment, readable by id and
+// by order. The shipments table doubles as the shipment → order index that
+// webhook events are resolved through.
+type ShipmentStore interface {
+	// RegisterShipment binds a new shipment to its order and reports whether
+	// this call created it. Registering the same pair again is a no-op; a
+	// shipment already bound to another order returns ErrShipmentOrderMismatch.
+	RegisterShipment(ctx context.Context, shipment *Shipment) (bool, error)
+	// UnregisterShipment removes a shipment RegisterShipment created for an
+	// order that then did not ship. A shipment a carrier has already
+	// reported on is kept.
+	UnregisterShipment(ctx context.Context, shipmentID, orderID string) error
+	// UpsertShipment creates or updates a shipment. Empty optional fields
+	// (carrier, tracking number, estimated delivery) leave stored values
+	// untouched, since carriers do not repeat them on every event.
+	UpsertShipment(ctx context.Context, shipment *Shipment) error
+	GetShipment(ctx context.Context, shipmentID string) (*Shipment, error)
+	ListShipmentsByOrder(ctx context.Context, orderID string) ([]*Shipment, error)
+	// AddTrackingEvent appends a carrier event to the shipment's timeline.
+	// Events are keyed by event_id, so storing a redelivered event again is
+	// harmless.
+	AddTrackingEvent(ctx context.Context, event *TrackingEvent) error
+	// ListTrackingEvents returns the shipment's timeline, oldest first.
+	ListTrackingEvents(ctx context.Context, shipmentID string) ([]TrackingEvent, error)
+	// AdvanceShipment moves the shipment's last applied event position from
+	// expected to next, and reports false if another event moved it first.
+	// A zero next clears the position.
+	AdvanceShipment(ctx context.Context, shipmentID string, expected, next EventPosition) (bool, error)
+}
+
+type CassandraShipmentStore struct {
+	session *gocql.Session
+}
+
+func NewCassandraShipmentStore(session *gocql.Session) *CassandraShipmentStore {
+	return &CassandraShipmentStore{session: session}
+}
+
+// InitSchema creates the shipments tables. shipments_by_order duplicates
+// every column so an order's shipments are read from a single partition.
+func (s *CassandraShipmentStore) InitSchema() error {
+	err := s.session.Query(`
+		CREATE TABLE IF NOT EXISTS ordering.shipments (
+			shipment_id        TEXT PRIMARY KEY,
+			order_id           TEXT,
+			carrier            TEXT,
+			tracking_number    TEXT,
+			status             TEXT,
+			estimated_delivery TIMESTAMP,
+			updated_at         TIMESTAMP,
+			last_event_at      TIMESTAMP,
+			last_event_seq     BIGINT
+		)
+	`).Exec()
+	if err != nil {
+		return fmt.Errorf("create shipments table: %w", err)
+	}
+
+	// Added for out-of-order event handling; older rows start with null,
+	// meaning no event has been applied yet.
+	err = addColumnIfMissing(s.session, "ordering", "shipments", "last_event_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = addColumnIfMissing(s.session, "ordering", "shipments", "last_event_seq", "BIGINT")
+	if err != nil {
+		return err
+	}
+
+	err = s.session.Query(`
+		CREATE TABLE IF NOT EXISTS ordering.shipments_by_order (
+			order_id           TEXT,
+			shipment_id        TEXT,
+			carrier            TEXT,
+			tracking_number    TEXT,
+			status             TEXT,
+			estimated_delivery TIMESTAMP,
+			updated_at         TIMESTAMP,
+			PRIMARY KEY (order_id, shipment_id)
+		)
+	`).Exec()
+	if err != nil {
+		return fmt.Errorf("create shipments_by_order table: %w", err)
+	}
+
+	err = s.session.Query(`
+		CREATE TABLE IF NOT EXISTS ordering.shipment_tracking (
+			shipment_id TEXT,
+			occurred_at TIMESTAMP,
+			event_id    TEXT,
+			event_type  TEXT,
+			status      TEXT,
+			location    TEXT,
+			details     TEXT,
+			recorded_at TIMESTAMP,
+			PRIMARY KEY (shipment_id, occurred_at, event_id)
+		) WITH CLUSTERING ORDER BY (occurred_at ASC, event_id ASC)
+	`).Exec()
+	if err != nil {
+		return fmt.Errorf("create shipment_tracking table: %w", err)
+	}
+	return nil
+}
+
+func (s *CassandraShipmentStore) RegisterShipment(_ context.Context, shipment *Shipment) (bool, error) {
+	previous := make(map[string]interface{})
+	applied, err := s.session.Query(`
+		INSERT INTO ordering.shipments (shipment_id, order_id, carrier, tracking_number, status, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		IF NOT EXISTS
+	`, shipment.ShipmentID, shipment.OrderID, shipment.Carrier, shipment.TrackingNumber,
+		shipment.Status, shipment.UpdatedAt).MapScanCAS(previous)
+	if err != nil {
+		return false, fmt.Errorf("register shipment: %w", err)
+	}
+	if !applied {
+		if boundTo, _ := previous["order_id"].(string); boundTo != shipment.OrderID {
+			return false, fmt.Errorf("%w: %s is bound to order %s", ErrShipmentOrderMismatch, shipment.ShipmentID, boundTo)
+		}
+		return false, nil
+	}
+
+	err = s.session.Query(`
+		INSERT INTO ordering.shipments_by_order (order_id, shipment_id, carrier, tracking_number, status, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, shipment.OrderID, shipment.ShipmentID, shipment.Carrier, shipment.TrackingNumber,
+		shipment.Status, shipment.UpdatedAt).Exec()
+	if err != nil {
+		return true, fmt.Errorf("register shipment by order: %w", err)
+	}
+	return true, nil
+}
+
+func (s *CassandraShipmentStore) UnregisterShipment(_ context.Context, shipmentID, orderID string) error {
+	applied, err := s.session.Query(`
+		DELETE FROM ordering.shipments
+		WHERE shipment_id = ?
+		IF order_id = ? AND status = ?
+	`, shipmentID, orderID, ShipmentStatusRegistered).MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		return fmt.Errorf("unregister shipment: %w", err)
+	}
+	if !applied {
+		return nil
+	}
+
+	err = s.session.Query(`
+		DELETE FROM ordering.shipments_by_order
+		WHERE order_id = ? AND shipment_id = ?
+	`, orderID, shipmentID).Exec()
+	if err != nil {
+		return fmt.Errorf("unregister shipment by order: %w", err)
+	}
+	return nil
+}
+
+func (s *CassandraShipmentStore) UpsertShipment(_ context.Context, shipment *Shipment) error {
+	// Build "SET col = ?" for the columns this event carries, so the UPDATE
+	// never overwrites a known carrier or ETA with an empty value.
+	sets := []string{"status = ?", "updated_at = ?"}
+	values := []interface{}{shipment.Status, shipment.UpdatedAt}
+	if shipment.Carrier != "" {
+		sets = append(sets, "carrier = ?")
+		values = append(values, shipment.Carrier)
+	}
+	if shipment.TrackingNumber != "" {
+		sets = append(sets, "tracking_number = ?")
+		values = append(values, shipment.TrackingNumber)
+	}
+	if shipment.EstimatedDelivery != nil {
+		sets = append(sets, "estimated_delivery = ?")
+		values = append(values, *shipment.EstimatedDelivery)
+	}
+	set := strings.Join(sets, ", ")
+
+	batch := s.session.NewBatch(gocql.LoggedBatch)
+	batch.Query(`UPDATE ordering.shipments SET order_id = ?, `+set+` WHERE shipment_id = ?`,
+		append(append([]interface{}{shipment.OrderID}, values...), shipment.ShipmentID)...)
+	batch.Query(`UPDATE ordering.shipments_by_order SET `+set+` WHERE order_id = ? AND shipment_id = ?`,
+		append(values, shipment.OrderID, shipment.ShipmentID)...)
+	if err := s.session.ExecuteBatch(batch); err != nil {
+		return fmt.Errorf("upsert shipment: %w", err)
+	}
+	return nil
+}
+
+const shipmentColumns = `shipment_id, order_id, carrier, tracking_number, status, estimated_delivery, updated_at`
+
+func scanShipment(scan func(dest ...interface{}) error) (*Shipment, error) {
+	var sh Shipment
+	var eta time.Time
+	err := scan(&sh.ShipmentID, &sh.OrderID, &sh.Carrier, &sh.TrackingNumber, &sh.Status, &eta, &sh.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if !eta.IsZero() {
+		sh.EstimatedDelivery = &eta
+	}
+	return &sh, nil
+}
+
+func (s *CassandraShipmentStore) GetShipment(_ context.Context, shipmentID string) (*Shipment, error) {
+	var lastEventAt time.Time
+	var lastEventSeq int64
+	query := s.session.Query(
+		`SELECT `+shipmentColumns+`, last_event_at, last_event_seq FROM ordering.shipments WHERE shipment_id = ?`, shipmentID)
+	shipment, err := scanShipment(func(dest ...interface{}) error {
+		return query.Scan(append(dest, &lastEventAt, &lastEventSeq)...)
+	})
+	if err == nil && !lastEventAt.IsZero() {
+		shipment.LastEventAt = &lastEventAt
+		shipment.LastEventSeq = lastEventSeq
+	}
+	if err != nil {
+		if err == gocql.ErrNotFound {
+			return nil, ErrShipmentNotFound
+		}
+		return nil, fmt.Errorf("get shipment: %w", err)
+	}
+	return shipment, nil
+}
+
+func (s *CassandraShipmentStore) ListShipmentsByOrder(_ context.Context, orderID string) ([]*Shipment, error) {
+	iter := s.session.Query(
+		`SELECT `+shipmentColumns+` FROM ordering.shipments_by_order WHERE order_id = ?`, orderID).Iter()
+
+	shipments := []*Shipment{}
+	scanner := iter.Scanner()
+	for scanner.Next() {
+		shipment, err := scanShipment(scanner.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("scan shipment: %w", err)
+		}
+		shipments = append(shipments, shipment)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("list shipments: %w", err)
+	}
+	return shipments, nil
+}
+
+func (s *CassandraShipmentStore) AddTrackingEvent(_ context.Context, event *TrackingEvent) error {
+	err := s.session.Query(`
+		INSERT INTO ordering.shipment_tracking
+			(shipment_id, occurred_at, event_id, event_type, status, location, details, recorded_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, event.ShipmentID, event.OccurredAt, event.EventID, event.EventType, event.Status,
+		event.Location, event.Details, event.RecordedAt).Exec()
+	if err != nil {
+		return fmt.Errorf("insert tracking event: %w", err)
+	}
+	return nil
+}
+
+func (s *CassandraShipmentStore) ListTrackingEvents(_ context.Context, shipmentID string) ([]TrackingEvent, error) {
+	iter := s.session.Query(`
+		SELECT shipment_id, event_id, event_type, status, location, details, occurred_at, recorded_at
+		FROM ordering.shipment_tracking
+		WHERE shipment_id = ?
+	`, shipmentID).Iter()
+
+	events := []TrackingEvent{}
+	var e TrackingEvent
+	for iter.Scan(&e.ShipmentID, &e.EventID, &e.EventType, &e.Status, &e.Location, &e.Details, &e.OccurredAt, &e.RecordedAt) {
+		events = append(events, e)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, fmt.Errorf("list tracking events: %w", err)
+	}
+	return events, nil
+}
+
+func (s *CassandraShipmentStore) AdvanceShipment(_ context.Context, shipmentID string, expected, next EventPosition) (bool, error) {
+	set := `last_event_at = ?, last_event_seq = ?`
+	args := []interface{}{next.At, next.Seq, shipmentID}
+	if next.At.IsZero() {
+		set = `last_event_at = null, last_event_seq = null`
+		args = []interface{}{shipmentID}
+	}
+
+	var query *gocql.Query
+	if expected.At.IsZero() {
+		query = s.session.Query(`UPDATE ordering.shipments SET `+set+` WHERE shipment_id = ? IF last_event_at = null`,
+			args...)
+	} else {
+		query = s.session.Query(`UPDATE ordering.shipments SET `+set+` WHERE shipment_id = ? IF last_event_at = ? AND last_event_seq = ?`,
+			append(args, expected.At, expected.Seq)...)
+	}
+
+	applied, err := query.MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		return false, fmt.Errorf("advance shipment: %w", err)
+	}
+	return applied, nil
+}
+
+// MemoryShipmentStore is the process-local ShipmentStore used with
+// STORE_BACKEND=memory.
+type MemoryShipmentStore struct {
+	mu        sync.RWMutex
+	shipments map[string]*Shipment
+	tracking  map[string][]TrackingEvent
+}
+
+func NewMemoryShipmentStore() *MemoryShipmentStore {
+	return &MemoryShipmentStore{
+		shipments: make(map[string]*Shipment),
+		tracking:  make(map[string][]TrackingEvent),
+	}
+}
+
+func (s *MemoryShipmentStore) RegisterShipment(_ context.Context, shipment *Shipment) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stored, ok := s.shipments[shipment.ShipmentID]; ok {
+		if stored.OrderID != shipment.OrderID {
+			return false, fmt.Errorf("%w: %s is bound to order %s", ErrShipmentOrderMismatch, shipment.ShipmentID, stored.OrderID)
+		}
+		return false, nil
+	}
+	stored := *shipment
+	s.shipments[shipment.ShipmentID] = &stored
+	return true, nil
+}
+
+func (s *MemoryShipmentStore) UnregisterShipment(_ context.Context, shipmentID, orderID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stored, ok := s.shipments[shipmentID]; ok && stored.OrderID == orderID && stored.Status == ShipmentStatusRegistered {
+		delete(s.shipments, shipmentID)
+	}
+	return nil
+}
+
+func (s *MemoryShipmentStore) UpsertShipment(_ context.Context, shipment *Shipment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.shipments[shipment.ShipmentID]
+	if !ok {
+		stored = &Shipment{ShipmentID: shipment.ShipmentID}
+		s.shipments[shipment.ShipmentID] = stored
+	}
+	stored.OrderID = shipment.OrderID
+	stored.Status = shipment.Status
+	stored.UpdatedAt = shipment.UpdatedAt
+	if shipment.Carrier != "" {
+		stored.Carrier = shipment.Carrier
+	}
+	if shipment.TrackingNumber != "" {
+		stored.TrackingNumber = shipment.TrackingNumber
+	}
+	if shipment.EstimatedDelivery != nil {
+		eta := *shipment.EstimatedDelivery
+		stored.EstimatedDelivery = &eta
+	}
+	return nil
+}
+
+func (s *MemoryShipmentStore) GetShipment(_ context.Context, shipmentID string) (*Shipment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	shipment, ok := s.shipments[shipmentID]
+	if !ok {
+		return nil, ErrShipmentNotFound
+	}
+	out := *shipment
+	return &out, nil
+}
+
+func (s *MemoryShipmentStore) ListShipmentsByOrder(_ context.Context, orderID string) ([]*Shipment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	shipments := []*Shipment{}
+	for _, shipment := range s.shipments {
+		if shipment.OrderID == orderID {
+			out := *shipment
+			shipments = append(shipments, &out)
+		}
+	}
+	// Same order as the shipments_by_order clustering key.
+	sort.Slice(shipments, func(i, j int) bool { return shipments[i].ShipmentID < shipments[j].ShipmentID })
+	return shipments, nil
+}
+
+func (s *MemoryShipmentStore) AddTrackingEvent(_ context.Context, event *TrackingEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	timeline := s.tracking[event.ShipmentID]
+	for i, existing := range timeline {
+		if existing.EventID == event.EventID && existing.OccurredAt.Equal(event.OccurredAt) {
+			timeline[i] = *event
+			return nil
+		}
+	}
+	timeline = append(timeline, *event)
+	// Same order as the shipment_tracking clustering key.
+	sort.SliceStable(timeline, func(i, j int) bool {
+		if !timeline[i].OccurredAt.Equal(timeline[j].OccurredAt) {
+			return timeline[i].OccurredAt.Before(timeline[j].OccurredAt)
+		}
+		return timeline[i].EventID < timeline[j].EventID
+	})
+	s.tracking[event.ShipmentID] = timeline
+	return nil
+}
+
+func (s *MemoryShipmentStore) ListTrackingEvents(_ context.Context, shipmentID string) ([]TrackingEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]TrackingEvent{}, s.tracking[shipmentID]...), nil
+}
+
+func (s *MemoryShipmentStore) AdvanceShipment(_ context.Context, shipmentID string, expected, next EventPosition) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shipment, ok := s.shipments[shipmentID]
+	if !ok {
+		return false, nil
+	}
+	current := shipment.lastEvent()
+	if !current.At.Equal(expected.At) || current.Seq != expected.Seq {
+		return false, nil
+	}
+	if next.At.IsZero() {
+		shipment.LastEventAt = nil
+		shipment.LastEventSeq = 0
+		return true, nil
+	}
+	at := next.At
+	shipment.LastEventAt = &at
+	shipment.LastEventSeq = next.Seq
+	return true, nil
+}
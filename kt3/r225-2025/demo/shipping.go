@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// ShippingEventProcessor applies carrier events to orders. Both webhook
+// endpoints hand their decoded event to Process, so every shipping-driven
+// status change goes through StateMachine.Transition and its lock.
+type ShippingEventProcessor struct {
+	store     OrderStore
+	shipments ShipmentStore
+	sm        *StateMachine
+}
+
+func NewShippingEventProcessor(store OrderStore, shipments ShipmentStore, sm *StateMachine) *ShippingEventProcessor {
+	return &ShippingEventProcessor{store: store, shipments: shipments, sm: sm}
+}
+
+// shippingTransition is the order-side effect of one carrier status.
+// An empty target means the event is informational only.
+type shippingTransition struct {
+	target string
+	reason string
+	refund bool
+}
+
+func shippingTransitionFor(event ShippingWebhookEvent, source string) (shippingTransition, error) {
+	switch event.Status {
+	case ShipStatusDelivered:
+		return shippingTransition{
+			target: StatusDelivered,
+			reason: fmt.Sprintf("delivered — confirmed by %s (shipment %s)", source, event.ShipmentID),
+		}, nil
+	case ShipStatusLost, ShipStatusDamaged:
+		return shippingTransition{
+			target: StatusShipFailed,
+			reason: fmt.Sprintf("shipment %s — refund initiated (shipment %s)",
+				strings.ToLower(event.Status), event.ShipmentID),
+			refund: true,
+		}, nil
+	case ShipStatusReturned:
+		return shippingTransition{
+			target: StatusReturned,
+			reason: fmt.Sprintf("shipment returned to sender (shipment %s)", event.ShipmentID),
+		}, nil
+	case ShipStatusInTransit:
+		return shippingTransition{}, nil
+	default:
+		return shippingTransition{}, fmt.Errorf("%w: %s", ErrUnknownShipStatus, event.Status)
+	}
+}
+
+// Process validates the event, maps the carrier status to a target order
+// state and applies it via the state machine. source names the endpoint
+// and is used in logs and history reasons.
+func (p *ShippingEventProcessor) Process(ctx context.Context, event ShippingWebhookEvent, source string) (*ShippingWebhookResponse, error) {
+	if event.ShipmentID == "" {
+		return nil, fmt.Errorf("%w: shipment_id is required", ErrInvalidShippingEvent)
+	}
+
+	// The order is taken from the shipment registered by ShipOrder, never
+	// from the payload alone: a signed event for one shipment must not be
+	// able to move some other order.
+	shipment, err := p.shipments.GetShipment(ctx, event.ShipmentID)
+	if err != nil {
+		if errors.Is(err, ErrShipmentNotFound) {
+			log.Printf("[%s] Unknown shipment %s, rejecting", source, event.ShipmentID)
+			return nil, fmt.Errorf("%w: %s", ErrShipmentNotFound, event.ShipmentID)
+		}
+		return nil, err
+	}
+	if event.OrderID != "" && event.OrderID != shipment.OrderID {
+		log.Printf("[%s] *** MISMATCH: shipment %s belongs to order %s, event names order %s ***",
+			source, event.ShipmentID, shipment.OrderID, event.OrderID)
+		return nil, fmt.Errorf("%w: shipment %s does not belong to order %s",
+			ErrShipmentOrderMismatch, event.ShipmentID, event.OrderID)
+	}
+	event.OrderID = shipment.OrderID
+
+	transition, err := shippingTransitionFor(event, source)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every authenticated event for a known shipment is part of its
+	// timeline, whether or not it changes the order.
+	if err := p.recordTracking(ctx, event); err != nil {
+		return nil, err
+	}
+
+	order, err := p.store.GetOrder(ctx, event.OrderID)
+	if err != nil {
+		return nil, err
+	}
+
+	current, undo, err := p.advance(ctx, shipment, event, source)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil {
+		log.Printf("[%s] Shipment %s: event %s (%s) is older than the last applied event (%s), ignoring",
+			source, event.ShipmentID, event.EventID, event.Status, current.At.Format(time.RFC3339))
+		return &ShippingWebhookResponse{
+			OrderID:        event.OrderID,
+			ShipmentID:     event.ShipmentID,
+			PreviousStatus: order.Status,
+			NewStatus:      order.Status,
+			Ignored:        true,
+			Message: fmt.Sprintf("stale event: a newer event (%s) was already applied; recorded in tracking only",
+				current.At.Format(time.RFC3339)),
+		}, nil
+	}
+
+	if transition.target == "" {
+		p.recordShipment(ctx, event, source)
+		log.Printf("[%s] Order %s: shipment %s is in transit", source, event.OrderID, event.ShipmentID)
+		return &ShippingWebhookResponse{
+			OrderID:        event.OrderID,
+			ShipmentID:     event.ShipmentID,
+			PreviousStatus: order.Status,
+			NewStatus:      order.Status,
+			Message:        "status noted, no state change",
+		}, nil
+	}
+
+	// Which order states a carrier status may move on from is the
+	// lifecycle's decision, not this processor's.
+	err = p.sm.Transition(ctx, event.OrderID, transition.target, transition.reason, nil)
+	if err != nil {
+		// The event was not applied, so it must not count as the newest
+		// one: the carrier's retry, or an older event still in flight,
+		// has to be able to move the order.
+		undo()
+		if errors.Is(err, ErrTransitionNotAllowed) {
+			if current, getErr := p.store.GetOrder(ctx, event.OrderID); getErr == nil {
+				log.Printf("[%s] Order %s: %s does not apply in state %s", source, event.OrderID, event.Status, current.Status)
+				return nil, fmt.Errorf("%w: order is in %s state, cannot move to %s",
+					ErrTransitionNotAllowed, current.Status, transition.target)
+			}
+		}
+		return nil, err
+	}
+
+	p.recordShipment(ctx, event, source)
+
+	newStatus := transition.target
+	if transition.refund {
+		// SHIP_FAILED is recorded first so the history shows why the refund
+		// was requested. If the follow-up fails the order stays in SHIP_FAILED,
+		// from where a refund can still be requested manually.
+		reason := fmt.Sprintf("refund requested after shipment %s", strings.ToLower(event.Status))
+		if err := p.sm.Transition(ctx, event.OrderID, StatusRefundPending, reason, nil); err != nil {
+			log.Printf("[%s] Order %s: could not request refund: %v", source, event.OrderID, err)
+		} else {
+			newStatus = StatusRefundPending
+			log.Printf("[%s] *** REFUND TRIGGERED for order %s (shipment %s, reason: %s) ***",
+				source, event.OrderID, event.ShipmentID, event.Status)
+		}
+	}
+
+	log.Printf("[%s] Order %s: %s → %s (refund=%v)", source, event.OrderID, order.Status, newStatus, transition.refund)
+
+	return &ShippingWebhookResponse{
+		OrderID:         event.OrderID,
+		ShipmentID:      event.ShipmentID,
+		PreviousStatus:  order.Status,
+		NewStatus:       newStatus,
+		RefundTriggered: newStatus == StatusRefundPending,
+		Message:         fmt.Sprintf("order transitioned to %s", newStatus),
+	}, nil
+}
+
+// advance claims the event's position as the shipment's newest applied
+// event. If a newer event has already been applied it returns that event's
+// position and the caller must not act on this one. Otherwise the returned
+// undo gives the claim back, for an event that turns out not to apply.
+// Events without a timestamp cannot be ordered and are always applied.
+func (p *ShippingEventProcessor) advance(ctx context.Context, shipment *Shipment, event ShippingWebhookEvent, source string) (*EventPosition, func(), error) {
+	noop := func() {}
+	if event.Timestamp <= 0 {
+		return nil, noop, nil
+	}
+	next := EventPosition{At: time.Unix(event.Timestamp, 0).UTC(), Seq: event.Sequence}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		last := shipment.lastEvent()
+		// An event at the same position is a carrier retry; let it through.
+		if next.Before(last) {
+			return &last, noop, nil
+		}
+		ok, err := p.shipments.AdvanceShipment(ctx, shipment.ShipmentID, last, next)
+		if err != nil {
+			return nil, noop, err
+		}
+		if ok {
+			return nil, func() { p.rollback(ctx, shipment.ShipmentID, next, last, source) }, nil
+		}
+		// Another event for this shipment moved the position; re-read it.
+		if shipment, err = p.shipments.GetShipment(ctx, shipment.ShipmentID); err != nil {
+			return nil, noop, err
+		}
+	}
+	return nil, noop, fmt.Errorf("%w: shipment %s is receiving concurrent events", ErrTransitionConflict, shipment.ShipmentID)
+}
+
+// rollback moves the shipment's position from claimed back to previous,
+// unless another event has moved it since, in which case that event owns it.
+func (p *ShippingEventProcessor) rollback(ctx context.Context, shipmentID string, claimed, previous EventPosition, source string) {
+	ok, err := p.shipments.AdvanceShipment(context.WithoutCancel(ctx), shipmentID, claimed, previous)
+	if err != nil {
+		log.Printf("[%s] Shipment %s: could not roll back event position: %v", source, shipmentID, err)
+	} else if !ok {
+		log.Printf("[%s] Shipment %s: event position moved on, not rolled back", source, shipmentID)
+	}
+}
+
+// recordShipment upserts the shipment once its event has been applied. The
+// order transition is already committed at this point, so a failure is
+// logged rather than returned: failing the webhook would make the carrier
+// retry an event the order can no longer accept.
+func (p *ShippingEventProcessor) recordShipment(ctx context.Context, event ShippingWebhookEvent, source string) {
+	shipment := &Shipment{
+		ShipmentID:     event.ShipmentID,
+		OrderID:        event.OrderID,
+		Carrier:        event.Carrier,
+		TrackingNumber: event.TrackingNumber,
+		Status:         event.Status,
+		UpdatedAt:      time.Now().UTC(),
+	}
+	if event.EstimatedDelivery > 0 {
+		eta := time.Unix(event.EstimatedDelivery, 0).UTC()
+		shipment.EstimatedDelivery = &eta
+	}
+	if err := p.shipments.UpsertShipment(ctx, shipment); err != nil {
+		log.Printf("[%s] Shipment %s: failed to record status %s: %v", source, event.ShipmentID, event.Status, err)
+	}
+}
+
+func (p *ShippingEventProcessor) recordTracking(ctx context.Context, event ShippingWebhookEvent) error {
+	now := time.Now().UTC()
+	occurredAt := now
+	if event.Timestamp > 0 {
+		occurredAt = time.Unix(event.Timestamp, 0).UTC()
+	}
+	return p.shipments.AddTrackingEvent(ctx, &TrackingEvent{
+		ShipmentID: event.ShipmentID,
+		EventID:    event.EventID,
+		EventType:  event.EventType,
+		Status:     event.Status,
+		Location:   event.Location,
+		Details:    event.Details,
+		OccurredAt: occurredAt,
+		RecordedAt: now,
+	})
+}
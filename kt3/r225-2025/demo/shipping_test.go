@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestProcessor returns a ShippingEventProcessor over in-memory stores
+// and a shipment SH-1 registered for a new order in status.
+func newTestProcessor(t *testing.T, status string) (*testEnv, *MemoryShipmentStore, *ShippingEventProcessor, *Order) {
+	t.Helper()
+	env := newTestEnv(t)
+	shipments := NewMemoryShipmentStore()
+	order := env.seedOrder(t, "c1", status)
+	if _, err := shipments.RegisterShipment(context.Background(), &Shipment{
+		ShipmentID: "SH-1",
+		OrderID:    order.OrderID,
+		Status:     ShipmentStatusRegistered,
+	}); err != nil {
+		t.Fatalf("RegisterShipment: %v", err)
+	}
+	return env, shipments, NewShippingEventProcessor(env.store, shipments, env.sm), order
+}
+
+func shipEvent(id, status string, at time.Time, seq int64) ShippingWebhookEvent {
+	return ShippingWebhookEvent{EventID: id, ShipmentID: "SH-1", Status: status, Timestamp: at.Unix(), Sequence: seq}
+}
+
+func timelineOf(t *testing.T, shipments ShipmentStore) []string {
+	t.Helper()
+	events, err := shipments.ListTrackingEvents(context.Background(), "SH-1")
+	if err != nil {
+		t.Fatalf("ListTrackingEvents: %v", err)
+	}
+	var ids []string
+	for _, e := range events {
+		ids = append(ids, e.EventID+":"+e.Status)
+	}
+	return ids
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestProcessOutOfOrderEvents(t *testing.T) {
+	env, shipments, p, order := newTestProcessor(t, StatusShipping)
+	ctx := asPrincipal(testCarrier)
+	t0 := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	resp, err := p.Process(ctx, shipEvent("e2", ShipStatusDelivered, t0.Add(time.Hour), 0), "test")
+	if err != nil || resp.NewStatus != StatusDelivered {
+		t.Fatalf("DELIVERED: resp %+v, err %v", resp, err)
+	}
+
+	// IN_TRANSIT arrives late: it joins the timeline but changes nothing.
+	resp, err = p.Process(ctx, shipEvent("e1", ShipStatusInTransit, t0, 0), "test")
+	if err != nil || !resp.Ignored || resp.NewStatus != StatusDelivered {
+		t.Fatalf("late IN_TRANSIT: resp %+v, err %v", resp, err)
+	}
+
+	if got := env.status(t, order.OrderID); got != StatusDelivered {
+		t.Errorf("order status %s, want DELIVERED", got)
+	}
+	shipment, _ := shipments.GetShipment(context.Background(), "SH-1")
+	if shipment.Status != ShipStatusDelivered {
+		t.Errorf("shipment status %s, want DELIVERED", shipment.Status)
+	}
+	if got, want := timelineOf(t, shipments), []string{"e1:IN_TRANSIT", "e2:DELIVERED"}; !equalStrings(got, want) {
+		t.Errorf("timeline %v, want %v", got, want)
+	}
+}
+
+func TestProcessEventPositions(t *testing.T) {
+	_, shipments, p, _ := newTestProcessor(t, StatusShipping)
+	ctx := asPrincipal(testCarrier)
+	t0 := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		event       ShippingWebhookEvent
+		wantIgnored bool
+	}{
+		{"first", shipEvent("e1", ShipStatusInTransit, t0, 2), false},
+		{"same position, a carrier retry", shipEvent("e1", ShipStatusInTransit, t0, 2), false},
+		{"same timestamp, another event at the same sequence", shipEvent("e2", ShipStatusInTransit, t0, 2), false},
+		{"same timestamp, lower sequence", shipEvent("e0", ShipStatusInTransit, t0, 1), true},
+		{"same timestamp, higher sequence", shipEvent("e3", ShipStatusInTransit, t0, 3), false},
+		{"earlier timestamp, higher sequence", shipEvent("e4", ShipStatusInTransit, t0.Add(-time.Second), 9), true},
+	}
+	for _, tc := range tests {
+		resp, err := p.Process(ctx, tc.event, "test")
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if resp.Ignored != tc.wantIgnored {
+			t.Errorf("%s: ignored=%v, want %v", tc.name, resp.Ignored, tc.wantIgnored)
+		}
+	}
+
+	shipment, _ := shipments.GetShipment(context.Background(), "SH-1")
+	if got := shipment.lastEvent(); !got.At.Equal(t0) || got.Seq != 3 {
+		t.Errorf("last applied position %v/%d, want %v/3", got.At, got.Seq, t0)
+	}
+	if n := len(timelineOf(t, shipments)); n != 5 {
+		t.Errorf("timeline holds %d events, want 5 (ignored events are recorded too)", n)
+	}
+}
+
+func TestProcessRejectedEventDoesNotAdvance(t *testing.T) {
+	env, shipments, p, order := newTestProcessor(t, StatusPaid)
+	ctx := asPrincipal(testCarrier)
+	t0 := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// DELIVERED for an order that has not shipped yet is rejected, and its
+	// position is given back.
+	_, err := p.Process(ctx, shipEvent("e2", ShipStatusDelivered, t0.Add(time.Hour), 0), "test")
+	if !errors.Is(err, ErrTransitionNotAllowed) {
+		t.Fatalf("DELIVERED from PAID: err = %v, want ErrTransitionNotAllowed", err)
+	}
+	shipment, _ := shipments.GetShipment(context.Background(), "SH-1")
+	if shipment.LastEventAt != nil {
+		t.Fatalf("rejected event left the position at %v", shipment.LastEventAt)
+	}
+
+	if err := env.store.UpdateOrderStatus(context.Background(), order.OrderID, StatusPaid, StatusShipping, "shipped", 0, OrderFields{}); err != nil {
+		t.Fatalf("ship: %v", err)
+	}
+
+	// An event older than the rejected one still applies, and so does the
+	// carrier's retry of the rejected one.
+	resp, err := p.Process(ctx, shipEvent("e1", ShipStatusInTransit, t0, 0), "test")
+	if err != nil || resp.Ignored {
+		t.Fatalf("IN_TRANSIT after the rejection: resp %+v, err %v", resp, err)
+	}
+	resp, err = p.Process(ctx, shipEvent("e2", ShipStatusDelivered, t0.Add(time.Hour), 0), "test")
+	if err != nil || resp.NewStatus != StatusDelivered {
+		t.Fatalf("DELIVERED retry: resp %+v, err %v", resp, err)
+	}
+	if got := env.status(t, order.OrderID); got != StatusDelivered {
+		t.Errorf("order status %s, want DELIVERED", got)
+	}
+}
@@ -2,70 +2,95 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"time"
-
-	"github.com/redis/go-redis/v9"
 )
 
-var AllowedTransitions = map[string]map[string]bool{
-	StatusPendingPayment: {StatusPaid: true, StatusCancelled: true},
-	StatusPaid:           {StatusShipping: true},
-	StatusShipping:       {StatusDelivered: true, StatusShipFailed: true},
-}
-
 type StateMachine struct {
-	store              *OrderStore
-	rdb                *redis.Client
+	store              OrderStore
+	actions            ActionEnv
+	locker             Locker
+	lifecycle          *Lifecycle
+	policy             *AccessPolicy
 	lockTTL            time.Duration
 	maxProcessingDelay time.Duration
 }
 
-func NewStateMachine(store *OrderStore, rdb *redis.Client, lockTTL, maxProcessingDelay time.Duration) *StateMachine {
+func NewStateMachine(store OrderStore, refunds RefundStore, locker Locker, lifecycle *Lifecycle, policy *AccessPolicy, lockTTL, maxProcessingDelay time.Duration) *StateMachine {
 	return &StateMachine{
 		store:              store,
-		rdb:                rdb,
+		actions:            ActionEnv{Orders: store, Refunds: refunds},
+		locker:             locker,
+		lifecycle:          lifecycle,
+		policy:             policy,
 		lockTTL:            lockTTL,
 		maxProcessingDelay: maxProcessingDelay,
 	}
 }
 
-func (sm *StateMachine) Transition(ctx context.Context, orderID, targetState, reason string) error {
+// Transition moves the order to targetState if the lifecycle allows it from
+// the current state, all required inputs are present and every guard passes.
+// Preparations run right before the status write and abort the transition
+// if they fail; post-commit actions run after it and only log failures.
+//
+// The principal in ctx must hold the permission for targetState and be
+// allowed to act on the order, whichever route the call came from.
+func (sm *StateMachine) Transition(ctx context.Context, orderID, targetState, reason string, inputs TransitionInputs) error {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return fmt.Errorf("%w: no principal for transition to %s", ErrForbidden, targetState)
+	}
+	if !sm.policy.Allows(principal.Role, TransitionPermission(targetState)) {
+		log.Printf("[state] Order %s: %s %q may not move orders to %s", orderID, principal.Role, principal.ID(), targetState)
+		return fmt.Errorf("%w: role %s may not move orders to %s", ErrForbidden, principal.Role, targetState)
+	}
+
 	lockKey := fmt.Sprintf("order_lock:%s", orderID)
 
-	var acquired bool
+	var lease *Lease
 	for retries := 0; retries < 50; retries++ {
 		var err error
-		acquired, err = sm.rdb.SetNX(ctx, lockKey, "1", sm.lockTTL).Result()
-		if err != nil {
-			return fmt.Errorf("redis lock error: %w", err)
-		}
-		if acquired {
+		lease, err = sm.locker.Acquire(ctx, lockKey, sm.lockTTL)
+		if err == nil {
 			break
 		}
+		if !errors.Is(err, ErrLockNotAcquired) {
+			return err
+		}
 		time.Sleep(100 * time.Millisecond)
 	}
-	if !acquired {
+	if lease == nil {
 		return ErrLockNotAcquired
 	}
 
-	log.Printf("[state] Order %s: lock acquired (value=\"1\", TTL=%v)", orderID, sm.lockTTL)
+	log.Printf("[state] Order %s: lock acquired (owner=%s, fence=%d, TTL=%v)", orderID, lease.Owner[:8], lease.Fence, sm.lockTTL)
 
 	defer func() {
-		sm.rdb.Del(ctx, lockKey)
-		log.Printf("[state] Order %s: lock released (DEL)", orderID)
+		released, err := sm.locker.Release(ctx, lease)
+		if err != nil {
+			log.Printf("[state] Order %s: lock release error: %v", orderID, err)
+		} else if released {
+			log.Printf("[state] Order %s: lock released (owner verified)", orderID)
+		} else {
+			log.Printf("[state] Order %s: lock NOT released (ownership lost)", orderID)
+		}
 	}()
 
 	order, err := sm.store.GetOrder(ctx, orderID)
 	if err != nil {
 		return err
 	}
+	if !sm.policy.CanAccessOrder(principal, order) {
+		return ErrOrderNotFound
+	}
 	currentState := order.Status
 
-	if !isAllowed(currentState, targetState) {
-		return ErrTransitionNotAllowed
+	transition, err := sm.lifecycle.check(order, targetState, inputs)
+	if err != nil {
+		return err
 	}
 
 	if sm.maxProcessingDelay > 0 {
@@ -74,19 +99,50 @@ func (sm *StateMachine) Transition(ctx context.Context, orderID, targetState, re
 		time.Sleep(delay)
 	}
 
-	err = sm.store.UpdateOrderStatus(ctx, orderID, targetState, reason)
+	// Re-check ownership and extend the TTL to cover the write; if the lock
+	// expired during processing another process may already own the order.
+	held, err := sm.locker.Refresh(ctx, lease, sm.lockTTL)
+	if err != nil {
+		return err
+	}
+	if !held {
+		log.Printf("[state] Order %s: lock expired during processing, aborting", orderID)
+		return ErrLockExpired
+	}
+
+	next := *order
+	next.Status = targetState
+	next.Reason = reason
+	for _, prepare := range transition.prepare {
+		if err := prepare.fn(ctx, sm.actions, &next, inputs); err != nil {
+			log.Printf("[state] Order %s: preparation %s failed, not moving to %s: %v", orderID, prepare.name, targetState, err)
+			return fmt.Errorf("%s: %w", prepare.name, err)
+		}
+	}
+
+	fields := transition.fields(inputs)
+	err = sm.store.UpdateOrderStatus(ctx, orderID, currentState, targetState, reason, lease.Fence, fields)
 	if err != nil {
+		if errors.Is(err, ErrStaleFence) {
+			log.Printf("[state] Order %s: write rejected, fence %d is stale", orderID, lease.Fence)
+		}
+		if errors.Is(err, ErrTransitionConflict) {
+			log.Printf("[state] Order %s: write rejected, status is no longer %s", orderID, currentState)
+		}
 		return err
 	}
 
 	log.Printf("[state] Order %s: %s → %s COMMITTED", orderID, currentState, targetState)
-	return nil
-}
 
-func isAllowed(currentState, targetState string) bool {
-	targets, ok := AllowedTransitions[currentState]
-	if !ok {
-		return false
+	order.Status = targetState
+	order.Reason = reason
+	if fields.PaymentID != "" {
+		order.PaymentID = fields.PaymentID
 	}
-	return targets[targetState]
-}
\ No newline at end of file
+	for _, action := range transition.actions {
+		if err := action.fn(ctx, sm.actions, order, inputs); err != nil {
+			log.Printf("[state] Order %s: post-commit action %s failed: %v", orderID, action.name, err)
+		}
+	}
+	return nil
+}
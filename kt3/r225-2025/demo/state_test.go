@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentPayAndCancel races a payment against a cancellation through
+// the state machine. Exactly one must win, and the order must end up in the
+// winner's state.
+func TestConcurrentPayAndCancel(t *testing.T) {
+	env := newTestEnv(t)
+	actors := map[string]context.Context{
+		StatusPaid:      asPrincipal(&Principal{Subject: "psp", Role: RolePayment}),
+		StatusCancelled: asPrincipal(&Principal{Subject: "c1", CustomerID: "c1", Role: RoleCustomer}),
+	}
+
+	for i := 0; i < 50; i++ {
+		order := env.seedOrder(t, "c1", StatusPendingPayment)
+		targets := []string{StatusPaid, StatusCancelled}
+		errs := make([]error, len(targets))
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for j, target := range targets {
+			wg.Add(1)
+			go func(j int, target string) {
+				defer wg.Done()
+				<-start
+				errs[j] = env.sm.Transition(actors[target], order.OrderID, target, "race", TransitionInputs{"payment_id": "pay_1"})
+			}(j, target)
+		}
+		close(start)
+		wg.Wait()
+
+		winner := ""
+		for j, err := range errs {
+			switch {
+			case err == nil:
+				if winner != "" {
+					t.Fatalf("order %s: both %s and %s succeeded", order.OrderID, winner, targets[j])
+				}
+				winner = targets[j]
+			case !isConflictError(err):
+				t.Fatalf("order %s: %s failed with %v, want a conflict", order.OrderID, targets[j], err)
+			}
+		}
+		if winner == "" {
+			t.Fatalf("order %s: neither transition succeeded: %v", order.OrderID, errs)
+		}
+		if got := env.status(t, order.OrderID); got != winner {
+			t.Fatalf("order %s: status = %s, winner was %s", order.OrderID, got, winner)
+		}
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -10,17 +13,40 @@ import (
 	"github.com/google/uuid"
 )
 
-type OrderStore struct {
+// OrderStore is the persistence contract used by Handlers and StateMachine.
+// CassandraOrderStore is the production implementation; MemoryOrderStore
+// backs unit tests and local demos that run without Cassandra.
+type OrderStore interface {
+	// CreateOrder stores a new order priced only from its item snapshots,
+	// which are written once alongside it.
+	CreateOrder(ctx context.Context, customerID string, snapshots []ItemSnapshot) (*Order, error)
+	GetOrder(ctx context.Context, orderID string) (*Order, error)
+	// UpdateOrderStatus moves the order from expectedStatus to newStatus and
+	// writes fields in the same conditional update.
+	UpdateOrderStatus(ctx context.Context, orderID, expectedStatus, newStatus, reason string, fence int64, fields OrderFields) error
+	GetOrderHistory(ctx context.Context, orderID string) ([]StatusChange, error)
+	GetItemSnapshots(ctx context.Context, orderID string) ([]ItemSnapshot, error)
+	// ListCustomerOrders returns one page of the customer's orders, newest
+	// first, and the paging state of the next page (nil after the last
+	// page). A paging state the store cannot resume from is ErrInvalidCursor.
+	ListCustomerOrders(ctx context.Context, customerID string, filter OrderFilter, pageSize int, pageState []byte) ([]OrderSummary, []byte, error)
+	// ListOrdersByStatus returns one page of the orders in filter.Status
+	// that entered it within [filter.From, filter.To), oldest first. Status,
+	// From and To are required; paging works as in ListCustomerOrders.
+	ListOrdersByStatus(ctx context.Context, filter OrderFilter, pageSize int, pageState []byte) ([]OrderSummary, []byte, error)
+}
+
+type CassandraOrderStore struct {
 	session *gocql.Session
 }
 
-func NewOrderStore(session *gocql.Session) *OrderStore {
-	return &OrderStore{session: session}
+func NewCassandraOrderStore(session *gocql.Session) *CassandraOrderStore {
+	return &CassandraOrderStore{session: session}
 }
 
 // InitSchema creates the keyspace and tables if they don't exist.
 // Called once at startup after Cassandra connection is established.
-func (s *OrderStore) InitSchema() error {
+func (s *CassandraOrderStore) InitSchema() error {
 	log.Println("[store] Initializing Cassandra schema...")
 
 	err := s.session.Query(`
@@ -41,8 +67,11 @@ func (s *OrderStore) InitSchema() error {
 			status      TEXT,
 			items       TEXT,
 			total       DOUBLE,
+			total_minor BIGINT,
+			currency    TEXT,
 			payment_id  TEXT,
 			reason      TEXT,
+			fence_token BIGINT,
 			created_at  TIMESTAMP,
 			updated_at  TIMESTAMP
 		)
@@ -51,6 +80,109 @@ func (s *OrderStore) InitSchema() error {
 		return fmt.Errorf("create orders table: %w", err)
 	}
 
+	// Tables created before fencing was introduced lack fence_token; rows
+	// written by then keep it null until their first fenced update.
+	err = addColumnIfMissing(s.session, "ordering", "orders", "fence_token", "BIGINT")
+	if err != nil {
+		return err
+	}
+
+	// Amounts moved from DOUBLE to minor units plus currency. The old total
+	// and price columns are kept and only read for rows whose minor-unit
+	// column is still null; BackfillOrderMoney converts orders in place.
+	if err := addColumnIfMissing(s.session, "ordering", "orders", "total_minor", "BIGINT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(s.session, "ordering", "orders", "currency", "TEXT"); err != nil {
+		return err
+	}
+
+	// One row per order line. The legacy orders.items text column is only
+	// read for orders created before this table existed.
+	err = s.session.Query(`
+		CREATE TABLE IF NOT EXISTS ordering.order_items (
+			order_id   TEXT,
+			line_no    INT,
+			product_id TEXT,
+			quantity    INT,
+			price       DOUBLE,
+			price_minor BIGINT,
+			currency    TEXT,
+			PRIMARY KEY (order_id, line_no)
+		)
+	`).Exec()
+	if err != nil {
+		return fmt.Errorf("create order_items table: %w", err)
+	}
+
+	// A table created before amounts moved to minor units lacks these; a
+	// new one already has them. Altering only works once the table exists.
+	if err := addColumnIfMissing(s.session, "ordering", "order_items", "price_minor", "BIGINT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(s.session, "ordering", "order_items", "currency", "TEXT"); err != nil {
+		return err
+	}
+
+	// Catalog data captured when the order was placed; rows are inserted
+	// with IF NOT EXISTS and never updated.
+	err = s.session.Query(`
+		CREATE TABLE IF NOT EXISTS ordering.order_item_snapshots (
+			order_id         TEXT,
+			line_no          INT,
+			product_id       TEXT,
+			sku              TEXT,
+			name             TEXT,
+			unit_price_minor BIGINT,
+			currency         TEXT,
+			quantity         INT,
+			captured_at      TIMESTAMP,
+			PRIMARY KEY (order_id, line_no)
+		)
+	`).Exec()
+	if err != nil {
+		return fmt.Errorf("create order_item_snapshots table: %w", err)
+	}
+
+	// Orders per customer, newest first, for the "My orders" listing. Rows
+	// are derived from ordering.orders and can always be rewritten from it.
+	err = s.session.Query(`
+		CREATE TABLE IF NOT EXISTS ordering.orders_by_customer (
+			customer_id TEXT,
+			created_at  TIMESTAMP,
+			order_id    TEXT,
+			status      TEXT,
+			total_minor BIGINT,
+			currency    TEXT,
+			updated_at  TIMESTAMP,
+			PRIMARY KEY (customer_id, created_at, order_id)
+		) WITH CLUSTERING ORDER BY (created_at DESC, order_id ASC)
+	`).Exec()
+	if err != nil {
+		return fmt.Errorf("create orders_by_customer table: %w", err)
+	}
+
+	// Orders per status for operational queries, oldest first. updated_at is
+	// when the order entered its status (only status changes set it), and
+	// partitions are bucketed by that day so no partition grows without
+	// bound. A transition moves the row to its new (status, day) partition.
+	err = s.session.Query(`
+		CREATE TABLE IF NOT EXISTS ordering.orders_by_status (
+			status      TEXT,
+			day         DATE,
+			updated_at  TIMESTAMP,
+			order_id    TEXT,
+			customer_id TEXT,
+			total_minor BIGINT,
+			currency    TEXT,
+			created_at  TIMESTAMP,
+			PRIMARY KEY ((status, day), updated_at, order_id)
+		) WITH CLUSTERING ORDER BY (updated_at ASC, order_id ASC)
+	`).Exec()
+	if err != nil {
+		return fmt.Errorf("create orders_by_status table: %w", err)
+	}
+
 	err = s.session.Query(`
 		CREATE TABLE IF NOT EXISTS ordering.order_status_history (
 			order_id   TEXT,
@@ -68,52 +200,71 @@ func (s *OrderStore) InitSchema() error {
 	return nil
 }
 
-// CreateOrder inserts a new order with PENDING_PAYMENT status.
-func (s *OrderStore) CreateOrder(_ context.Context, req CreateOrderRequest) (*Order, error) {
+// CreateOrder inserts a new order with CREATED status, priced from snapshots.
+func (s *CassandraOrderStore) CreateOrder(_ context.Context, customerID string, snapshots []ItemSnapshot) (*Order, error) {
 	orderID := uuid.New().String()
 	now := time.Now()
 
-	var total float64
-	for _, item := range req.Items {
-		total += item.Price * float64(item.Quantity)
+	items, total, err := snapshotOrderItems(snapshots)
+	if err != nil {
+		return nil, err
 	}
 
-	// Serialize items as simple JSON string for demo purposes
-	itemsJSON := "["
-	for i, item := range req.Items {
-		if i > 0 {
-			itemsJSON += ","
-		}
-		itemsJSON += fmt.Sprintf(
-			`{"product_id":"%s","quantity":%d,"price":%.2f}`,
-			item.ProductID, item.Quantity, item.Price,
-		)
+	// The snapshot goes first, as a conditional batch on the order's own
+	// partition, so it can only ever be written once. If the order batch
+	// below fails the snapshot is orphaned, which is harmless.
+	snapshotBatch := s.session.NewBatch(gocql.LoggedBatch)
+	for _, snapshot := range snapshots {
+		snapshotBatch.Query(`
+			INSERT INTO ordering.order_item_snapshots
+				(order_id, line_no, product_id, sku, name, unit_price_minor, currency, quantity, captured_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			IF NOT EXISTS
+		`, orderID, snapshot.LineNo, snapshot.ProductID, snapshot.SKU, snapshot.Name,
+			snapshot.UnitPrice.Amount, snapshot.UnitPrice.Currency, snapshot.Quantity, snapshot.CapturedAt)
+	}
+	applied, iter, err := s.session.ExecuteBatchCAS(snapshotBatch)
+	if iter != nil {
+		iter.Close()
 	}
-	itemsJSON += "]"
-
-	err := s.session.Query(`
-		INSERT INTO ordering.orders
-			(order_id, customer_id, status, items, total, payment_id, reason, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, '', '', ?, ?)
-	`, orderID, req.CustomerID, StatusPendingPayment, itemsJSON, total, now, now).Exec()
 	if err != nil {
-		return nil, fmt.Errorf("insert order: %w", err)
+		return nil, fmt.Errorf("insert item snapshots: %w", err)
+	}
+	if !applied {
+		return nil, ErrSnapshotExists
 	}
 
-	// Record initial status in history
-	err = s.session.Query(`
+	// The order, its lines and the initial history entry are written in one
+	// logged batch so a reader never sees an order without its items.
+	batch := s.session.NewBatch(gocql.LoggedBatch)
+	batch.Query(`
+		INSERT INTO ordering.orders
+			(order_id, customer_id, status, total_minor, currency, payment_id, reason, fence_token, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, '', '', 0, ?, ?)
+	`, orderID, customerID, StatusCreated, total.Amount, total.Currency, now, now)
+	for i, item := range items {
+		batch.Query(`
+			INSERT INTO ordering.order_items (order_id, line_no, product_id, quantity, price_minor, currency)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, orderID, i, item.ProductID, item.Quantity, item.Price.Amount, item.Price.Currency)
+	}
+	batch.Query(`
 		INSERT INTO ordering.order_status_history (order_id, changed_at, status, reason)
 		VALUES (?, ?, ?, ?)
-	`, orderID, now, StatusPendingPayment, "order created").Exec()
-	if err != nil {
-		return nil, fmt.Errorf("insert initial status history: %w", err)
+	`, orderID, now, StatusCreated, "order created")
+	batch.Query(insertCustomerIndexCQL, customerID, now, orderID, StatusCreated, total.Amount, total.Currency, now,
+		indexTimestamp(now))
+	batch.Query(insertStatusIndexCQL, StatusCreated, statusDay(now), now, orderID, customerID, total.Amount,
+		total.Currency, now, indexTimestamp(now))
+	if err := s.session.ExecuteBatch(batch); err != nil {
+		return nil, fmt.Errorf("insert order: %w", err)
 	}
 
 	return &Order{
 		OrderID:    orderID,
-		CustomerID: req.CustomerID,
-		Status:     StatusPendingPayment,
-		Items:      req.Items,
+		CustomerID: customerID,
+		Status:     StatusCreated,
+		Items:      items,
 		Total:      total,
 		CreatedAt:  now,
 		UpdatedAt:  now,
@@ -121,12 +272,15 @@ func (s *OrderStore) CreateOrder(_ context.Context, req CreateOrderRequest) (*Or
 }
 
 // GetOrder retrieves an order by ID.
-func (s *OrderStore) GetOrder(_ context.Context, orderID string) (*Order, error) {
+func (s *CassandraOrderStore) GetOrder(_ context.Context, orderID string) (*Order, error) {
 	var order Order
 	var itemsJSON string
+	var legacyTotal float64
+	var totalMinor *int64
+	var currency string
 
 	err := s.session.Query(`
-		SELECT order_id, customer_id, status, items, total, payment_id, reason, created_at, updated_at
+		SELECT order_id, customer_id, status, items, total, total_minor, currency, payment_id, reason, created_at, updated_at
 		FROM ordering.orders
 		WHERE order_id = ?
 	`, orderID).Scan(
@@ -134,7 +288,9 @@ func (s *OrderStore) GetOrder(_ context.Context, orderID string) (*Order, error)
 		&order.CustomerID,
 		&order.Status,
 		&itemsJSON,
-		&order.Total,
+		&legacyTotal,
+		&totalMinor,
+		&currency,
 		&order.PaymentID,
 		&order.Reason,
 		&order.CreatedAt,
@@ -146,21 +302,143 @@ func (s *OrderStore) GetOrder(_ context.Context, orderID string) (*Order, error)
 		}
 		return nil, fmt.Errorf("get order: %w", err)
 	}
+	order.Total = storedMoney(totalMinor, currency, legacyTotal)
+
+	order.Items, err = s.getOrderItems(orderID, itemsJSON)
+	if err != nil {
+		return nil, err
+	}
 
 	return &order, nil
 }
 
-// UpdateOrderStatus updates the order status and records the change in history.
-func (s *OrderStore) UpdateOrderStatus(_ context.Context, orderID, newStatus, reason string) error {
+// getOrderItems reads the order lines from order_items, falling back to the
+// legacy items text column for orders written before that table existed.
+func (s *CassandraOrderStore) getOrderItems(orderID, legacyItemsJSON string) ([]OrderItem, error) {
+	iter := s.session.Query(`
+		SELECT product_id, quantity, price, price_minor, currency
+		FROM ordering.order_items
+		WHERE order_id = ?
+	`, orderID).Iter()
+
+	items := []OrderItem{}
+	var (
+		item        OrderItem
+		legacyPrice float64
+		priceMinor  *int64
+		currency    string
+	)
+	for iter.Scan(&item.ProductID, &item.Quantity, &legacyPrice, &priceMinor, &currency) {
+		item.Price = storedMoney(priceMinor, currency, legacyPrice)
+		items = append(items, item)
+		priceMinor = nil
+	}
+	if err := iter.Close(); err != nil {
+		return nil, fmt.Errorf("get order items: %w", err)
+	}
+
+	if len(items) == 0 && legacyItemsJSON != "" {
+		// The legacy column was built by string concatenation, so a product
+		// id containing a quote may not parse; return no items rather than
+		// failing the whole read.
+		legacy, err := parseLegacyItems(legacyItemsJSON)
+		if err != nil {
+			log.Printf("[store] Order %s: legacy items column is not valid JSON: %v", orderID, err)
+			return []OrderItem{}, nil
+		}
+		items = legacy
+	}
+	return items, nil
+}
+
+// parseLegacyItems reads the orders.items text column written before order
+// lines had their own table, with prices as float64 major units in
+// LegacyCurrency.
+func parseLegacyItems(raw string) ([]OrderItem, error) {
+	var legacy []struct {
+		ProductID string  `json:"product_id"`
+		Quantity  int     `json:"quantity"`
+		Price     float64 `json:"price"`
+	}
+	if err := json.Unmarshal([]byte(raw), &legacy); err != nil {
+		return nil, err
+	}
+	items := make([]OrderItem, 0, len(legacy))
+	for _, l := range legacy {
+		items = append(items, OrderItem{
+			ProductID: l.ProductID,
+			Quantity:  l.Quantity,
+			Price:     MoneyFromFloat(l.Price, LegacyCurrency),
+		})
+	}
+	return items, nil
+}
+
+// BackfillOrderMoney writes total_minor and currency for orders that only
+// have the legacy DOUBLE total, and returns how many rows it converted. It is
+// safe to run repeatedly and alongside traffic: each row is converted with a
+// conditional update that only applies while total_minor is still null.
+func (s *CassandraOrderStore) BackfillOrderMoney(ctx context.Context) (int, error) {
+	iter := s.session.Query(`SELECT order_id, total, total_minor FROM ordering.orders`).WithContext(ctx).Iter()
+
+	var (
+		converted  int
+		orderID    string
+		total      float64
+		totalMinor *int64
+	)
+	for iter.Scan(&orderID, &total, &totalMinor) {
+		money, ok := backfillTotal(total, totalMinor)
+		if !ok {
+			continue
+		}
+		applied, err := s.session.Query(`
+			UPDATE ordering.orders SET total_minor = ?, currency = ?
+			WHERE order_id = ?
+			IF total_minor = null
+		`, money.Amount, money.Currency, orderID).WithContext(ctx).MapScanCAS(make(map[string]interface{}))
+		if err != nil {
+			iter.Close()
+			return converted, fmt.Errorf("backfill order %s: %w", orderID, err)
+		}
+		if applied {
+			converted++
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return converted, fmt.Errorf("scan orders for backfill: %w", err)
+	}
+	return converted, nil
+}
+
+// backfillTotal returns the minor-unit total BackfillOrderMoney writes for a
+// row, and false if the row already has one.
+func backfillTotal(legacy float64, totalMinor *int64) (Money, bool) {
+	if totalMinor != nil {
+		return Money{}, false
+	}
+	return MoneyFromFloat(legacy, LegacyCurrency), true
+}
+
+// UpdateOrderStatus moves the order from expectedStatus to newStatus and
+// records the change in history. The write is a lightweight transaction: if
+// the stored status no longer equals expectedStatus it returns
+// ErrTransitionConflict. A positive fence is the fencing token of the caller's
+// lock lease and the write is also rejected with ErrStaleFence if a newer
+// token has already been persisted; a zero fence skips that check.
+func (s *CassandraOrderStore) UpdateOrderStatus(_ context.Context, orderID, expectedStatus, newStatus, reason string, fence int64, fields OrderFields) error {
 	now := time.Now()
 
-	err := s.session.Query(`
-		UPDATE ordering.orders
-		SET status = ?, reason = ?, updated_at = ?
-		WHERE order_id = ?
-	`, newStatus, reason, now, orderID).Exec()
-	if err != nil {
-		return fmt.Errorf("update order status: %w", err)
+	// The order's current orders_by_status key, read before it changes, so
+	// the old row can be removed. If the read fails the stale row is left
+	// behind for ListOrdersByStatus to drop when it next comes across it.
+	previous, err := s.readOrderSummary(orderID)
+	if err != nil && !errors.Is(err, ErrOrderNotFound) {
+		log.Printf("[store] Order %s: could not read previous status index key: %v", orderID, err)
+	}
+
+	if err := s.casStatus(orderID, expectedStatus, newStatus, reason, fence, fields, now); err != nil {
+		return err
 	}
 
 	// Record status change in history
@@ -172,23 +450,110 @@ func (s *OrderStore) UpdateOrderStatus(_ context.Context, orderID, newStatus, re
 		return fmt.Errorf("insert status history: %w", err)
 	}
 
+	// The listings are derived data: a failed update is logged and repaired
+	// by the index reconciler or on read instead of failing a transition
+	// that is already committed.
+	if err := s.reindexOrder(orderID); err != nil {
+		log.Printf("[store] Order %s: order indexes not updated: %v", orderID, err)
+	}
+	if previous != nil && previous.Status == expectedStatus {
+		if err := s.deleteStatusIndex(*previous, now); err != nil {
+			log.Printf("[store] Order %s: stale orders_by_status row not removed: %v", orderID, err)
+		}
+	}
+
 	return nil
 }
 
-// UpdateOrderPaymentID sets the payment_id field on an order.
-func (s *OrderStore) UpdateOrderPaymentID(_ context.Context, orderID, paymentID string) error {
-	err := s.session.Query(`
-		UPDATE ordering.orders SET payment_id = ? WHERE order_id = ?
-	`, paymentID, orderID).Exec()
+// casStatus runs the conditional UPDATE behind UpdateOrderStatus and turns a
+// rejected condition into the matching sentinel error.
+func (s *CassandraOrderStore) casStatus(orderID, expectedStatus, newStatus, reason string, fence int64, fields OrderFields, now time.Time) error {
+	// Every variant of the update writes the same columns; only the
+	// condition differs.
+	set := `status = ?, reason = ?, updated_at = ?`
+	setArgs := []interface{}{newStatus, reason, now}
+	if fields.PaymentID != "" {
+		set += `, payment_id = ?`
+		setArgs = append(setArgs, fields.PaymentID)
+	}
+	if fence > 0 {
+		set += `, fence_token = ?`
+		setArgs = append(setArgs, fence)
+	}
+	update := func(condition string, conditionArgs ...interface{}) *gocql.Query {
+		args := append(append([]interface{}{}, setArgs...), orderID)
+		return s.session.Query(`UPDATE ordering.orders SET `+set+` WHERE order_id = ? IF `+condition,
+			append(args, conditionArgs...)...)
+	}
+
+	var query *gocql.Query
+	if fence > 0 {
+		query = update(`status = ? AND fence_token <= ?`, expectedStatus, fence)
+	} else {
+		query = update(`status = ?`, expectedStatus)
+	}
+
+	previous := make(map[string]interface{})
+	applied, err := query.MapScanCAS(previous)
+	if err != nil {
+		return fmt.Errorf("update order status: %w", err)
+	}
+	if applied {
+		return nil
+	}
+
+	storedStatus, _ := previous["status"].(string)
+	if storedStatus == "" {
+		return ErrOrderNotFound
+	}
+	if storedStatus != expectedStatus {
+		log.Printf("[store] Order %s: CAS rejected (expected status=%s, found=%s)", orderID, expectedStatus, storedStatus)
+		return ErrTransitionConflict
+	}
+
+	storedFence, _ := previous["fence_token"].(int64)
+	if storedFence > fence {
+		return ErrStaleFence
+	}
+
+	// The status matched and the fence read back as not newer than ours, so
+	// fence_token must be null: a row written before fencing was introduced.
+	// Claim it with an explicit null check instead.
+	applied, err = update(`status = ? AND fence_token = null`, expectedStatus).MapScanCAS(make(map[string]interface{}))
 	if err != nil {
-		return fmt.Errorf("update payment_id: %w", err)
+		return fmt.Errorf("update order status: %w", err)
+	}
+	if !applied {
+		return ErrTransitionConflict
+	}
+	return nil
+}
+
+// addColumnIfMissing runs ALTER TABLE ... ADD unless the column already
+// exists. The table must exist; InitSchema creates it first.
+func addColumnIfMissing(session *gocql.Session, keyspace, table, column, cqlType string) error {
+	var existing string
+	err := session.Query(`
+		SELECT column_name FROM system_schema.columns
+		WHERE keyspace_name = ? AND table_name = ? AND column_name = ?
+	`, keyspace, table, column).Scan(&existing)
+	if err == nil {
+		return nil
+	}
+	if err != gocql.ErrNotFound {
+		return fmt.Errorf("inspect %s.%s.%s: %w", keyspace, table, column, err)
+	}
+
+	stmt := fmt.Sprintf("ALTER TABLE %s.%s ADD %s %s", keyspace, table, column, cqlType)
+	if err := session.Query(stmt).Exec(); err != nil {
+		return fmt.Errorf("add column %s.%s.%s: %w", keyspace, table, column, err)
 	}
 	return nil
 }
 
 // GetOrderHistory returns the status change history for an order,
 // ordered by most recent first.
-func (s *OrderStore) GetOrderHistory(_ context.Context, orderID string) ([]StatusChange, error) {
+func (s *CassandraOrderStore) GetOrderHistory(_ context.Context, orderID string) ([]StatusChange, error) {
 	iter := s.session.Query(`
 		SELECT order_id, changed_at, status, reason
 		FROM ordering.order_status_history
@@ -235,3 +600,336 @@ func ConnectCassandra(host string, timeout time.Duration) (*gocql.Session, error
 		time.Sleep(5 * time.Second)
 	}
 }
+
+func (s *CassandraOrderStore) GetItemSnapshots(_ context.Context, orderID string) ([]ItemSnapshot, error) {
+	iter := s.session.Query(`
+		SELECT order_id, line_no, product_id, sku, name, unit_price_minor, currency, quantity, captured_at
+		FROM ordering.order_item_snapshots
+		WHERE order_id = ?
+	`, orderID).Iter()
+
+	snapshots := []ItemSnapshot{}
+	var sn ItemSnapshot
+	for iter.Scan(&sn.OrderID, &sn.LineNo, &sn.ProductID, &sn.SKU, &sn.Name,
+		&sn.UnitPrice.Amount, &sn.UnitPrice.Currency, &sn.Quantity, &sn.CapturedAt) {
+		snapshots = append(snapshots, sn)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, fmt.Errorf("get item snapshots: %w", err)
+	}
+	return snapshots, nil
+}
+
+const insertCustomerIndexCQL = `
+	INSERT INTO ordering.orders_by_customer
+		(customer_id, created_at, order_id, status, total_minor, currency, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	USING TIMESTAMP ?
+`
+
+// indexTimestamp is the write timestamp of an index row: the order's
+// updated_at at the millisecond precision Cassandra stores it with. Whoever
+// writes the row, and in whatever order writes land, the row for the most
+// recent change wins.
+func indexTimestamp(updatedAt time.Time) int64 {
+	return updatedAt.Truncate(time.Millisecond).UnixMicro()
+}
+
+const insertStatusIndexCQL = `
+	INSERT INTO ordering.orders_by_status
+		(status, day, updated_at, order_id, customer_id, total_minor, currency, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	USING TIMESTAMP ?
+`
+
+// statusDay is the orders_by_status partition an order entering its status
+// at t falls into: the UTC day of t.
+func statusDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+const orderSummaryColumns = `order_id, customer_id, status, total, total_minor, currency, created_at, updated_at`
+
+func scanOrderSummary(scan func(dest ...interface{}) bool) (OrderSummary, bool) {
+	var (
+		o          OrderSummary
+		total      float64
+		totalMinor *int64
+		currency   string
+	)
+	if !scan(&o.OrderID, &o.CustomerID, &o.Status, &total, &totalMinor, &currency, &o.CreatedAt, &o.UpdatedAt) {
+		return OrderSummary{}, false
+	}
+	o.Total = storedMoney(totalMinor, currency, total)
+	return o, true
+}
+
+// readOrderSummary reads the indexed fields of an order from ordering.orders.
+func (s *CassandraOrderStore) readOrderSummary(orderID string) (*OrderSummary, error) {
+	iter := s.session.Query(`SELECT `+orderSummaryColumns+` FROM ordering.orders WHERE order_id = ?`, orderID).Iter()
+	o, ok := scanOrderSummary(iter.Scan)
+	if err := iter.Close(); err != nil {
+		return nil, fmt.Errorf("read order: %w", err)
+	}
+	if !ok {
+		return nil, ErrOrderNotFound
+	}
+	return &o, nil
+}
+
+// reindexOrder rewrites the order's orders_by_customer and orders_by_status
+// rows from ordering.orders.
+func (s *CassandraOrderStore) reindexOrder(orderID string) error {
+	o, err := s.readOrderSummary(orderID)
+	if err != nil {
+		return err
+	}
+	return s.writeIndexes(*o)
+}
+
+func (s *CassandraOrderStore) writeIndexes(o OrderSummary) error {
+	err := s.session.Query(insertCustomerIndexCQL, o.CustomerID, o.CreatedAt, o.OrderID, o.Status,
+		o.Total.Amount, o.Total.Currency, o.UpdatedAt, indexTimestamp(o.UpdatedAt)).Exec()
+	if err != nil {
+		return fmt.Errorf("write orders_by_customer: %w", err)
+	}
+	err = s.session.Query(insertStatusIndexCQL, o.Status, statusDay(o.UpdatedAt), o.UpdatedAt, o.OrderID,
+		o.CustomerID, o.Total.Amount, o.Total.Currency, o.CreatedAt, indexTimestamp(o.UpdatedAt)).Exec()
+	if err != nil {
+		return fmt.Errorf("write orders_by_status: %w", err)
+	}
+	return nil
+}
+
+// deleteStatusIndex removes the orders_by_status row o was indexed under.
+// The tombstone carries the time the order left that status, which is newer
+// than the row's own write timestamp, so a late rewrite of the old row (by
+// the reconciler, say) cannot bring it back.
+func (s *CassandraOrderStore) deleteStatusIndex(o OrderSummary, leftAt time.Time) error {
+	err := s.session.Query(`
+		DELETE FROM ordering.orders_by_status USING TIMESTAMP ?
+		WHERE status = ? AND day = ? AND updated_at = ? AND order_id = ?
+	`, indexTimestamp(leftAt), o.Status, statusDay(o.UpdatedAt), o.UpdatedAt, o.OrderID).Exec()
+	if err != nil {
+		return fmt.Errorf("delete orders_by_status row: %w", err)
+	}
+	return nil
+}
+
+// ReconcileOrderIndexes rewrites the orders_by_customer and orders_by_status
+// rows of every order, for orders created before the tables existed or whose
+// index update failed. It is safe to run at any time: rows carry the order's
+// updated_at as their write timestamp, so a stale copy never overwrites a
+// newer one. Rows left behind in an old status partition are not found by a
+// scan of orders; ListOrdersByStatus drops them when it reads them.
+func (s *CassandraOrderStore) ReconcileOrderIndexes(ctx context.Context) (int, error) {
+	iter := s.session.Query(`SELECT ` + orderSummaryColumns + ` FROM ordering.orders`).WithContext(ctx).Iter()
+
+	indexed := 0
+	for {
+		o, ok := scanOrderSummary(iter.Scan)
+		if !ok {
+			break
+		}
+		if err := s.writeIndexes(o); err != nil {
+			iter.Close()
+			return indexed, fmt.Errorf("index order %s: %w", o.OrderID, err)
+		}
+		indexed++
+	}
+	if err := iter.Close(); err != nil {
+		return indexed, fmt.Errorf("scan orders for index reconciliation: %w", err)
+	}
+	return indexed, nil
+}
+
+// RunIndexReconciler calls ReconcileOrderIndexes every interval until ctx is
+// done.
+func (s *CassandraOrderStore) RunIndexReconciler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			indexed, err := s.ReconcileOrderIndexes(ctx)
+			if err != nil {
+				log.Printf("[store] Index reconciliation stopped after %d orders: %v", indexed, err)
+				continue
+			}
+			log.Printf("[store] Index reconciliation rewrote %d orders", indexed)
+		}
+	}
+}
+
+func (s *CassandraOrderStore) ListCustomerOrders(ctx context.Context, customerID string, filter OrderFilter, pageSize int, pageState []byte) ([]OrderSummary, []byte, error) {
+	cql := `
+		SELECT order_id, customer_id, status, total_minor, currency, created_at, updated_at
+		FROM ordering.orders_by_customer
+		WHERE customer_id = ?`
+	args := []interface{}{customerID}
+	if !filter.From.IsZero() {
+		cql += ` AND created_at >= ?`
+		args = append(args, filter.From)
+	}
+	if !filter.To.IsZero() {
+		cql += ` AND created_at < ?`
+		args = append(args, filter.To)
+	}
+	if filter.Status != "" {
+		// Filtering stays inside one customer's partition, so it is bounded
+		// by that customer's order count. Pages may come back with fewer
+		// rows than pageSize, or none, while more pages remain.
+		cql += ` AND status = ? ALLOW FILTERING`
+		args = append(args, filter.Status)
+	}
+
+	// Setting a page state, even a nil one, turns off gocql's automatic
+	// paging, so exactly one page is read.
+	iter := s.session.Query(cql, args...).WithContext(ctx).PageSize(pageSize).PageState(pageState).Iter()
+	next := iter.PageState()
+
+	orders := []OrderSummary{}
+	var o OrderSummary
+	for iter.Scan(&o.OrderID, &o.CustomerID, &o.Status, &o.Total.Amount, &o.Total.Currency, &o.CreatedAt, &o.UpdatedAt) {
+		orders = append(orders, o)
+	}
+	if err := iter.Close(); err != nil {
+		var reqErr gocql.RequestError
+		if pageState != nil && errors.As(err, &reqErr) && reqErr.Code() == gocql.ErrCodeInvalid {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+		}
+		return nil, nil, fmt.Errorf("list customer orders: %w", err)
+	}
+	if len(next) == 0 {
+		next = nil
+	}
+	return orders, next, nil
+}
+
+// ListOrdersByStatus walks the filter's (status, day) partitions from the
+// day of From to the day of To, oldest first. The page state names the
+// partition to resume in and, inside it, gocql's own paging state.
+//
+// Every row is checked against ordering.orders before it is returned. A row
+// whose order has since moved on, left behind by a transition whose index
+// cleanup failed, is deleted and the order's current rows are rewritten, so
+// the index repairs itself as it is read. Pages can therefore hold fewer
+// rows than pageSize while more pages remain.
+func (s *CassandraOrderStore) ListOrdersByStatus(ctx context.Context, filter OrderFilter, pageSize int, pageState []byte) ([]OrderSummary, []byte, error) {
+	first, last := statusDay(filter.From), statusDay(filter.To.Add(-time.Millisecond))
+	day, state, err := decodeStatusPageState(pageState, first, last)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	orders := []OrderSummary{}
+	for ; !day.After(last); day = day.AddDate(0, 0, 1) {
+		rows, next, err := s.listStatusPartition(ctx, filter, day, pageSize-len(orders), state)
+		if err != nil {
+			if state != nil {
+				var reqErr gocql.RequestError
+				if errors.As(err, &reqErr) && reqErr.Code() == gocql.ErrCodeInvalid {
+					return nil, nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+				}
+			}
+			return nil, nil, err
+		}
+		state = nil
+
+		for _, row := range rows {
+			current, err := s.verifyStatusRow(row)
+			if err != nil {
+				return nil, nil, err
+			}
+			if current {
+				orders = append(orders, row)
+			}
+		}
+
+		if next != nil {
+			return orders, encodeStatusPageState(day, next), nil
+		}
+		if len(orders) >= pageSize && day.Before(last) {
+			return orders, encodeStatusPageState(day.AddDate(0, 0, 1), nil), nil
+		}
+	}
+	return orders, nil, nil
+}
+
+func (s *CassandraOrderStore) listStatusPartition(ctx context.Context, filter OrderFilter, day time.Time, pageSize int, pageState []byte) ([]OrderSummary, []byte, error) {
+	iter := s.session.Query(`
+		SELECT order_id, customer_id, status, total_minor, currency, created_at, updated_at
+		FROM ordering.orders_by_status
+		WHERE status = ? AND day = ? AND updated_at >= ? AND updated_at < ?
+	`, filter.Status, day, filter.From, filter.To).WithContext(ctx).PageSize(pageSize).PageState(pageState).Iter()
+	next := iter.PageState()
+
+	rows := []OrderSummary{}
+	var o OrderSummary
+	for iter.Scan(&o.OrderID, &o.CustomerID, &o.Status, &o.Total.Amount, &o.Total.Currency, &o.CreatedAt, &o.UpdatedAt) {
+		rows = append(rows, o)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, nil, fmt.Errorf("list orders by status: %w", err)
+	}
+	if len(next) == 0 {
+		next = nil
+	}
+	return rows, next, nil
+}
+
+// verifyStatusRow reports whether row still matches its order. A stale row is
+// deleted and the order's current index rows are rewritten.
+func (s *CassandraOrderStore) verifyStatusRow(row OrderSummary) (bool, error) {
+	current, err := s.readOrderSummary(row.OrderID)
+	if err != nil && !errors.Is(err, ErrOrderNotFound) {
+		return false, fmt.Errorf("verify orders_by_status row of %s: %w", row.OrderID, err)
+	}
+	if current != nil && current.Status == row.Status && current.UpdatedAt.Equal(row.UpdatedAt) {
+		return true, nil
+	}
+
+	leftAt := time.Now()
+	if current != nil {
+		leftAt = current.UpdatedAt
+		if err := s.writeIndexes(*current); err != nil {
+			log.Printf("[store] Order %s: order indexes not repaired: %v", row.OrderID, err)
+		}
+	}
+	if err := s.deleteStatusIndex(row, leftAt); err != nil {
+		log.Printf("[store] Order %s: stale orders_by_status row not removed: %v", row.OrderID, err)
+	} else {
+		log.Printf("[store] Order %s: removed stale orders_by_status row (%s since %s)",
+			row.OrderID, row.Status, row.UpdatedAt.Format(time.RFC3339))
+	}
+	return false, nil
+}
+
+// encodeStatusPageState packs the partition day, as days since the Unix
+// epoch, in front of the partition's gocql paging state.
+func encodeStatusPageState(day time.Time, state []byte) []byte {
+	buf := make([]byte, 8, 8+len(state))
+	binary.BigEndian.PutUint64(buf, uint64(day.Unix()/86400))
+	return append(buf, state...)
+}
+
+func decodeStatusPageState(pageState []byte, first, last time.Time) (time.Time, []byte, error) {
+	if pageState == nil {
+		return first, nil, nil
+	}
+	if len(pageState) < 8 {
+		return time.Time{}, nil, fmt.Errorf("%w: short paging state", ErrInvalidCursor)
+	}
+	day := time.Unix(int64(binary.BigEndian.Uint64(pageState))*86400, 0).UTC()
+	if day.Before(first) || day.After(last) {
+		return time.Time{}, nil, fmt.Errorf("%w: day outside the queried range", ErrInvalidCursor)
+	}
+	state := pageState[8:]
+	if len(state) == 0 {
+		state = nil
+	}
+	return day, state, nil
+}
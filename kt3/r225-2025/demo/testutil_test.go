@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// fakeClock is a Clock that only moves when the test advances it.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// testEnv is a StateMachine wired to in-memory backends, the default
+// lifecycle and DefaultAccessPolicy.
+type testEnv struct {
+	store   *MemoryOrderStore
+	refunds *MemoryRefundStore
+	locker  *MemoryLocker
+	sm      *StateMachine
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	lifecycle, err := DefaultLifecycle()
+	if err != nil {
+		t.Fatalf("DefaultLifecycle: %v", err)
+	}
+	env := &testEnv{
+		store:   NewMemoryOrderStore(),
+		refunds: NewMemoryRefundStore(),
+		locker:  NewMemoryLocker(),
+	}
+	env.sm = NewStateMachine(env.store, env.refunds, env.locker, lifecycle, DefaultAccessPolicy, 5*time.Second, 0)
+	return env
+}
+
+// seedOrder creates an order for customerID and puts it straight into
+// status, bypassing the lifecycle. Orders past PENDING_PAYMENT get a
+// payment_id, as they would have in production.
+func (env *testEnv) seedOrder(t *testing.T, customerID, status string) *Order {
+	t.Helper()
+	ctx := context.Background()
+	order, err := env.store.CreateOrder(ctx, customerID, []ItemSnapshot{{
+		ProductID:  "p1",
+		SKU:        "SKU-P1",
+		Name:       "Test product",
+		UnitPrice:  Money{Amount: 4999, Currency: "EUR"},
+		Quantity:   2,
+		CapturedAt: time.Now().UTC(),
+	}})
+	if err != nil {
+		t.Fatalf("CreateOrder: %v", err)
+	}
+	if status == StatusCreated {
+		return order
+	}
+
+	var fields OrderFields
+	if status != StatusPendingPayment && status != StatusPaymentFailed && status != StatusCancelled {
+		fields.PaymentID = "pay_test"
+	}
+	if err := env.store.UpdateOrderStatus(ctx, order.OrderID, StatusCreated, status, "seeded", 0, fields); err != nil {
+		t.Fatalf("seed status %s: %v", status, err)
+	}
+	order, err = env.store.GetOrder(ctx, order.OrderID)
+	if err != nil {
+		t.Fatalf("GetOrder: %v", err)
+	}
+	return order
+}
+
+func (env *testEnv) status(t *testing.T, orderID string) string {
+	t.Helper()
+	order, err := env.store.GetOrder(context.Background(), orderID)
+	if err != nil {
+		t.Fatalf("GetOrder: %v", err)
+	}
+	return order.Status
+}
+
+func asPrincipal(p *Principal) context.Context {
+	return ContextWithPrincipal(context.Background(), p)
+}
+
+// testServer serves the API routes over a testEnv behind Authorize and
+// Idempotency, as main wires them. Requests carry their principal in the
+// context instead of a token.
+type testServer struct {
+	*testEnv
+	shipments *MemoryShipmentStore
+	dedup     *MemoryIdempotencyStore
+	keys      *WebhookKeyring
+	handlers  *Handlers
+	router    chi.Router
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	keys, err := NewWebhookKeyring("k1", []WebhookKey{{ID: "k1", Secret: "s3cret"}}, nil)
+	if err != nil {
+		t.Fatalf("NewWebhookKeyring: %v", err)
+	}
+	s := &testServer{
+		testEnv:   newTestEnv(t),
+		shipments: NewMemoryShipmentStore(),
+		dedup:     NewMemoryIdempotencyStore(),
+		keys:      keys,
+	}
+	s.handlers = NewHandlers(s.store, nil, s.refunds, s.shipments, s.sm, DefaultAccessPolicy, WebhookConfig{
+		Verifier: NewWebhookVerifier(keys, nil, 5*time.Minute, nil),
+		Dedup:    s.dedup,
+		DedupTTL: time.Hour,
+	}, []byte("0123456789abcdef0123456789abcdef"))
+	s.router = chi.NewRouter()
+	s.router.Group(func(r chi.Router) {
+		r.Use(Authorize(DefaultAccessPolicy))
+		r.Use(Idempotency(s.dedup, time.Hour))
+		s.handlers.Routes(r)
+	})
+	return s
+}
+
+// do sends a request as p, with optional header name/value pairs.
+func (s *testServer) do(p *Principal, method, path, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, r.WithContext(ContextWithPrincipal(r.Context(), p)))
+	return rec
+}
+
+// webhook sends event to the v1 shipping webhook, signed with the active
+// key, as the carrier.
+func (s *testServer) webhook(t *testing.T, event ShippingWebhookEvent, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("marshal event: %v", err)
+	}
+	keyID, signature, err := SignWebhookPayload(body, s.keys, time.Now().Unix())
+	if err != nil {
+		t.Fatalf("SignWebhookPayload: %v", err)
+	}
+	header = append([]string{WebhookSignatureHeader, signature, WebhookKeyIDHeader, keyID}, header...)
+	return s.do(testCarrier, http.MethodPost, "/webhooks/shipping", string(body), header...)
+}
+
+// shipSeeded registers shipmentID for a seeded order, as ShipOrder would.
+func (s *testServer) shipSeeded(t *testing.T, orderID, shipmentID string) {
+	t.Helper()
+	if _, err := s.shipments.RegisterShipment(context.Background(), &Shipment{
+		ShipmentID: shipmentID,
+		OrderID:    orderID,
+		Status:     ShipmentStatusRegistered,
+		UpdatedAt:  time.Now().UTC(),
+	}); err != nil {
+		t.Fatalf("RegisterShipment: %v", err)
+	}
+}
+
+var testCarrier = &Principal{Subject: "carrier_1", Role: RoleCarrier}
+
+func decodeJSON(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body.String(), err)
+	}
+}
@@ -3,63 +3,215 @@ package main
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
-	"encoding/json"
-	"log"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"time"
 )
 
-type WebhookSignatureData struct {
-	ShipmentID string `json:"shipment_id"`
-	OrderID    string `json:"order_id"`
-	EventType  string `json:"event_type"`
-	Timestamp  int64  `json:"timestamp"`
+const WebhookSignatureHeader = "X-Webhook-Signature"
+
+// Clock abstracts the current time so webhook freshness checks can be
+// tested deterministically.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// WebhookConfig groups the settings shared by the shipping webhook endpoints.
+// DedupTTL should comfortably exceed the verifier's timestamp tolerance so a
+// replay inside the window is still caught by event_id deduplication.
+type WebhookConfig struct {
+	Verifier *WebhookVerifier
+	Dedup    IdempotencyStore
+	DedupTTL time.Duration
 }
 
-func computeWebhookHMAC(rawBody []byte, secret string) string {
-	var sigData WebhookSignatureData
-	if err := json.Unmarshal(rawBody, &sigData); err != nil {
-		log.Printf("[webhook] Failed to unmarshal payload for HMAC: %v", err)
-		return ""
+// SignatureScheme is one versioned entry of the signature header. Every
+// scheme is an HMAC over "<timestamp>.<raw body>"; only the hash differs,
+// so a stronger algorithm is added as a new version instead of a new endpoint.
+type SignatureScheme struct {
+	Name string
+	Hash func() hash.Hash
+}
+
+// DefaultSignatureSchemes lists the supported schemes, preferred first.
+var DefaultSignatureSchemes = []SignatureScheme{
+	{Name: "v2", Hash: sha512.New},
+	{Name: "v1", Hash: sha256.New},
+}
+
+// LookupSignatureSchemes resolves scheme names such as "v1,v2" against
+// DefaultSignatureSchemes, keeping the default preference order.
+func LookupSignatureSchemes(names string) ([]SignatureScheme, error) {
+	wanted := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			wanted[name] = true
+		}
 	}
 
-	canonical, err := json.Marshal(sigData)
-	if err != nil {
-		log.Printf("[webhook] Failed to marshal canonical payload: %v", err)
-		return ""
+	var schemes []SignatureScheme
+	for _, scheme := range DefaultSignatureSchemes {
+		if wanted[scheme.Name] {
+			schemes = append(schemes, scheme)
+			delete(wanted, scheme.Name)
+		}
+	}
+	for name := range wanted {
+		return nil, fmt.Errorf("unknown signature scheme %q", name)
 	}
+	if len(schemes) == 0 {
+		return nil, fmt.Errorf("no signature schemes configured")
+	}
+	return schemes, nil
+}
+
+// SignatureHeader is the parsed form of "t=<ts>,v1=<sig>,v2=<sig>".
+// A scheme may appear more than once, e.g. while a sender signs with two keys.
+type SignatureHeader struct {
+	Timestamp  int64
+	Signatures map[string][]string
+}
+
+func ParseSignatureHeader(header string) (*SignatureHeader, error) {
+	parsed := &SignatureHeader{Signatures: make(map[string][]string)}
 
-	log.Printf("[webhook] Canonical payload for HMAC: %s", string(canonical))
+	for _, part := range strings.Split(header, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("%w: bad element %q", ErrWebhookSignatureMalformed, part)
+		}
+		if name == "t" {
+			ts, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: bad timestamp %q", ErrWebhookSignatureMalformed, value)
+			}
+			parsed.Timestamp = ts
+			continue
+		}
+		parsed.Signatures[name] = append(parsed.Signatures[name], value)
+	}
 
-	mac := hmac.New(sha256.New, []byte(secret))
-	mac.Write(canonical)
-	return hex.EncodeToString(mac.Sum(nil))
+	if parsed.Timestamp == 0 {
+		return nil, ErrWebhookTimestampMissing
+	}
+	if len(parsed.Signatures) == 0 {
+		return nil, fmt.Errorf("%w: no signatures", ErrWebhookSignatureMalformed)
+	}
+	return parsed, nil
 }
 
-func VerifyWebhookSignature(rawBody []byte, signature, secret string) bool {
-	computed := computeWebhookHMAC(rawBody, secret)
-	if computed == "" {
-		return false
+// VerifiedWebhook describes which key and scheme authenticated a request.
+type VerifiedWebhook struct {
+	KeyID     string
+	Scheme    string
+	Timestamp int64
+}
+
+// WebhookVerifier authenticates webhook requests against a keyring. The
+// header timestamp is part of the signed payload and must lie within
+// tolerance of the clock, which bounds how long a captured request can be
+// replayed.
+type WebhookVerifier struct {
+	keys      *WebhookKeyring
+	schemes   []SignatureScheme
+	tolerance time.Duration
+	clock     Clock
+}
+
+func NewWebhookVerifier(keys *WebhookKeyring, schemes []SignatureScheme, tolerance time.Duration, clock Clock) *WebhookVerifier {
+	if len(schemes) == 0 {
+		schemes = DefaultSignatureSchemes
+	}
+	if clock == nil {
+		clock = systemClock{}
 	}
+	return &WebhookVerifier{keys: keys, schemes: schemes, tolerance: tolerance, clock: clock}
+}
 
-	log.Printf("[webhook] Computed HMAC: %s", computed)
-	log.Printf("[webhook] Provided HMAC: %s", signature)
+// Verify checks the signature header of rawBody. keyID is the optional
+// X-Webhook-Key-Id header value.
+func (v *WebhookVerifier) Verify(header, keyID string, rawBody []byte) (*VerifiedWebhook, error) {
+	parsed, err := ParseSignatureHeader(header)
+	if err != nil {
+		return nil, err
+	}
 
-	return computed == signature
+	if err := CheckWebhookTimestamp(parsed.Timestamp, v.clock.Now(), v.tolerance); err != nil {
+		return nil, err
+	}
+
+	var matched string
+	matchedKey, err := v.keys.Verify(keyID, func(secret string) bool {
+		for _, scheme := range v.schemes {
+			expected := computeSignature(scheme, secret, parsed.Timestamp, rawBody)
+			for _, candidate := range parsed.Signatures[scheme.Name] {
+				provided, err := hex.DecodeString(candidate)
+				if err != nil {
+					continue
+				}
+				if hmac.Equal(expected, provided) {
+					matched = scheme.Name
+					return true
+				}
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &VerifiedWebhook{KeyID: matchedKey, Scheme: matched, Timestamp: parsed.Timestamp}, nil
 }
 
-func SignWebhookPayload(rawBody []byte, secret string) string {
-	return computeWebhookHMAC(rawBody, secret)
+// SignWebhookPayload produces a signature header for rawBody using the
+// keyring's active key and every given scheme (DefaultSignatureSchemes if
+// none), and returns the key id to send in X-Webhook-Key-Id.
+func SignWebhookPayload(rawBody []byte, keys *WebhookKeyring, timestamp int64, schemes ...SignatureScheme) (keyID, header string, err error) {
+	key, err := keys.Active()
+	if err != nil {
+		return "", "", err
+	}
+	if len(schemes) == 0 {
+		schemes = DefaultSignatureSchemes
+	}
+
+	parts := []string{fmt.Sprintf("t=%d", timestamp)}
+	for _, scheme := range schemes {
+		sig := computeSignature(scheme, key.Secret, timestamp, rawBody)
+		parts = append(parts, scheme.Name+"="+hex.EncodeToString(sig))
+	}
+	return key.ID, strings.Join(parts, ","), nil
 }
 
-func VerifyWebhookSignatureRaw(rawBody []byte, signature, secret string) bool {
-	mac := hmac.New(sha256.New, []byte(secret))
+func computeSignature(scheme SignatureScheme, secret string, timestamp int64, rawBody []byte) []byte {
+	mac := hmac.New(scheme.Hash, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
 	mac.Write(rawBody)
-	computed := hex.EncodeToString(mac.Sum(nil))
-	return computed == signature
+	return mac.Sum(nil)
 }
 
-func SignWebhookPayloadRaw(rawBody []byte, secret string) string {
-	mac := hmac.New(sha256.New, []byte(secret))
-	mac.Write(rawBody)
-	return hex.EncodeToString(mac.Sum(nil))
+// CheckWebhookTimestamp verifies that ts (unix seconds, covered by the
+// signature) lies within tolerance of now. It returns ErrWebhookTimestampMissing
+// or a wrapped ErrWebhookTimestampStale describing the drift.
+func CheckWebhookTimestamp(ts int64, now time.Time, tolerance time.Duration) error {
+	if ts <= 0 {
+		return ErrWebhookTimestampMissing
+	}
+
+	drift := now.Sub(time.Unix(ts, 0))
+	if drift > tolerance || drift < -tolerance {
+		return fmt.Errorf("%w: event time %s is %v away from server time (allowed ±%v)",
+			ErrWebhookTimestampStale, time.Unix(ts, 0).UTC().Format(time.RFC3339), drift.Round(time.Second), tolerance)
+	}
+	return nil
 }
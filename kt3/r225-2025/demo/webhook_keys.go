@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const WebhookKeyIDHeader = "X-Webhook-Key-Id"
+
+// WebhookKey is one named carrier secret. A zero NotBefore or NotAfter leaves
+// that side of the validity window open.
+type WebhookKey struct {
+	ID        string    `json:"id"`
+	Secret    string    `json:"secret"`
+	NotBefore time.Time `json:"not_before,omitempty"`
+	NotAfter  time.Time `json:"not_after,omitempty"`
+}
+
+func (k WebhookKey) validAt(now time.Time) bool {
+	if !k.NotBefore.IsZero() && now.Before(k.NotBefore) {
+		return false
+	}
+	if !k.NotAfter.IsZero() && !now.Before(k.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// WebhookKeyring holds the active signing key plus any previous keys that
+// are still accepted for verification, so the carrier secret can be rotated
+// without a coordinated restart.
+type WebhookKeyring struct {
+	keys     []WebhookKey
+	activeID string
+	clock    Clock
+}
+
+func NewWebhookKeyring(activeID string, keys []WebhookKey, clock Clock) (*WebhookKeyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("webhook keyring: no keys configured")
+	}
+	if clock == nil {
+		clock = systemClock{}
+	}
+
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key.ID == "" || key.Secret == "" {
+			return nil, errors.New("webhook keyring: every key needs an id and a secret")
+		}
+		if seen[key.ID] {
+			return nil, fmt.Errorf("webhook keyring: duplicate key id %q", key.ID)
+		}
+		seen[key.ID] = true
+	}
+	if !seen[activeID] {
+		return nil, fmt.Errorf("webhook keyring: active key %q is not configured", activeID)
+	}
+
+	return &WebhookKeyring{keys: keys, activeID: activeID, clock: clock}, nil
+}
+
+// ParseWebhookKeys decodes a JSON array of WebhookKey, as supplied in the
+// WEBHOOK_KEYS environment variable.
+func ParseWebhookKeys(data string) ([]WebhookKey, error) {
+	var keys []WebhookKey
+	if err := json.Unmarshal([]byte(data), &keys); err != nil {
+		return nil, fmt.Errorf("parse webhook keys: %w", err)
+	}
+	return keys, nil
+}
+
+// Active returns the key outgoing payloads are signed with.
+func (k *WebhookKeyring) Active() (WebhookKey, error) {
+	for _, key := range k.keys {
+		if key.ID == k.activeID {
+			if !key.validAt(k.clock.Now()) {
+				return WebhookKey{}, fmt.Errorf("%w: %s", ErrWebhookKeyNotValid, key.ID)
+			}
+			return key, nil
+		}
+	}
+	return WebhookKey{}, fmt.Errorf("%w: %s", ErrWebhookKeyUnknown, k.activeID)
+}
+
+// IDs lists the configured key ids, for startup logging.
+func (k *WebhookKeyring) IDs() []string {
+	ids := make([]string, 0, len(k.keys))
+	for _, key := range k.keys {
+		ids = append(ids, key.ID)
+	}
+	return ids
+}
+
+// Verify runs check against the candidate keys and returns the id of the
+// first key that matches. With a keyID only that key is tried; without one
+// every key valid right now is tried. Keys outside their validity window
+// never match.
+func (k *WebhookKeyring) Verify(keyID string, check func(secret string) bool) (string, error) {
+	now := k.clock.Now()
+
+	if keyID != "" {
+		for _, key := range k.keys {
+			if key.ID != keyID {
+				continue
+			}
+			if !key.validAt(now) {
+				return "", fmt.Errorf("%w: %s", ErrWebhookKeyNotValid, keyID)
+			}
+			if check(key.Secret) {
+				return key.ID, nil
+			}
+			return "", ErrWebhookSignatureInvalid
+		}
+		return "", fmt.Errorf("%w: %s", ErrWebhookKeyUnknown, keyID)
+	}
+
+	for _, key := range k.keys {
+		if key.validAt(now) && check(key.Secret) {
+			return key.ID, nil
+		}
+	}
+	return "", ErrWebhookSignatureInvalid
+}
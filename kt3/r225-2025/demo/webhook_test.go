@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookVerifierTimestampWindow(t *testing.T) {
+	clock := newFakeClock()
+	keys, err := NewWebhookKeyring("k1", []WebhookKey{{ID: "k1", Secret: "s3cret"}}, clock)
+	if err != nil {
+		t.Fatalf("NewWebhookKeyring: %v", err)
+	}
+	verifier := NewWebhookVerifier(keys, nil, 5*time.Minute, clock)
+	body := []byte(`{"event_id":"e1","shipment_id":"s1","status":"DELIVERED"}`)
+
+	tests := []struct {
+		name    string
+		skew    time.Duration
+		wantErr error
+	}{
+		{"now", 0, nil},
+		{"at the past edge", -5 * time.Minute, nil},
+		{"at the future edge", 5 * time.Minute, nil},
+		{"too old", -5*time.Minute - time.Second, ErrWebhookTimestampStale},
+		{"too far ahead", 5*time.Minute + time.Second, ErrWebhookTimestampStale},
+	}
+	for _, tc := range tests {
+		ts := clock.Now().Add(tc.skew).Unix()
+		keyID, header, err := SignWebhookPayload(body, keys, ts)
+		if err != nil {
+			t.Fatalf("%s: SignWebhookPayload: %v", tc.name, err)
+		}
+		_, err = verifier.Verify(header, keyID, body)
+		if tc.wantErr == nil && err != nil {
+			t.Errorf("%s: Verify: %v", tc.name, err)
+		}
+		if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: Verify: err = %v, want %v", tc.name, err, tc.wantErr)
+		}
+	}
+
+	// A request captured now stops verifying once the window has passed.
+	keyID, header, _ := SignWebhookPayload(body, keys, clock.Now().Unix())
+	clock.Advance(5*time.Minute + time.Second)
+	if _, err := verifier.Verify(header, keyID, body); !errors.Is(err, ErrWebhookTimestampStale) {
+		t.Fatalf("replay after the window: err = %v, want ErrWebhookTimestampStale", err)
+	}
+}
+
+func TestWebhookVerifierRejectsMissingTimestamp(t *testing.T) {
+	keys, err := NewWebhookKeyring("k1", []WebhookKey{{ID: "k1", Secret: "s3cret"}}, nil)
+	if err != nil {
+		t.Fatalf("NewWebhookKeyring: %v", err)
+	}
+	verifier := NewWebhookVerifier(keys, nil, 5*time.Minute, newFakeClock())
+	if _, err := verifier.Verify("v1=00", "k1", []byte("{}")); !errors.Is(err, ErrWebhookTimestampMissing) {
+		t.Fatalf("err = %v, want ErrWebhookTimestampMissing", err)
+	}
+}
+
+// signedHeader builds a signature header for body by hand, so tests can sign
+// with keys the keyring would no longer pick and combine schemes freely.
+func signedHeader(secret string, ts int64, body []byte, schemes ...SignatureScheme) string {
+	parts := []string{fmt.Sprintf("t=%d", ts)}
+	for _, scheme := range schemes {
+		parts = append(parts, scheme.Name+"="+hex.EncodeToString(computeSignature(scheme, secret, ts, body)))
+	}
+	return strings.Join(parts, ",")
+}
+
+func TestWebhookKeyRotation(t *testing.T) {
+	clock := newFakeClock()
+	rotatedAt := clock.Now()
+	keys, err := NewWebhookKeyring("k2", []WebhookKey{
+		{ID: "k1", Secret: "old-secret", NotAfter: rotatedAt.Add(time.Hour)},
+		{ID: "k2", Secret: "new-secret", NotBefore: rotatedAt},
+	}, clock)
+	if err != nil {
+		t.Fatalf("NewWebhookKeyring: %v", err)
+	}
+	verifier := NewWebhookVerifier(keys, nil, 5*time.Minute, clock)
+	body := []byte(`{"event_id":"e1","shipment_id":"s1","status":"DELIVERED"}`)
+	v1 := DefaultSignatureSchemes[1]
+
+	// Inside its window the old key still verifies, named or not.
+	header := signedHeader("old-secret", clock.Now().Unix(), body, v1)
+	for _, keyID := range []string{"k1", ""} {
+		got, err := verifier.Verify(header, keyID, body)
+		if err != nil || got.KeyID != "k1" {
+			t.Errorf("old key, key id %q: got %+v, err %v", keyID, got, err)
+		}
+	}
+	if _, err := verifier.Verify(header, "k2", body); !errors.Is(err, ErrWebhookSignatureInvalid) {
+		t.Errorf("old signature under k2: err = %v, want ErrWebhookSignatureInvalid", err)
+	}
+	if _, err := verifier.Verify(header, "k9", body); !errors.Is(err, ErrWebhookKeyUnknown) {
+		t.Errorf("unknown key id: err = %v, want ErrWebhookKeyUnknown", err)
+	}
+
+	// Past NotAfter the old key is refused even with a fresh timestamp.
+	clock.Advance(time.Hour)
+	header = signedHeader("old-secret", clock.Now().Unix(), body, v1)
+	if _, err := verifier.Verify(header, "k1", body); !errors.Is(err, ErrWebhookKeyNotValid) {
+		t.Errorf("expired key: err = %v, want ErrWebhookKeyNotValid", err)
+	}
+	if _, err := verifier.Verify(header, "", body); !errors.Is(err, ErrWebhookSignatureInvalid) {
+		t.Errorf("expired key without key id: err = %v, want ErrWebhookSignatureInvalid", err)
+	}
+
+	keyID, header, err := SignWebhookPayload(body, keys, clock.Now().Unix())
+	if err != nil {
+		t.Fatalf("SignWebhookPayload: %v", err)
+	}
+	if got, err := verifier.Verify(header, keyID, body); err != nil || got.KeyID != "k2" {
+		t.Errorf("active key: got %+v, err %v", got, err)
+	}
+}
+
+func TestParseSignatureHeader(t *testing.T) {
+	parsed, err := ParseSignatureHeader(" t=1735732800 , v1=aa,v2=cc,v1=bb")
+	if err != nil {
+		t.Fatalf("ParseSignatureHeader: %v", err)
+	}
+	if parsed.Timestamp != 1735732800 {
+		t.Errorf("timestamp %d, want 1735732800", parsed.Timestamp)
+	}
+	if got := parsed.Signatures["v1"]; !equalStrings(got, []string{"aa", "bb"}) {
+		t.Errorf("v1 signatures %v, want [aa bb]", got)
+	}
+	if got := parsed.Signatures["v2"]; !equalStrings(got, []string{"cc"}) {
+		t.Errorf("v2 signatures %v, want [cc]", got)
+	}
+
+	tests := []struct {
+		header  string
+		wantErr error
+	}{
+		{"v1=aa", ErrWebhookTimestampMissing},
+		{"t=0,v1=aa", ErrWebhookTimestampMissing},
+		{"t=soon,v1=aa", ErrWebhookSignatureMalformed},
+		{"t=1735732800", ErrWebhookSignatureMalformed},
+		{"t=1735732800,v1", ErrWebhookSignatureMalformed},
+		{"t=1735732800,v1=", ErrWebhookSignatureMalformed},
+		{"t=1735732800,=aa", ErrWebhookSignatureMalformed},
+		{"", ErrWebhookSignatureMalformed},
+	}
+	for _, tc := range tests {
+		if _, err := ParseSignatureHeader(tc.header); !errors.Is(err, tc.wantErr) {
+			t.Errorf("%q: err = %v, want %v", tc.header, err, tc.wantErr)
+		}
+	}
+}
+
+func TestWebhookVerifierSchemes(t *testing.T) {
+	clock := newFakeClock()
+	keys, err := NewWebhookKeyring("k1", []WebhookKey{{ID: "k1", Secret: "s3cret"}}, clock)
+	if err != nil {
+		t.Fatalf("NewWebhookKeyring: %v", err)
+	}
+	body := []byte(`{"event_id":"e1"}`)
+	ts := clock.Now().Unix()
+	v2, v1 := DefaultSignatureSchemes[0], DefaultSignatureSchemes[1]
+	v2Only, err := LookupSignatureSchemes("v2")
+	if err != nil {
+		t.Fatalf("LookupSignatureSchemes: %v", err)
+	}
+
+	valid := signedHeader("s3cret", ts, body, v1, v2)
+	wrongV1 := strings.Split(signedHeader("other", ts, body, v1), ",")[1]
+	goodV1 := strings.Split(signedHeader("s3cret", ts, body, v1), ",")[1]
+
+	tests := []struct {
+		name       string
+		schemes    []SignatureScheme
+		header     string
+		wantScheme string
+		wantErr    error
+	}{
+		{"v2 preferred over v1", nil, valid, "v2", nil},
+		{"v1 alone", nil, signedHeader("s3cret", ts, body, v1), "v1", nil},
+		{"bad v2 falls back to v1", nil, fmt.Sprintf("t=%d,v2=00,%s", ts, goodV1), "v1", nil},
+		{"second of two v1 entries", nil, fmt.Sprintf("t=%d,%s,%s", ts, wrongV1, goodV1), "v1", nil},
+		{"not hex", nil, fmt.Sprintf("t=%d,v1=zz", ts), "", ErrWebhookSignatureInvalid},
+		{"unknown scheme only", nil, fmt.Sprintf("t=%d,v9=00", ts), "", ErrWebhookSignatureInvalid},
+		{"v1 when only v2 is accepted", v2Only, signedHeader("s3cret", ts, body, v1), "", ErrWebhookSignatureInvalid},
+	}
+	for _, tc := range tests {
+		verifier := NewWebhookVerifier(keys, tc.schemes, 5*time.Minute, clock)
+		got, err := verifier.Verify(tc.header, "k1", body)
+		if tc.wantErr != nil {
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("%s: err = %v, want %v", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Verify: %v", tc.name, err)
+			continue
+		}
+		if got.Scheme != tc.wantScheme {
+			t.Errorf("%s: verified with %s, want %s", tc.name, got.Scheme, tc.wantScheme)
+		}
+	}
+}
+
+func TestWebhookVerifierRejectsTamperedRequest(t *testing.T) {
+	clock := newFakeClock()
+	keys, err := NewWebhookKeyring("k1", []WebhookKey{{ID: "k1", Secret: "s3cret"}}, clock)
+	if err != nil {
+		t.Fatalf("NewWebhookKeyring: %v", err)
+	}
+	verifier := NewWebhookVerifier(keys, nil, 5*time.Minute, clock)
+	body := []byte(`{"event_id":"e1","shipment_id":"s1","status":"IN_TRANSIT"}`)
+	ts := clock.Now().Unix()
+	keyID, header, err := SignWebhookPayload(body, keys, ts)
+	if err != nil {
+		t.Fatalf("SignWebhookPayload: %v", err)
+	}
+
+	tampered := []byte(strings.Replace(string(body), "IN_TRANSIT", "LOST", 1))
+	if _, err := verifier.Verify(header, keyID, tampered); !errors.Is(err, ErrWebhookSignatureInvalid) {
+		t.Errorf("tampered body: err = %v, want ErrWebhookSignatureInvalid", err)
+	}
+	if _, err := verifier.Verify(header, keyID, append(body, ' ')); !errors.Is(err, ErrWebhookSignatureInvalid) {
+		t.Errorf("body with trailing space: err = %v, want ErrWebhookSignatureInvalid", err)
+	}
+
+	// The timestamp is signed too: moving it forward breaks the signature.
+	moved := strings.Replace(header, fmt.Sprintf("t=%d", ts), fmt.Sprintf("t=%d", ts+60), 1)
+	if _, err := verifier.Verify(moved, keyID, body); !errors.Is(err, ErrWebhookSignatureInvalid) {
+		t.Errorf("moved timestamp: err = %v, want ErrWebhookSignatureInvalid", err)
+	}
+}
+
+func TestShippingWebhookDedup(t *testing.T) {
+	s := newTestServer(t)
+	order := s.seedOrder(t, "c1", StatusShipping)
+	s.shipSeeded(t, order.OrderID, "SH-1")
+	event := ShippingWebhookEvent{
+		EventID:    "evt-1",
+		ShipmentID: "SH-1",
+		EventType:  "status_update",
+		Status:     ShipStatusDelivered,
+		Timestamp:  time.Now().Unix(),
+	}
+
+	first := s.webhook(t, event)
+	if first.Code != http.StatusOK {
+		t.Fatalf("first delivery: status %d: %s", first.Code, first.Body)
+	}
+
+	second := s.webhook(t, event)
+	var dup DuplicateWebhookResponse
+	decodeJSON(t, second, &dup)
+	if second.Code != http.StatusOK || !dup.Duplicate || dup.OriginalStatus != http.StatusOK {
+		t.Fatalf("redelivery: status %d, %+v", second.Code, dup)
+	}
+	if string(dup.OriginalResponse) != strings.TrimSpace(first.Body.String()) {
+		t.Errorf("redelivery original_response = %s, want %s", dup.OriginalResponse, first.Body)
+	}
+	history, err := s.store.GetOrderHistory(context.Background(), order.OrderID)
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+	if n := countTransitions(history, StatusDelivered); n != 1 {
+		t.Errorf("order moved to DELIVERED %d times, want 1", n)
+	}
+
+	// The same event_id with another payload is not a redelivery.
+	event.Status = ShipStatusLost
+	if rec := s.webhook(t, event); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reused event_id: status %d, want 422", rec.Code)
+	}
+}
+
+func TestShippingWebhookDedupReleasedOnFailure(t *testing.T) {
+	s := newTestServer(t)
+	order := s.seedOrder(t, "c1", StatusShipping)
+	event := ShippingWebhookEvent{EventID: "evt-1", ShipmentID: "SH-1", Status: ShipStatusDelivered, Timestamp: time.Now().Unix()}
+
+	// The carrier reports before ShipOrder has registered the shipment.
+	if rec := s.webhook(t, event); rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown shipment: status %d, want 404", rec.Code)
+	}
+
+	s.shipSeeded(t, order.OrderID, "SH-1")
+	rec := s.webhook(t, event)
+	var resp ShippingWebhookResponse
+	decodeJSON(t, rec, &resp)
+	if rec.Code != http.StatusOK || resp.NewStatus != StatusDelivered {
+		t.Fatalf("retry: status %d, %s", rec.Code, rec.Body)
+	}
+	if got := s.status(t, order.OrderID); got != StatusDelivered {
+		t.Errorf("order status %s, want DELIVERED", got)
+	}
+}
+
+func TestShippingWebhookDedupKeysAreSeparateFromIdempotencyKeys(t *testing.T) {
+	s := newTestServer(t)
+	order := s.seedOrder(t, "c1", StatusShipping)
+	s.shipSeeded(t, order.OrderID, "SH-1")
+	event := ShippingWebhookEvent{EventID: "evt-1", ShipmentID: "SH-1", Status: ShipStatusInTransit, Timestamp: time.Now().Unix()}
+
+	// A client Idempotency-Key spelled like a dedup key claims nothing in
+	// the dedup namespace.
+	customer := &Principal{Subject: "c1", CustomerID: "c1", Role: RoleCustomer}
+	cancel := s.do(customer, http.MethodPost, "/orders/"+order.OrderID+"/cancel", `{"reason":"x"}`,
+		IdempotencyKeyHeader, "dedup:evt-1")
+	if cancel.Code == http.StatusOK {
+		t.Fatalf("cancel of a shipping order succeeded")
+	}
+
+	rec := s.webhook(t, event, IdempotencyKeyHeader, "dedup:evt-1")
+	var resp ShippingWebhookResponse
+	decodeJSON(t, rec, &resp)
+	if rec.Code != http.StatusOK || resp.OrderID != order.OrderID {
+		t.Fatalf("webhook: status %d, %s", rec.Code, rec.Body)
+	}
+
+	s.dedup.mu.Lock()
+	defer s.dedup.mu.Unlock()
+	var dedupKeys, idemKeys int
+	for key := range s.dedup.records {
+		switch {
+		case key == "dedup:evt-1":
+			dedupKeys++
+		case strings.HasPrefix(key, "idempotency:"):
+			idemKeys++
+		default:
+			t.Errorf("unexpected key %q", key)
+		}
+	}
+	if dedupKeys != 1 || idemKeys != 2 {
+		t.Errorf("stored %d dedup and %d idempotency keys, want 1 and 2", dedupKeys, idemKeys)
+	}
+}
+
+func countTransitions(history []StatusChange, status string) int {
+	n := 0
+	for _, h := range history {
+		if h.Status == status {
+			n++
+		}
+	}
+	return n
+}
